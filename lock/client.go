@@ -14,9 +14,78 @@
 
 package lock
 
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// ErrCompareFailed is returned by LockClient.Set if the semaphore was
+// modified by another client since it was read.
+var ErrCompareFailed = errors.New("compare failed")
+
 // LockClient is a generic interface for a lock
+// Set must only store the semaphore if it has not been modified since it was
+// returned by Get, and return ErrCompareFailed otherwise.
 type LockClient interface {
 	Init() error
 	Get() (*Semaphore, error)
 	Set(*Semaphore) error
 }
+
+// ContextLockClient is a LockClient whose operations can be bounded by a
+// context. All LockClients of this package implement it; Lock uses the
+// context variants if the client implements them.
+type ContextLockClient interface {
+	LockClient
+	InitContext(context.Context) error
+	GetContext(context.Context) (*Semaphore, error)
+	SetContext(context.Context, *Semaphore) error
+}
+
+// withContext returns c as a ContextLockClient. Clients which don't
+// implement it ignore the context.
+func withContext(c LockClient) ContextLockClient {
+	if cc, ok := c.(ContextLockClient); ok {
+		return cc
+	}
+
+	return backgroundClient{c}
+}
+
+// backgroundClient adds context variants ignoring the context to a
+// LockClient.
+type backgroundClient struct {
+	LockClient
+}
+
+func (c backgroundClient) InitContext(ctx context.Context) error {
+	return c.Init()
+}
+
+func (c backgroundClient) GetContext(ctx context.Context) (*Semaphore, error) {
+	return c.Get()
+}
+
+func (c backgroundClient) SetContext(ctx context.Context, sem *Semaphore) error {
+	return c.Set(sem)
+}
+
+// Watch watches the semaphore if the client is a Watcher. Otherwise it blocks
+// until the context is done, so that the semaphore is polled.
+func (c backgroundClient) Watch(ctx context.Context, index uint64) error {
+	if w, ok := c.LockClient.(Watcher); ok {
+		return w.Watch(ctx, index)
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Watcher is implemented by LockClients which can wait for the semaphore to
+// change. Clients which don't implement it are polled instead.
+type Watcher interface {
+	// Watch blocks until the semaphore is modified after the given index,
+	// or the context is done.
+	Watch(ctx context.Context, index uint64) error
+}
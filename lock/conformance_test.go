@@ -0,0 +1,91 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/lock"
+	"github.com/coreos/locksmith/lock/locktest"
+)
+
+func TestFileLockClientConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith_conformance_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	locktest.TestLockClient(t, func(t *testing.T) lock.LockClient {
+		n++
+		c, err := lock.NewFileLockClient(context.Background(), filepath.Join(dir, fmt.Sprint(n)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
+
+func TestEtcdLockClientConformance(t *testing.T) {
+	locktest.TestLockClient(t, func(t *testing.T) lock.LockClient {
+		c, err := lock.NewTestEtcdLockClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
+
+func TestEtcdV3LockClientConformance(t *testing.T) {
+	locktest.TestLockClient(t, func(t *testing.T) lock.LockClient {
+		c, err := lock.NewTestEtcdV3LockClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
+
+func TestKubernetesLockClientConformance(t *testing.T) {
+	locktest.TestLockClient(t, func(t *testing.T) lock.LockClient {
+		c, err := lock.NewTestKubernetesLockClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
+
+func TestConsulLockClientConformance(t *testing.T) {
+	var stops []func()
+	defer func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}()
+
+	locktest.TestLockClient(t, func(t *testing.T) lock.LockClient {
+		c, stop := lock.NewTestConsulLockClient(t)
+		stops = append(stops, stop)
+		return c
+	})
+}
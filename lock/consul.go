@@ -0,0 +1,325 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/consul"
+)
+
+const (
+	// minSessionTTL and maxSessionTTL are the bounds Consul puts on session
+	// TTLs, in seconds.
+	minSessionTTL = 10
+	maxSessionTTL = 86400
+)
+
+// ConsulKV is the minimum Consul API ConsulLockClient needs to do its job.
+type ConsulKV interface {
+	Get(ctx context.Context, key string) (*consul.KVPair, error)
+	List(ctx context.Context, prefix string) ([]*consul.KVPair, error)
+	Txn(ctx context.Context, ops []consul.TxnOp) (bool, error)
+	CreateSession(ctx context.Context, name string, ttl int64) (string, error)
+	DestroySession(ctx context.Context, id string) error
+	Watch(ctx context.Context, key string, index uint64) error
+}
+
+// ConsulLockClient is a LockClient storing the semaphore in the Consul KV
+// store. The semaphore is swapped with check-and-set on its modify index, and
+// every holder with a lease is backed by a key locked by a Consul session with
+// the lease as TTL, so holders are expired by Consul itself rather than by the
+// clocks of the machines. Consul may take up to twice the TTL to invalidate a
+// session.
+type ConsulLockClient struct {
+	kv      ConsulKV
+	keypath string
+}
+
+// NewConsulLockClient creates a new ConsulLockClient. The group parameter
+// defines the key in which the client will manipulate the semaphore, using
+// the same layout as EtcdLockClient. If the group is the empty string, the
+// default semaphore will be used. The semaphore is initialized within the
+// given context.
+func NewConsulLockClient(ctx context.Context, kv ConsulKV, group string) (*ConsulLockClient, error) {
+	clc := &ConsulLockClient{kv, semaphoreKey(group)}
+	if err := clc.InitContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return clc, nil
+}
+
+// holderKey returns the key backing the lease of holder id.
+func (c *ConsulLockClient) holderKey(id string) string {
+	return path.Join(c.keypath, holderBranch, url.QueryEscape(id))
+}
+
+// Init is InitContext without a deadline.
+func (c *ConsulLockClient) Init() error {
+	return c.InitContext(context.Background())
+}
+
+// InitContext sets an initial copy of the semaphore if it doesn't exist yet.
+func (c *ConsulLockClient) InitContext(ctx context.Context) error {
+	b, err := json.Marshal(newSemaphore())
+	if err != nil {
+		return err
+	}
+
+	// check-and-set with index 0 only creates the key; the transaction
+	// failing just means the semaphore already exists.
+	_, err = c.kv.Txn(ctx, []consul.TxnOp{{Verb: consul.VerbCAS, Key: c.keypath, Value: b, Index: 0}})
+	return err
+}
+
+// Get is GetContext without a deadline.
+func (c *ConsulLockClient) Get() (*Semaphore, error) {
+	return c.GetContext(context.Background())
+}
+
+// GetContext fetches the Semaphore from Consul. Holders with a lease whose backing
+// key has been removed by Consul are marked as expired.
+func (c *ConsulLockClient) GetContext(ctx context.Context) (*Semaphore, error) {
+	pair, err := c.kv.Get(ctx, c.keypath)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, ErrSemaphoreNotFound
+	}
+
+	sem := &Semaphore{}
+	if err := json.Unmarshal(pair.Value, sem); err != nil {
+		return nil, err
+	}
+
+	sem.Index = pair.ModifyIndex
+
+	live, err := c.liveHolders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, info := range sem.HolderInfo {
+		if _, ok := live[id]; !ok && info.ExpireTime != 0 {
+			info.ExpireTime = 1
+		}
+	}
+
+	return sem, nil
+}
+
+// liveHolders returns the holder keys currently present in Consul, keyed by
+// holder id.
+func (c *ConsulLockClient) liveHolders(ctx context.Context) (map[string]*consul.KVPair, error) {
+	prefix := path.Join(c.keypath, holderBranch) + "/"
+	pairs, err := c.kv.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]*consul.KVPair)
+	for _, pair := range pairs {
+		id, err := url.QueryUnescape(strings.TrimPrefix(pair.Key, prefix))
+		if err != nil {
+			return nil, err
+		}
+		live[id] = pair
+	}
+
+	return live, nil
+}
+
+// Set is SetContext without a deadline.
+func (c *ConsulLockClient) Set(sem *Semaphore) error {
+	return c.SetContext(context.Background(), sem)
+}
+
+// SetContext sets a Semaphore in Consul. The semaphore is only written if it was not
+// modified since it was read, in which case ErrCompareFailed is returned.
+// Holder keys are locked by a new session whenever the expire time of the
+// holder changes, and removed once the holder is gone. Holders whose session
+// has already expired are not given a new one.
+func (c *ConsulLockClient) SetContext(ctx context.Context, sem *Semaphore) error {
+	if sem == nil {
+		return errors.New("cannot set nil semaphore")
+	}
+	b, err := json.Marshal(sem)
+	if err != nil {
+		return err
+	}
+
+	live, err := c.liveHolders(ctx)
+	if err != nil {
+		return err
+	}
+
+	op := consul.TxnOp{Verb: consul.VerbSet, Key: c.keypath, Value: b}
+	if sem.Index != 0 {
+		op.Verb, op.Index = consul.VerbCAS, sem.Index
+	}
+	ops := []consul.TxnOp{op}
+
+	// sessions replaced by this update, destroyed once it succeeded.
+	var replaced, created []string
+
+	t := now()
+	for id, info := range sem.HolderInfo {
+		if info.ExpireTime == 0 || info.Expired(t) {
+			continue
+		}
+
+		expire := strconv.FormatInt(info.ExpireTime, 10)
+		old, ok := live[id]
+		if ok && string(old.Value) == expire {
+			continue
+		}
+
+		ttl := info.ExpireTime - t.Unix()
+		if ttl < minSessionTTL {
+			ttl = minSessionTTL
+		}
+		if ttl > maxSessionTTL {
+			ttl = maxSessionTTL
+		}
+		session, err := c.kv.CreateSession(ctx, "locksmith "+id, ttl)
+		if err != nil {
+			c.destroySessions(created)
+			return err
+		}
+		created = append(created, session)
+
+		// a key locked by another session cannot be locked again, so the
+		// old key is deleted first.
+		if ok {
+			ops = append(ops, consul.TxnOp{Verb: consul.VerbDelete, Key: old.Key})
+			replaced = append(replaced, old.Session)
+		}
+		ops = append(ops, consul.TxnOp{Verb: consul.VerbLock, Key: c.holderKey(id), Value: []byte(expire), Session: session})
+	}
+
+	for id, pair := range live {
+		if info, ok := sem.HolderInfo[id]; !ok || info.ExpireTime == 0 {
+			ops = append(ops, consul.TxnOp{Verb: consul.VerbDelete, Key: pair.Key})
+			replaced = append(replaced, pair.Session)
+		}
+	}
+
+	ok, err := c.kv.Txn(ctx, ops)
+	if err != nil || !ok {
+		c.destroySessions(created)
+		if err != nil {
+			return err
+		}
+		return ErrCompareFailed
+	}
+
+	c.destroySessions(replaced)
+	return nil
+}
+
+// destroySessions destroys the given sessions. Failures are ignored, as the
+// sessions expire on their own.
+func (c *ConsulLockClient) destroySessions(ids []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+
+	for _, id := range ids {
+		if id != "" {
+			c.kv.DestroySession(ctx, id)
+		}
+	}
+}
+
+// Register stores member m under its own key. Consul sessions cannot outlive
+// the registration of a member, so the expire time of m is stored along with
+// it instead, and expired members are removed whenever a member registers.
+func (c *ConsulLockClient) Register(ctx context.Context, h string, m *Member) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, expired, err := c.members(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := memberKey(c.keypath, h)
+	ops := []consul.TxnOp{{Verb: consul.VerbSet, Key: key, Value: b}}
+	for _, k := range expired {
+		if k != key {
+			ops = append(ops, consul.TxnOp{Verb: consul.VerbDelete, Key: k})
+		}
+	}
+
+	_, err = c.kv.Txn(ctx, ops)
+	return err
+}
+
+// Members returns the members registered in the group of the semaphore.
+func (c *ConsulLockClient) Members(ctx context.Context) (map[string]*Member, error) {
+	members, _, err := c.members(ctx)
+	return members, err
+}
+
+// members returns the registered members which have not expired, by id, and
+// the keys of those which have.
+func (c *ConsulLockClient) members(ctx context.Context) (map[string]*Member, []string, error) {
+	prefix := memberPrefix(c.keypath) + "/"
+	pairs, err := c.kv.List(ctx, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	members := make(map[string]*Member)
+	var expired []string
+	t := now()
+	for _, pair := range pairs {
+		id, err := url.QueryUnescape(strings.TrimPrefix(pair.Key, prefix))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m := &Member{}
+		if err := json.Unmarshal(pair.Value, m); err != nil {
+			return nil, nil, err
+		}
+		if m.Expired(t) {
+			expired = append(expired, pair.Key)
+			continue
+		}
+		members[id] = m
+	}
+
+	return members, expired, nil
+}
+
+// Watch blocks until the semaphore is modified after the given index. Unlike
+// EtcdV3LockClient.Watch, it does not return when a holder key expires: the
+// index of the holder keys then stays ahead of the semaphore until someone
+// updates it, which would wake up watchers over and over. Lock.Acquire checks
+// the semaphore again once the expire time of a holder has passed anyway.
+func (c *ConsulLockClient) Watch(ctx context.Context, index uint64) error {
+	return c.kv.Watch(ctx, c.keypath, index)
+}
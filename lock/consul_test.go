@@ -0,0 +1,380 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/consul"
+)
+
+// fakeConsul is an in-memory Consul agent serving the KV, transaction and
+// session endpoints ConsulLockClient uses. Sessions never expire on their own;
+// tests invalidate them with expire.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	kvs      map[string]*consul.KVPair
+	sessions map[string]int64
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *consul.Client, func()) {
+	f := &fakeConsul{index: 1, kvs: make(map[string]*consul.KVPair), sessions: make(map[string]int64)}
+	srv := httptest.NewServer(f)
+
+	c, err := consul.New(consul.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f, c, srv.Close
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", "0")
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		_, recurse := r.URL.Query()["recurse"]
+
+		var keys []string
+		for k := range f.kvs {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		var pairs []*consul.KVPair
+		for _, k := range keys {
+			pairs = append(pairs, f.kvs[k])
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	case r.Method == "PUT" && r.URL.Path == "/v1/txn":
+		var ops []struct{ KV consul.TxnOp }
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !f.txn(ops) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"Results":null,"Errors":[{"OpIndex":0,"What":"failed"}]}`))
+			return
+		}
+		w.Write([]byte(`{"Results":[],"Errors":null}`))
+	case r.Method == "PUT" && r.URL.Path == "/v1/session/create":
+		var req struct{ TTL string }
+		json.NewDecoder(r.Body).Decode(&req)
+		ttl, _ := time.ParseDuration(req.TTL)
+		id := "session-" + string('a'+rune(len(f.sessions)))
+		f.sessions[id] = int64(ttl / time.Second)
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		f.invalidate(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+		w.Write([]byte("true"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// txn applies ops if all of them can be applied. f.mu must be held.
+func (f *fakeConsul) txn(ops []struct{ KV consul.TxnOp }) bool {
+	kvs := make(map[string]consul.KVPair)
+	for k, v := range f.kvs {
+		kvs[k] = *v
+	}
+
+	f.index++
+	for _, op := range ops {
+		old, exists := kvs[op.KV.Key]
+		pair := consul.KVPair{Key: op.KV.Key, Value: op.KV.Value, CreateIndex: f.index, ModifyIndex: f.index}
+		if exists {
+			pair.CreateIndex = old.CreateIndex
+		}
+
+		switch op.KV.Verb {
+		case consul.VerbCAS:
+			if (op.KV.Index == 0 && exists) || (op.KV.Index != 0 && old.ModifyIndex != op.KV.Index) {
+				f.index--
+				return false
+			}
+			kvs[op.KV.Key] = pair
+		case consul.VerbSet:
+			kvs[op.KV.Key] = pair
+		case consul.VerbLock:
+			if _, ok := f.sessions[op.KV.Session]; !ok || (exists && old.Session != "" && old.Session != op.KV.Session) {
+				f.index--
+				return false
+			}
+			pair.Session = op.KV.Session
+			kvs[op.KV.Key] = pair
+		case consul.VerbDelete:
+			delete(kvs, op.KV.Key)
+		}
+	}
+
+	f.kvs = make(map[string]*consul.KVPair)
+	for k, v := range kvs {
+		v := v
+		f.kvs[k] = &v
+	}
+	return true
+}
+
+// invalidate destroys a session and deletes the keys it locked, as Consul
+// does with sessions using the delete behavior. f.mu must be held.
+func (f *fakeConsul) invalidate(id string) {
+	delete(f.sessions, id)
+	for k, v := range f.kvs {
+		if v.Session == id {
+			delete(f.kvs, k)
+		}
+	}
+	f.index++
+}
+
+// expire invalidates all sessions, as Consul does when they are not renewed.
+func (f *fakeConsul) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id := range f.sessions {
+		f.invalidate(id)
+	}
+}
+
+// NewTestConsulLockClient returns a ConsulLockClient talking to a fake Consul
+// agent, for the conformance tests in package lock_test. The returned function
+// stops the agent.
+func NewTestConsulLockClient(t *testing.T) (*ConsulLockClient, func()) {
+	_, c, stop := newFakeConsul(t)
+	lc, err := NewConsulLockClient(context.Background(), c, "")
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return lc, stop
+}
+
+func TestConsulLockClientInit(t *testing.T) {
+	f, c, done := newFakeConsul(t)
+	defer done()
+
+	for i, tt := range []struct {
+		group   string
+		keypath string
+	}{
+		{"", SemaphorePrefix},
+		{"", SemaphorePrefix},
+		{"prod/database", "coreos.com/updateengine/rebootlock/groups/prod%2Fdatabase/semaphore"},
+	} {
+		clc, err := NewConsulLockClient(context.Background(), c, tt.group)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		if clc.keypath != tt.keypath {
+			t.Errorf("case %d: unexpected key path: got %v want %v", i, clc.keypath, tt.keypath)
+		}
+		if _, ok := f.kvs[tt.keypath]; !ok {
+			t.Errorf("case %d: semaphore was not created", i)
+		}
+	}
+
+	// initializing twice must not reset the semaphore
+	if got := f.kvs[SemaphorePrefix].ModifyIndex; got != 2 {
+		t.Errorf("semaphore was rewritten at index %d", got)
+	}
+}
+
+func TestConsulLockClientGetSet(t *testing.T) {
+	_, c, done := newFakeConsul(t)
+	defer done()
+
+	clc, err := NewConsulLockClient(context.Background(), c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sem, err := clc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Semaphore{Index: 2, Semaphore: 1, Max: 1}); !reflect.DeepEqual(sem, want) {
+		t.Fatalf("bad semaphore: got %#v, want %#v", sem, want)
+	}
+
+	stale := *sem
+	if err := sem.Lock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := clc.Set(sem); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clc.Set(&stale); err != ErrCompareFailed {
+		t.Errorf("setting a stale semaphore should fail with ErrCompareFailed, got %v", err)
+	}
+
+	sem, err = clc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) {
+		t.Errorf("unexpected holders: %v", sem.Holders)
+	}
+
+	if err := clc.Set(nil); err == nil {
+		t.Error("setting a nil semaphore should fail")
+	}
+}
+
+func TestConsulLockClientMembers(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	f, c, done := newFakeConsul(t)
+	defer done()
+
+	clc, err := NewConsulLockClient(context.Background(), c, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New("a", clc).Heartbeat(context.Background(), Member{}); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(memberExpiry + time.Second)
+	if err := New("b", clc).Heartbeat(context.Background(), Member{}); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := clc.Members(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := members["b"]; !ok || len(members) != 1 {
+		t.Errorf("unexpected members: %v", members)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.kvs[memberKey(clc.keypath, "a")]; ok {
+		t.Error("expired member was not removed")
+	}
+	if _, ok := f.kvs[memberKey(clc.keypath, "b")]; !ok {
+		t.Error("member was not stored under its own key")
+	}
+}
+
+func TestConsulLockClientSession(t *testing.T) {
+	f, c, done := newFakeConsul(t)
+	defer done()
+
+	clc, err := NewConsulLockClient(context.Background(), c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	al := New("a", clc)
+	al.SetTTL(time.Hour)
+	if err := al.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	hk := clc.holderKey("a")
+	hkv, ok := f.kvs[hk]
+	if !ok || hkv.Session == "" {
+		t.Fatalf("holder key was not locked by a session: %#v", hkv)
+	}
+	if ttl := f.sessions[hkv.Session]; ttl != 3600 {
+		t.Errorf("unexpected session TTL: %d", ttl)
+	}
+
+	// renewing must lock the holder key with a new session, and destroy
+	// the old one.
+	now = func() time.Time { return time.Now().Add(time.Minute) }
+	defer func() { now = time.Now }()
+	session := hkv.Session
+	if err := al.Renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if f.kvs[hk].Session == session {
+		t.Error("Renew did not create a new session")
+	}
+	if _, ok := f.sessions[session]; ok {
+		t.Error("Renew did not destroy the old session")
+	}
+
+	// once Consul invalidates the session, writes which do not reclaim the
+	// slot must not create a session for the expired holder.
+	f.expire()
+	sem, err := clc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sem.SetMax(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := clc.Set(sem); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.sessions) != 0 {
+		t.Errorf("write created sessions for the expired holder: %v", f.sessions)
+	}
+	if _, ok := f.kvs[hk]; ok {
+		t.Error("write recreated the holder key of the expired holder")
+	}
+
+	// another machine can reclaim the slot, regardless of the expire time
+	// recorded in the semaphore.
+	bl := New("b", clc)
+	if err := bl.Lock(); err != nil {
+		t.Fatalf("b should have reclaimed the expired session of a: %v", err)
+	}
+
+	sem, err = clc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sem.Holders, []string{"b"}) {
+		t.Errorf("unexpected holders: %v", sem.Holders)
+	}
+
+	if err := bl.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.kvs) != 1 {
+		t.Errorf("holder keys were not cleaned up: %v", f.kvs)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"net/url"
 	"path"
+	"time"
 
 	"github.com/coreos/etcd/client"
 
@@ -41,6 +42,12 @@ type KeysAPI interface {
 	Create(ctx context.Context, key, value string) (*client.Response, error)
 }
 
+// keysWatcher is implemented by KeysAPIs which can watch keys, like
+// client.KeysAPI.
+type keysWatcher interface {
+	Watcher(key string, opts *client.WatcherOptions) client.Watcher
+}
+
 // EtcdLockClient is a wrapper around the etcd client that provides
 // simple primitives to operate on the internal semaphore and holders
 // structs through etcd.
@@ -53,28 +60,56 @@ type EtcdLockClient struct {
 // the etcd key path in which the client will manipulate the semaphore. If the
 // group is the empty string, the default semaphore will be used.
 func NewEtcdLockClient(keyapi KeysAPI, group string) (*EtcdLockClient, error) {
-	key := SemaphorePrefix
-	if group != "" {
-		key = path.Join(keyPrefix, groupBranch, url.QueryEscape(group), semaphoreBranch)
-	}
+	return NewEtcdLockClientContext(context.Background(), keyapi, group)
+}
 
-	elc := &EtcdLockClient{keyapi, key}
-	if err := elc.Init(); err != nil {
+// NewEtcdLockClientContext is NewEtcdLockClient initializing the semaphore
+// within the given context.
+func NewEtcdLockClientContext(ctx context.Context, keyapi KeysAPI, group string) (*EtcdLockClient, error) {
+	elc := &EtcdLockClient{keyapi, semaphoreKey(group)}
+	if err := elc.InitContext(ctx); err != nil {
 		return nil, err
 	}
 
 	return elc, nil
 }
 
-// Init sets an initial copy of the semaphore if it doesn't exist yet.
+// semaphoreKey returns the key of the semaphore of the given group.
+func semaphoreKey(group string) string {
+	if group == "" {
+		return SemaphorePrefix
+	}
+
+	return path.Join(keyPrefix, groupBranch, url.QueryEscape(group), semaphoreBranch)
+}
+
+// memberPrefix returns the key below which the members of the group of the
+// semaphore stored at keypath are stored. It lies next to the semaphore, so
+// that watching the semaphore does not see heartbeats.
+func memberPrefix(keypath string) string {
+	return path.Join(path.Dir(keypath), memberBranch)
+}
+
+// memberKey returns the key member id of the group of the semaphore stored at
+// keypath is stored at.
+func memberKey(keypath, id string) string {
+	return path.Join(memberPrefix(keypath), url.QueryEscape(id))
+}
+
+// Init is InitContext without a deadline.
 func (c *EtcdLockClient) Init() error {
+	return c.InitContext(context.Background())
+}
+
+// InitContext sets an initial copy of the semaphore if it doesn't exist yet.
+func (c *EtcdLockClient) InitContext(ctx context.Context) error {
 	sem := newSemaphore()
 	b, err := json.Marshal(sem)
 	if err != nil {
 		return err
 	}
 
-	if _, err := c.keyapi.Create(context.Background(), c.keypath, string(b)); err != nil {
+	if _, err := c.keyapi.Create(ctx, c.keypath, string(b)); err != nil {
 		eerr, ok := err.(client.Error)
 		if ok && eerr.Code == client.ErrorCodeNodeExist {
 			return nil
@@ -86,9 +121,14 @@ func (c *EtcdLockClient) Init() error {
 	return nil
 }
 
-// Get fetches the Semaphore from etcd.
+// Get is GetContext without a deadline.
 func (c *EtcdLockClient) Get() (*Semaphore, error) {
-	resp, err := c.keyapi.Get(context.Background(), c.keypath, nil)
+	return c.GetContext(context.Background())
+}
+
+// GetContext fetches the Semaphore from etcd.
+func (c *EtcdLockClient) GetContext(ctx context.Context) (*Semaphore, error) {
+	resp, err := c.keyapi.Get(ctx, c.keypath, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -104,8 +144,14 @@ func (c *EtcdLockClient) Get() (*Semaphore, error) {
 	return sem, nil
 }
 
-// Set sets a Semaphore in etcd.
+// Set is SetContext without a deadline.
 func (c *EtcdLockClient) Set(sem *Semaphore) error {
+	return c.SetContext(context.Background(), sem)
+}
+
+// SetContext sets a Semaphore in etcd. If the semaphore was modified since it was
+// read, ErrCompareFailed is returned.
+func (c *EtcdLockClient) SetContext(ctx context.Context, sem *Semaphore) error {
 	if sem == nil {
 		return errors.New("cannot set nil semaphore")
 	}
@@ -118,6 +164,74 @@ func (c *EtcdLockClient) Set(sem *Semaphore) error {
 		PrevIndex: sem.Index,
 	}
 
-	_, err = c.keyapi.Set(context.Background(), c.keypath, string(b), setopts)
+	_, err = c.keyapi.Set(ctx, c.keypath, string(b), setopts)
+	if eerr, ok := err.(client.Error); ok && eerr.Code == client.ErrorCodeTestFailed {
+		return ErrCompareFailed
+	}
+
+	return err
+}
+
+// Register stores member m under its own key with a TTL lasting until the
+// expire time of m, so that etcd forgets the member.
+func (c *EtcdLockClient) Register(ctx context.Context, h string, m *Member) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	setopts := &client.SetOptions{
+		TTL: time.Duration(m.ttl(now())) * time.Second,
+	}
+
+	_, err = c.keyapi.Set(ctx, memberKey(c.keypath, h), string(b), setopts)
+	return err
+}
+
+// Members returns the members registered in the group of the semaphore.
+func (c *EtcdLockClient) Members(ctx context.Context) (map[string]*Member, error) {
+	members := make(map[string]*Member)
+
+	resp, err := c.keyapi.Get(ctx, memberPrefix(c.keypath), &client.GetOptions{Recursive: true})
+	if eerr, ok := err.(client.Error); ok && eerr.Code == client.ErrorCodeKeyNotFound {
+		return members, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range resp.Node.Nodes {
+		id, err := url.QueryUnescape(path.Base(n.Key))
+		if err != nil {
+			return nil, err
+		}
+
+		m := &Member{}
+		if err := json.Unmarshal([]byte(n.Value), m); err != nil {
+			return nil, err
+		}
+		members[id] = m
+	}
+
+	return members, nil
+}
+
+// Watch blocks until the semaphore is modified after the given index. If the
+// KeysAPI cannot watch keys, it blocks until the context is done.
+func (c *EtcdLockClient) Watch(ctx context.Context, index uint64) error {
+	kw, ok := c.keyapi.(keysWatcher)
+	if !ok {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	w := kw.Watcher(c.keypath, &client.WatcherOptions{AfterIndex: index})
+	_, err := w.Next(ctx)
+	if eerr, ok := err.(client.Error); ok && eerr.Code == client.ErrorCodeEventIndexCleared {
+		// the index is too old to watch from, so the semaphore has changed
+		// since.
+		return nil
+	}
+
 	return err
 }
@@ -17,6 +17,9 @@ package lock
 import (
 	"errors"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/coreos/etcd/client"
@@ -40,6 +43,94 @@ func (t *testEtcdClient) Create(ctx context.Context, key, value string) (*client
 	return t.resp, t.err
 }
 
+func (t *testEtcdClient) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	return t
+}
+
+func (t *testEtcdClient) Next(ctx context.Context) (*client.Response, error) {
+	return t.resp, t.err
+}
+
+// memKeysAPI is an in-memory etcd v2 KeysAPI. Directories only exist through
+// the keys below them, which are listed as if read recursively, and TTLs are
+// ignored. It is safe for concurrent use.
+type memKeysAPI struct {
+	mu    sync.Mutex
+	index uint64
+	nodes map[string]client.Node
+}
+
+func newMemKeysAPI() *memKeysAPI {
+	return &memKeysAPI{nodes: make(map[string]client.Node)}
+}
+
+func (m *memKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if node, ok := m.nodes[key]; ok {
+		return &client.Response{Action: "get", Node: &node, Index: m.index}, nil
+	}
+
+	// keys below key make it a directory.
+	dir := &client.Node{Key: key, Dir: true}
+	var keys []string
+	for k := range m.nodes {
+		if strings.HasPrefix(k, key+"/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		node := m.nodes[k]
+		dir.Nodes = append(dir.Nodes, &node)
+	}
+	if len(dir.Nodes) == 0 {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Index: m.index}
+	}
+	return &client.Response{Action: "get", Node: dir, Index: m.index}, nil
+}
+
+func (m *memKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[key]
+	if opts != nil && opts.PrevIndex != 0 && (!ok || node.ModifiedIndex != opts.PrevIndex) {
+		return nil, client.Error{Code: client.ErrorCodeTestFailed, Index: m.index}
+	}
+	return m.store(key, value, "set"), nil
+}
+
+func (m *memKeysAPI) Create(ctx context.Context, key, value string) (*client.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.nodes[key]; ok {
+		return nil, client.Error{Code: client.ErrorCodeNodeExist, Index: m.index}
+	}
+	return m.store(key, value, "create"), nil
+}
+
+// store sets key to value. m.mu must be held.
+func (m *memKeysAPI) store(key, value, action string) *client.Response {
+	m.index++
+	node, ok := m.nodes[key]
+	if !ok {
+		node = client.Node{Key: key, CreatedIndex: m.index}
+	}
+	node.Value = value
+	node.ModifiedIndex = m.index
+	m.nodes[key] = node
+	return &client.Response{Action: action, Node: &node, Index: m.index}
+}
+
+// NewTestEtcdLockClient returns an EtcdLockClient backed by an in-memory
+// KeysAPI, for the conformance tests in package lock_test.
+func NewTestEtcdLockClient() (*EtcdLockClient, error) {
+	return NewEtcdLockClient(newMemKeysAPI(), "")
+}
+
 func TestEtcdLockClientInit(t *testing.T) {
 	for i, tt := range []struct {
 		ee      error
@@ -95,6 +186,9 @@ func TestEtcdLockClientGet(t *testing.T) {
 		// successful calls
 		{nil, makeResponse(10, `{"semaphore": 1}`), &Semaphore{Index: 10, Semaphore: 1}, false},
 		{nil, makeResponse(1024, `{"semaphore": 1, "max": 2, "holders": ["foo", "bar"]}`), &Semaphore{Index: 1024, Semaphore: 1, Max: 2, Holders: []string{"foo", "bar"}}, false},
+		{nil, makeResponse(12, `{"semaphore": 0, "max": 1, "holders": ["foo"], "holderInfo": {"foo": {"startTime": 5, "expireTime": 65}}}`), &Semaphore{Index: 12, Semaphore: 0, Max: 1, Holders: []string{"foo"}, HolderInfo: map[string]*Holder{"foo": {StartTime: 5, ExpireTime: 65}}}, false},
+		// holder metadata unknown to this version is ignored
+		{nil, makeResponse(13, `{"semaphore": 0, "max": 1, "holders": ["foo"], "holderInfo": {"foo": {"startTime": 5, "hostname": "foo.example.com", "reason": "update", "version": "1235.0.0", "strategy": "etcd-lock", "future": true}}}`), &Semaphore{Index: 13, Semaphore: 0, Max: 1, Holders: []string{"foo"}, HolderInfo: map[string]*Holder{"foo": {StartTime: 5, Hostname: "foo.example.com", Reason: "update", Version: "1235.0.0", Strategy: "etcd-lock"}}}, false},
 		// index should be set from etcd, not json!
 		{nil, makeResponse(1234, `{"semaphore": 89, "index": 4567}`), &Semaphore{Index: 1234, Semaphore: 89}, false},
 	} {
@@ -135,6 +229,8 @@ func TestEtcdLockClientSet(t *testing.T) {
 		{&Semaphore{}, client.Error{Code: client.ErrorCodeNodeExist}, true},
 		{&Semaphore{}, client.Error{Code: client.ErrorCodeKeyNotFound}, true},
 		{&Semaphore{}, errors.New("some random error"), true},
+		// a failed compare-and-swap is reported as ErrCompareFailed
+		{&Semaphore{Index: uint64(1234)}, client.Error{Code: client.ErrorCodeTestFailed}, true},
 	} {
 		elc := &EtcdLockClient{
 			keyapi: &testEtcdClient{err: tt.ee},
@@ -143,5 +239,29 @@ func TestEtcdLockClientSet(t *testing.T) {
 		if (got != nil) != tt.want {
 			t.Errorf("case %d: unexpected error state calling Set: got %v", i, got)
 		}
+		if eerr, ok := tt.ee.(client.Error); ok && eerr.Code == client.ErrorCodeTestFailed && got != ErrCompareFailed {
+			t.Errorf("case %d: expected ErrCompareFailed, got %v", i, got)
+		}
+	}
+}
+
+func TestEtcdLockClientWatch(t *testing.T) {
+	for i, tt := range []struct {
+		ee   error
+		want bool
+	}{
+		{nil, false},
+		// an index too old to watch from means the semaphore has changed
+		{client.Error{Code: client.ErrorCodeEventIndexCleared}, false},
+		{context.DeadlineExceeded, true},
+		{errors.New("some random error"), true},
+	} {
+		elc := &EtcdLockClient{
+			keyapi: &testEtcdClient{err: tt.ee},
+		}
+		got := elc.Watch(context.Background(), 1)
+		if (got != nil) != tt.want {
+			t.Errorf("case %d: unexpected error state calling Watch: got %v", i, got)
+		}
 	}
 }
@@ -0,0 +1,424 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/etcdv3"
+)
+
+const (
+	holderBranch = "holders"
+)
+
+var (
+	// ErrSemaphoreNotFound is returned by EtcdV3LockClient.Get if the
+	// semaphore does not exist.
+	ErrSemaphoreNotFound = errors.New("semaphore not found")
+)
+
+// V3KV is the minimum etcd v3 API EtcdV3LockClient needs to do its job.
+type V3KV interface {
+	Range(ctx context.Context, key string, prefix bool) ([]*etcdv3.KeyValue, error)
+	Txn(ctx context.Context, txn *etcdv3.Txn) (bool, error)
+	Grant(ctx context.Context, ttl int64) (int64, error)
+	Revoke(ctx context.Context, id int64) error
+	Watch(ctx context.Context, prefix string, rev int64) error
+}
+
+// EtcdV3LockClient is a LockClient storing the semaphore in etcd using the
+// v3 API. The semaphore is swapped with transactions, and every holder with a
+// lease is backed by a key attached to an etcd lease, so holders are expired
+// by etcd itself rather than by the clocks of the machines.
+type EtcdV3LockClient struct {
+	kv      V3KV
+	keypath string
+
+	// mu guards memberLease, the lease the members registered through
+	// this client are attached to, and memberExpire, the unix time it runs
+	// out.
+	mu           sync.Mutex
+	memberLease  int64
+	memberExpire int64
+}
+
+// NewEtcdV3LockClient creates a new EtcdV3LockClient. The group parameter
+// defines the key in which the client will manipulate the semaphore, using
+// the same layout as EtcdLockClient. If the group is the empty string, the
+// default semaphore will be used. The semaphore is initialized within the
+// given context.
+func NewEtcdV3LockClient(ctx context.Context, kv V3KV, group string) (*EtcdV3LockClient, error) {
+	elc := &EtcdV3LockClient{kv: kv, keypath: semaphoreKey(group)}
+	if err := elc.InitContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return elc, nil
+}
+
+// holderKey returns the key backing the lease of holder id.
+func (c *EtcdV3LockClient) holderKey(id string) string {
+	return holderKey(c.keypath, id)
+}
+
+// holderKey returns the key backing the lease of holder id of the semaphore
+// stored at keypath.
+func holderKey(keypath, id string) string {
+	return path.Join(keypath, holderBranch, url.QueryEscape(id))
+}
+
+// putHolder grants a lease lasting until the expire time of holder id of the
+// semaphore stored at keypath, and returns the operation writing its holder
+// key along with the lease.
+func putHolder(ctx context.Context, kv V3KV, keypath, id string, expire int64) (etcdv3.Op, int64, error) {
+	ttl := expire - now().Unix()
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	lease, err := kv.Grant(ctx, ttl)
+	if err != nil {
+		return etcdv3.Op{}, 0, err
+	}
+
+	return etcdv3.OpPut(holderKey(keypath, id), []byte(strconv.FormatInt(expire, 10)), lease), lease, nil
+}
+
+// revoke revokes leases which were granted for a transaction that did not
+// go through. Errors are ignored, the leases expire by themselves anyway.
+func revoke(ctx context.Context, kv V3KV, leases []int64) {
+	for _, lease := range leases {
+		kv.Revoke(ctx, lease)
+	}
+}
+
+// Init is InitContext without a deadline.
+func (c *EtcdV3LockClient) Init() error {
+	return c.InitContext(context.Background())
+}
+
+// InitContext sets an initial copy of the semaphore if it doesn't exist yet.
+func (c *EtcdV3LockClient) InitContext(ctx context.Context) error {
+	sem := newSemaphore()
+	b, err := json.Marshal(sem)
+	if err != nil {
+		return err
+	}
+
+	// the transaction failing just means the semaphore already exists.
+	_, err = c.kv.Txn(ctx, &etcdv3.Txn{
+		Compare: []etcdv3.Compare{{Key: c.keypath, Target: etcdv3.TargetCreate, Revision: 0}},
+		Success: []etcdv3.Op{etcdv3.OpPut(c.keypath, b, 0)},
+	})
+	return err
+}
+
+// Get is GetContext without a deadline.
+func (c *EtcdV3LockClient) Get() (*Semaphore, error) {
+	return c.GetContext(context.Background())
+}
+
+// GetContext fetches the Semaphore from etcd. Holders with a lease whose backing key
+// has been removed by etcd are marked as expired.
+func (c *EtcdV3LockClient) GetContext(ctx context.Context) (*Semaphore, error) {
+	kvs, err := c.kv.Range(ctx, c.keypath, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrSemaphoreNotFound
+	}
+
+	sem := &Semaphore{}
+	if err := json.Unmarshal(kvs[0].Value, sem); err != nil {
+		return nil, err
+	}
+
+	sem.Index = uint64(kvs[0].ModRevision)
+
+	live, err := c.liveHolders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, info := range sem.HolderInfo {
+		if _, ok := live[id]; !ok && info.ExpireTime != 0 {
+			info.ExpireTime = 1
+		}
+	}
+
+	return sem, nil
+}
+
+// liveHolders returns the holder keys currently present in etcd, keyed by
+// holder id, with the expire time they were written with as value.
+func (c *EtcdV3LockClient) liveHolders(ctx context.Context) (map[string]string, error) {
+	prefix := path.Join(c.keypath, holderBranch) + "/"
+	kvs, err := c.kv.Range(ctx, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]string)
+	for _, kv := range kvs {
+		id, err := url.QueryUnescape(strings.TrimPrefix(string(kv.Key), prefix))
+		if err != nil {
+			return nil, err
+		}
+		live[id] = string(kv.Value)
+	}
+
+	return live, nil
+}
+
+// Set is SetContext without a deadline.
+func (c *EtcdV3LockClient) Set(sem *Semaphore) error {
+	return c.SetContext(context.Background(), sem)
+}
+
+// SetContext sets a Semaphore in etcd. The semaphore is only written if it was not
+// modified since it was read, in which case ErrCompareFailed is returned.
+// Holder keys are granted a new lease whenever the expire time of the holder
+// changes, and removed once the holder is gone. Holders whose lease has
+// already expired are not given a new one.
+func (c *EtcdV3LockClient) SetContext(ctx context.Context, sem *Semaphore) error {
+	if sem == nil {
+		return errors.New("cannot set nil semaphore")
+	}
+	b, err := json.Marshal(sem)
+	if err != nil {
+		return err
+	}
+
+	live, err := c.liveHolders(ctx)
+	if err != nil {
+		return err
+	}
+
+	ops := []etcdv3.Op{etcdv3.OpPut(c.keypath, b, 0)}
+
+	var leases []int64
+	t := now()
+	for id, info := range sem.HolderInfo {
+		if info.ExpireTime == 0 || info.Expired(t) || live[id] == strconv.FormatInt(info.ExpireTime, 10) {
+			continue
+		}
+
+		op, lease, err := putHolder(ctx, c.kv, c.keypath, id, info.ExpireTime)
+		if err != nil {
+			revoke(ctx, c.kv, leases)
+			return err
+		}
+		ops = append(ops, op)
+		leases = append(leases, lease)
+	}
+
+	for id := range live {
+		if info, ok := sem.HolderInfo[id]; !ok || info.ExpireTime == 0 {
+			ops = append(ops, etcdv3.OpDelete(c.holderKey(id)))
+		}
+	}
+
+	txn := &etcdv3.Txn{Success: ops}
+	if sem.Index != 0 {
+		txn.Compare = []etcdv3.Compare{{Key: c.keypath, Target: etcdv3.TargetMod, Revision: int64(sem.Index)}}
+	}
+
+	ok, err := c.kv.Txn(ctx, txn)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// the new leases are not attached to anything.
+		revoke(ctx, c.kv, leases)
+		return ErrCompareFailed
+	}
+
+	return nil
+}
+
+// Register stores member m under its own key, attached to a lease running
+// out at the expire time of m, so that etcd forgets the member.
+func (c *EtcdV3LockClient) Register(ctx context.Context, h string, m *Member) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	lease, err := c.leaseMember(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.kv.Txn(ctx, &etcdv3.Txn{Success: []etcdv3.Op{etcdv3.OpPut(memberKey(c.keypath, h), b, lease)}})
+	if err != nil {
+		// the lease may be gone, grant a new one next time.
+		c.mu.Lock()
+		if c.memberLease == lease {
+			c.memberLease = 0
+		}
+		c.mu.Unlock()
+	}
+
+	return err
+}
+
+// leaseMember returns the lease to attach member m to. Heartbeats share a
+// lease, which is only replaced once less than half of the remaining
+// registration of m is left on it, so that not every heartbeat grants a
+// lease. The replaced lease runs out by itself.
+func (c *EtcdV3LockClient) leaseMember(ctx context.Context, m *Member) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := now()
+	ttl := m.ttl(t)
+	if c.memberLease != 0 && c.memberExpire-t.Unix() >= ttl/2 {
+		return c.memberLease, nil
+	}
+
+	lease, err := c.kv.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	c.memberLease, c.memberExpire = lease, t.Unix()+ttl
+	return lease, nil
+}
+
+// Members returns the members registered in the group of the semaphore.
+func (c *EtcdV3LockClient) Members(ctx context.Context) (map[string]*Member, error) {
+	prefix := memberPrefix(c.keypath) + "/"
+	kvs, err := c.kv.Range(ctx, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]*Member)
+	for _, kv := range kvs {
+		id, err := url.QueryUnescape(strings.TrimPrefix(string(kv.Key), prefix))
+		if err != nil {
+			return nil, err
+		}
+
+		m := &Member{}
+		if err := json.Unmarshal(kv.Value, m); err != nil {
+			return nil, err
+		}
+		members[id] = m
+	}
+
+	return members, nil
+}
+
+// Watch blocks until the semaphore or one of its holder keys is modified
+// after the given index. Holder keys are removed when their lease expires, so
+// this also returns when a holder expires.
+func (c *EtcdV3LockClient) Watch(ctx context.Context, index uint64) error {
+	return c.kv.Watch(ctx, c.keypath, int64(index)+1)
+}
+
+// MigrateV2ToV3 copies all locksmith keys from the etcd v2 store to the etcd
+// v3 store. Keys which already exist in the v3 store are left untouched, so
+// it is safe to run more than once. Holders of the semaphores with a lease
+// are given a holder key attached to a lease for the rest of their lease, as
+// EtcdV3LockClient expects. It returns the keys that were copied.
+func MigrateV2ToV3(ctx context.Context, keyapi KeysAPI, kv V3KV) ([]string, error) {
+	resp, err := keyapi.Get(ctx, keyPrefix, &client.GetOptions{Recursive: true})
+	if err != nil {
+		eerr, ok := err.(client.Error)
+		if ok && eerr.Code == client.ErrorCodeKeyNotFound {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var migrated []string
+	var walk func(n *client.Node) error
+	walk = func(n *client.Node) error {
+		if n.Dir {
+			for _, child := range n.Nodes {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		// v2 keys are rooted at "/", the v3 keys locksmith uses are not.
+		key := strings.TrimPrefix(n.Key, "/")
+
+		// members expire in v2 and register again in v3 within a
+		// heartbeat interval.
+		if path.Base(path.Dir(key)) == memberBranch && path.Base(key) != semaphoreBranch {
+			return nil
+		}
+		ops := []etcdv3.Op{etcdv3.OpPut(key, []byte(n.Value), 0)}
+
+		var leases []int64
+		if path.Base(key) == semaphoreBranch {
+			sem := &Semaphore{}
+			if err := json.Unmarshal([]byte(n.Value), sem); err != nil {
+				return err
+			}
+
+			for id, info := range sem.HolderInfo {
+				if info.ExpireTime == 0 {
+					continue
+				}
+
+				op, lease, err := putHolder(ctx, kv, key, id, info.ExpireTime)
+				if err != nil {
+					revoke(ctx, kv, leases)
+					return err
+				}
+				ops = append(ops, op)
+				leases = append(leases, lease)
+			}
+		}
+
+		ok, err := kv.Txn(ctx, &etcdv3.Txn{
+			Compare: []etcdv3.Compare{{Key: key, Target: etcdv3.TargetCreate, Revision: 0}},
+			Success: ops,
+		})
+		if err != nil {
+			return err
+		}
+		if ok {
+			migrated = append(migrated, key)
+		} else {
+			revoke(ctx, kv, leases)
+		}
+
+		return nil
+	}
+
+	if err := walk(resp.Node); err != nil {
+		return nil, err
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,456 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/etcdv3"
+)
+
+// testV3KV is an in-memory etcd v3 store. Leases never expire on their own;
+// tests revoke them with expire. It is safe for concurrent use.
+type testV3KV struct {
+	mu        sync.Mutex
+	rev       int64
+	kvs       map[string]*etcdv3.KeyValue
+	leases    map[int64]int64
+	lastLease int64
+}
+
+func newTestV3KV() *testV3KV {
+	return &testV3KV{kvs: make(map[string]*etcdv3.KeyValue), leases: make(map[int64]int64)}
+}
+
+func (t *testV3KV) Range(ctx context.Context, key string, prefix bool) ([]*etcdv3.KeyValue, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var keys []string
+	for k := range t.kvs {
+		if k == key || (prefix && strings.HasPrefix(k, key)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var kvs []*etcdv3.KeyValue
+	for _, k := range keys {
+		kv := *t.kvs[k]
+		kvs = append(kvs, &kv)
+	}
+	return kvs, nil
+}
+
+func (t *testV3KV) Txn(ctx context.Context, txn *etcdv3.Txn) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ok := true
+	for _, c := range txn.Compare {
+		var rev int64
+		if kv, exists := t.kvs[c.Key]; exists {
+			switch c.Target {
+			case etcdv3.TargetCreate:
+				rev = kv.CreateRevision
+			case etcdv3.TargetMod:
+				rev = kv.ModRevision
+			case etcdv3.TargetVersion:
+				rev = kv.Version
+			}
+		}
+		if rev != c.Revision {
+			ok = false
+		}
+	}
+
+	ops := txn.Success
+	if !ok {
+		ops = txn.Failure
+	}
+	if len(ops) == 0 {
+		return ok, nil
+	}
+
+	t.rev++
+	for _, op := range ops {
+		switch {
+		case op.Put != nil:
+			key := string(op.Put.Key)
+			kv, exists := t.kvs[key]
+			if !exists {
+				kv = &etcdv3.KeyValue{Key: op.Put.Key, CreateRevision: t.rev}
+				t.kvs[key] = kv
+			}
+			kv.Value = op.Put.Value
+			kv.ModRevision = t.rev
+			kv.Version++
+			kv.Lease = op.Put.Lease
+		case op.Delete != nil:
+			delete(t.kvs, string(op.Delete.Key))
+		}
+	}
+	return ok, nil
+}
+
+func (t *testV3KV) Grant(ctx context.Context, ttl int64) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastLease++
+	t.leases[t.lastLease] = ttl
+	return t.lastLease, nil
+}
+
+func (t *testV3KV) Revoke(ctx context.Context, id int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.leases, id)
+	for k, kv := range t.kvs {
+		if kv.Lease == id {
+			delete(t.kvs, k)
+		}
+	}
+	return nil
+}
+
+func (t *testV3KV) Watch(ctx context.Context, prefix string, rev int64) error {
+	return nil
+}
+
+// expire removes all keys attached to a lease, as etcd does when a lease
+// runs out.
+func (t *testV3KV) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, kv := range t.kvs {
+		if kv.Lease != 0 {
+			delete(t.kvs, k)
+		}
+	}
+}
+
+// NewTestEtcdV3LockClient returns an EtcdV3LockClient backed by an in-memory
+// store, for the conformance tests in package lock_test.
+func NewTestEtcdV3LockClient() (*EtcdV3LockClient, error) {
+	return NewEtcdV3LockClient(context.Background(), newTestV3KV(), "")
+}
+
+func TestEtcdV3LockClientInit(t *testing.T) {
+	kv := newTestV3KV()
+	for i, tt := range []struct {
+		group   string
+		keypath string
+	}{
+		{"", SemaphorePrefix},
+		{"", SemaphorePrefix},
+		{"prod/database", "coreos.com/updateengine/rebootlock/groups/prod%2Fdatabase/semaphore"},
+	} {
+		elc, err := NewEtcdV3LockClient(context.Background(), kv, tt.group)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		if elc.keypath != tt.keypath {
+			t.Errorf("case %d: unexpected etcd key path: got %v want %v", i, elc.keypath, tt.keypath)
+		}
+	}
+
+	// initializing twice must not reset the semaphore
+	if got := kv.kvs[SemaphorePrefix].Version; got != 1 {
+		t.Errorf("semaphore was written %d times, want 1", got)
+	}
+}
+
+func TestEtcdV3LockClientGetSet(t *testing.T) {
+	kv := newTestV3KV()
+	elc, err := NewEtcdV3LockClient(context.Background(), kv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sem, err := elc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Semaphore{Index: 1, Semaphore: 1, Max: 1}); !reflect.DeepEqual(sem, want) {
+		t.Fatalf("bad semaphore: got %#v, want %#v", sem, want)
+	}
+
+	stale := *sem
+	if err := sem.Lock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := elc.Set(sem); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := elc.Set(&stale); err != ErrCompareFailed {
+		t.Errorf("setting a stale semaphore should fail with ErrCompareFailed, got %v", err)
+	}
+
+	sem, err = elc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) {
+		t.Errorf("unexpected holders: %v", sem.Holders)
+	}
+
+	if err := elc.Set(nil); err == nil {
+		t.Error("setting a nil semaphore should fail")
+	}
+}
+
+func TestEtcdV3LockClientLease(t *testing.T) {
+	kv := newTestV3KV()
+	elc, err := NewEtcdV3LockClient(context.Background(), kv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	al := New("a", elc)
+	al.SetTTL(time.Hour)
+	if err := al.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	hk := elc.holderKey("a")
+	if hkv, ok := kv.kvs[hk]; !ok || hkv.Lease == 0 {
+		t.Fatalf("holder key was not written with a lease: %#v", hkv)
+	}
+
+	// renewing must grant a new lease
+	now = func() time.Time { return time.Now().Add(time.Minute) }
+	defer func() { now = time.Now }()
+	lease := kv.kvs[hk].Lease
+	if err := al.Renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if kv.kvs[hk].Lease == lease {
+		t.Error("Renew did not grant a new lease")
+	}
+
+	// a stale write must not leave the lease it granted behind
+	stale, err := elc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Index--
+	stale.HolderInfo["a"].ExpireTime += 60
+	leases := len(kv.leases)
+	if err := elc.Set(stale); err != ErrCompareFailed {
+		t.Fatalf("setting a stale semaphore should fail with ErrCompareFailed, got %v", err)
+	}
+	if len(kv.leases) != leases {
+		t.Errorf("stale write leaked a lease: %d leases, want %d", len(kv.leases), leases)
+	}
+
+	// once etcd expires the lease, writes which do not reclaim the slot
+	// must not grant the expired holder a new lease.
+	kv.expire()
+	sem, err := elc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sem.SetMax(2); err != nil {
+		t.Fatal(err)
+	}
+	leases = len(kv.leases)
+	if err := elc.Set(sem); err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.leases) != leases {
+		t.Errorf("write granted the expired holder a lease: %d leases, want %d", len(kv.leases), leases)
+	}
+	if _, ok := kv.kvs[hk]; ok {
+		t.Error("write recreated the holder key of the expired holder")
+	}
+
+	// another machine can reclaim the slot, regardless of the expire time
+	// recorded in the semaphore.
+	bl := New("b", elc)
+	if err := bl.Lock(); err != nil {
+		t.Fatalf("b should have reclaimed the expired lease of a: %v", err)
+	}
+
+	sem, err = elc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sem.Holders, []string{"b"}) {
+		t.Errorf("unexpected holders: %v", sem.Holders)
+	}
+
+	if err := bl.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.kvs) != 1 {
+		t.Errorf("holder keys were not cleaned up: %v", kv.kvs)
+	}
+}
+
+func TestEtcdV3LockClientMembers(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	kv := newTestV3KV()
+	elc, err := NewEtcdV3LockClient(context.Background(), kv, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := kv.kvs[elc.keypath].ModRevision
+
+	// heartbeats share a lease until half of the registration is used up.
+	for i, tt := range []struct {
+		after  time.Duration
+		leases int64
+	}{
+		{0, 1},
+		{HeartbeatInterval, 1},
+		{memberExpiry / 2, 1},
+		{memberExpiry/2 + time.Second, 2},
+	} {
+		clock = time.Unix(100000, 0).Add(tt.after)
+		if err := New("a", elc).Heartbeat(context.Background(), Member{Hostname: "core-01"}); err != nil {
+			t.Fatal(err)
+		}
+
+		mkv, ok := kv.kvs[memberKey(elc.keypath, "a")]
+		if !ok || mkv.Lease != tt.leases || kv.leases[mkv.Lease] == 0 {
+			t.Errorf("case %d: member key not attached to lease %d: %#v", i, tt.leases, mkv)
+		}
+	}
+
+	if kv.kvs[elc.keypath].ModRevision != rev {
+		t.Error("heartbeats modified the semaphore")
+	}
+	if !strings.HasPrefix(memberKey(elc.keypath, "a"), keyPrefix+"/groups/db/members/") {
+		t.Errorf("member key %q is not next to the semaphore", memberKey(elc.keypath, "a"))
+	}
+
+	// once etcd expires the lease, the member is gone.
+	kv.expire()
+	members, err := elc.Members(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 0 {
+		t.Errorf("expired member is still listed: %v", members)
+	}
+}
+
+func TestMigrateV2ToV3(t *testing.T) {
+	expire := time.Now().Add(time.Hour).Unix()
+	leased := fmt.Sprintf(`{"semaphore":0,"max":1,"holders":["b"],"holderInfo":{"b":{"startTime":1,"expireTime":%d}}}`, expire)
+	v2 := &testEtcdClient{
+		resp: &client.Response{
+			Node: &client.Node{
+				Key: "/" + keyPrefix,
+				Dir: true,
+				Nodes: client.Nodes{
+					{Key: "/" + keyPrefix + "/members", Dir: true, Nodes: client.Nodes{
+						{Key: "/" + keyPrefix + "/members/a", Value: `{"lastHeartbeat":1}`},
+					}},
+					{Key: "/" + SemaphorePrefix, Value: `{"semaphore":0,"max":1,"holders":["a"]}`},
+					{Key: "/" + keyPrefix + "/groups", Dir: true, Nodes: client.Nodes{
+						{Key: "/" + keyPrefix + "/groups/db", Dir: true, Nodes: client.Nodes{
+							{Key: "/" + keyPrefix + "/groups/db/members", Dir: true, Nodes: client.Nodes{
+								{Key: "/" + keyPrefix + "/groups/db/members/c", Value: `{"lastHeartbeat":1}`},
+							}},
+							{Key: "/" + keyPrefix + "/groups/db/semaphore", Value: `{"semaphore":2,"max":2}`},
+						}},
+						{Key: "/" + keyPrefix + "/groups/members", Dir: true, Nodes: client.Nodes{
+							{Key: "/" + keyPrefix + "/groups/members/semaphore", Value: `{"semaphore":1,"max":1}`},
+						}},
+						{Key: "/" + keyPrefix + "/groups/web", Dir: true, Nodes: client.Nodes{
+							{Key: "/" + keyPrefix + "/groups/web/semaphore", Value: leased},
+						}},
+					}},
+				},
+			},
+		},
+	}
+
+	kv := newTestV3KV()
+	got, err := MigrateV2ToV3(context.Background(), v2, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// members expire in v2 and are not migrated, unlike the semaphore of a
+	// group named like them.
+	want := []string{SemaphorePrefix, keyPrefix + "/groups/db/semaphore", keyPrefix + "/groups/members/semaphore", keyPrefix + "/groups/web/semaphore"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected migrated keys: got %v want %v", got, want)
+	}
+
+	elc, err := NewEtcdV3LockClient(context.Background(), kv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sem, err := elc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) {
+		t.Errorf("migrated semaphore has unexpected holders: %v", sem.Holders)
+	}
+
+	// holders with a lease must keep it
+	elc, err = NewEtcdV3LockClient(context.Background(), kv, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sem, err = elc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sem.HolderInfo["b"].ExpireTime; got != expire {
+		t.Errorf("migrated holder has expire time %d, want %d", got, expire)
+	}
+	if hkv, ok := kv.kvs[elc.holderKey("b")]; !ok || hkv.Lease == 0 {
+		t.Errorf("migrated holder has no lease: %#v", hkv)
+	}
+
+	// a second run must not overwrite anything
+	got, err = MigrateV2ToV3(context.Background(), v2, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("second migration copied keys: %v", got)
+	}
+	if len(kv.leases) != 1 {
+		t.Errorf("second migration leaked leases: %v", kv.leases)
+	}
+
+	v2.resp, v2.err = nil, client.Error{Code: client.ErrorCodeKeyNotFound}
+	if _, err := MigrateV2ToV3(context.Background(), v2, kv); err != nil {
+		t.Errorf("migrating an empty v2 store should succeed, got %v", err)
+	}
+}
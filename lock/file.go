@@ -0,0 +1,309 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/filelock"
+)
+
+const (
+	// fileLockRetryInterval is how long FileLockClient waits before trying
+	// again to lock a semaphore file locked by someone else.
+	fileLockRetryInterval = 10 * time.Millisecond
+	// fileWatchInterval is how often FileLockClient.Watch checks whether the
+	// semaphore file changed.
+	fileWatchInterval = time.Second
+)
+
+// fileSemaphore is the content of a semaphore file. The index is stored next
+// to the semaphore, as there is no store to keep track of it.
+type fileSemaphore struct {
+	Index     uint64     `json:"index"`
+	Semaphore *Semaphore `json:"semaphore"`
+}
+
+// FileLockClient is a LockClient storing the semaphore in a JSON file on the
+// local filesystem, or on a shared filesystem supporting flock. Updates are
+// made while holding an exclusive lock on the file, and are only applied if
+// the index stored in the file did not change since the semaphore was read.
+type FileLockClient struct {
+	path string
+}
+
+// NewFileLockClient creates a new FileLockClient storing the semaphores below
+// dir, using the same layout as the keys of EtcdLockClient. If the group is
+// the empty string, the default semaphore will be used. The semaphore is
+// initialized within the given context.
+func NewFileLockClient(ctx context.Context, dir, group string) (*FileLockClient, error) {
+	rel := strings.TrimPrefix(semaphoreKey(group), keyPrefix)
+	flc := &FileLockClient{filepath.Join(dir, filepath.FromSlash(rel))}
+	if err := flc.InitContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return flc, nil
+}
+
+// Init is InitContext without a deadline.
+func (c *FileLockClient) Init() error {
+	return c.InitContext(context.Background())
+}
+
+// InitContext sets an initial copy of the semaphore if it doesn't exist yet.
+func (c *FileLockClient) InitContext(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return c.update(ctx, func(cur *fileSemaphore) (*fileSemaphore, error) {
+		if cur != nil {
+			return nil, nil
+		}
+		return &fileSemaphore{Index: 1, Semaphore: newSemaphore()}, nil
+	})
+}
+
+// Get is GetContext without a deadline.
+func (c *FileLockClient) Get() (*Semaphore, error) {
+	return c.GetContext(context.Background())
+}
+
+// GetContext reads the Semaphore from the file.
+func (c *FileLockClient) GetContext(ctx context.Context) (*Semaphore, error) {
+	fs, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if fs == nil {
+		return nil, ErrSemaphoreNotFound
+	}
+
+	fs.Semaphore.Index = fs.Index
+	return fs.Semaphore, nil
+}
+
+// Set is SetContext without a deadline.
+func (c *FileLockClient) Set(sem *Semaphore) error {
+	return c.SetContext(context.Background(), sem)
+}
+
+// SetContext writes a Semaphore to the file. The semaphore is only written if the
+// file was not modified since the semaphore was read, in which case
+// ErrCompareFailed is returned.
+func (c *FileLockClient) SetContext(ctx context.Context, sem *Semaphore) error {
+	if sem == nil {
+		return errors.New("cannot set nil semaphore")
+	}
+
+	return c.update(ctx, func(cur *fileSemaphore) (*fileSemaphore, error) {
+		if cur == nil {
+			return nil, ErrSemaphoreNotFound
+		}
+		if sem.Index != 0 && sem.Index != cur.Index {
+			return nil, ErrCompareFailed
+		}
+		return &fileSemaphore{Index: cur.Index + 1, Semaphore: sem}, nil
+	})
+}
+
+// Watch blocks until the semaphore is modified after the given index. The
+// file is polled, as flock does not offer a way to be notified of changes.
+func (c *FileLockClient) Watch(ctx context.Context, index uint64) error {
+	for {
+		fs, err := c.read()
+		if err != nil {
+			return err
+		}
+		if fs == nil || fs.Index != index {
+			return nil
+		}
+
+		select {
+		case <-time.After(fileWatchInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// memberDir returns the directory the members of the group of the semaphore
+// are stored in, one file per member, next to the semaphore file.
+func (c *FileLockClient) memberDir() string {
+	return filepath.Join(filepath.Dir(c.path), memberBranch)
+}
+
+// Register stores member m in a file of its own. The expire time of m is
+// stored along with it, and expired members are removed when the members are
+// listed.
+func (c *FileLockClient) Register(ctx context.Context, h string, m *Member) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	dir := c.memberDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that readers never see a
+	// partial member.
+	f, err := ioutil.TempFile(dir, ".member")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, url.QueryEscape(h)))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Members returns the members registered in the group of the semaphore.
+func (c *FileLockClient) Members(ctx context.Context) (map[string]*Member, error) {
+	members := make(map[string]*Member)
+
+	files, err := ioutil.ReadDir(c.memberDir())
+	if os.IsNotExist(err) {
+		return members, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := now()
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		id, err := url.QueryUnescape(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(c.memberDir(), fi.Name())
+		b, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			// removed in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		m := &Member{}
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, err
+		}
+		if m.Expired(t) {
+			os.Remove(name)
+			continue
+		}
+		members[id] = m
+	}
+
+	return members, nil
+}
+
+// read returns the content of the semaphore file, or nil if it has not been
+// initialized yet. Updates replace the file atomically, so it can be read
+// without locking it.
+func (c *FileLockClient) read() (*fileSemaphore, error) {
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	fs := &fileSemaphore{}
+	if err := json.Unmarshal(b, fs); err != nil {
+		return nil, err
+	}
+	if fs.Semaphore == nil {
+		return nil, errors.New("semaphore file has no semaphore")
+	}
+
+	return fs, nil
+}
+
+// update locks the semaphore file and applies f to its content. If f returns
+// a new content, it is written before the file is unlocked. If the file is
+// locked by someone else, update retries until the context is done.
+func (c *FileLockClient) update(ctx context.Context, f func(cur *fileSemaphore) (*fileSemaphore, error)) error {
+	var (
+		l   *filelock.UpdateableFileLock
+		err error
+	)
+	for {
+		l, err = filelock.NewExclusiveLock(c.path)
+		if err != filelock.AlreadyLockedErr {
+			break
+		}
+
+		select {
+		case <-time.After(fileLockRetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	cur, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	next, err := f(cur)
+	if err != nil || next == nil {
+		return err
+	}
+
+	b, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+
+	return l.Update(bytes.NewReader(b))
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestFileLockClientInit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tt := range []struct {
+		group string
+		path  string
+	}{
+		{"", "semaphore"},
+		{"", "semaphore"},
+		{"prod/database", "groups/prod%2Fdatabase/semaphore"},
+	} {
+		flc, err := NewFileLockClient(context.Background(), dir, tt.group)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		if want := filepath.Join(dir, tt.path); flc.path != want {
+			t.Errorf("case %d: unexpected path: got %v want %v", i, flc.path, want)
+		}
+	}
+
+	// initializing twice must not reset the semaphore
+	flc, err := NewFileLockClient(context.Background(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sem, err := flc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Semaphore{Index: 1, Semaphore: 1, Max: 1}); !reflect.DeepEqual(sem, want) {
+		t.Errorf("bad semaphore: got %#v, want %#v", sem, want)
+	}
+}
+
+func TestFileLockClientGetSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	flc, err := NewFileLockClient(context.Background(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sem, err := flc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := *sem
+	if err := sem.Lock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flc.Set(sem); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flc.Set(&stale); err != ErrCompareFailed {
+		t.Errorf("setting a stale semaphore should fail with ErrCompareFailed, got %v", err)
+	}
+
+	sem, err = flc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) || sem.Index != 2 {
+		t.Errorf("unexpected semaphore: %#v", sem)
+	}
+
+	if err := flc.Set(nil); err == nil {
+		t.Error("setting a nil semaphore should fail")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := flc.Watch(ctx, sem.Index); err != context.DeadlineExceeded {
+		t.Errorf("watching an unmodified semaphore should time out, got %v", err)
+	}
+	if err := flc.Watch(context.Background(), 1); err != nil {
+		t.Errorf("watching a modified semaphore should return, got %v", err)
+	}
+}
+
+func TestFileLockClientConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 5
+	flc, err := NewFileLockClient(context.Background(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := New("", flc).SetMax(n); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			// every machine has its own client, as separate hosts would.
+			c, err := NewFileLockClient(context.Background(), dir, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := New(id, c).Lock(); err != nil {
+				t.Errorf("%s: %v", id, err)
+			}
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+
+	sem, err := flc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sem.Holders) != n || sem.Semaphore != 0 {
+		t.Errorf("concurrent locks were lost: %#v", sem)
+	}
+}
+
+func TestFileLockClientMembers(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	dir, err := ioutil.TempDir("", "locksmith_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	flc, err := NewFileLockClient(context.Background(), dir, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New("a", flc).Heartbeat(context.Background(), Member{}); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(memberExpiry + time.Second)
+	if err := New("b/c", flc).Heartbeat(context.Background(), Member{}); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := flc.Members(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := members["b/c"]; !ok || len(members) != 1 {
+		t.Errorf("unexpected members: %v", members)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "groups", "db", "members"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "b%2Fc" {
+		t.Errorf("expired member file was not removed: %v", files)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+// maxHistory is the number of events kept in the history of a semaphore.
+// Older events are dropped as new ones are recorded.
+const maxHistory = 100
+
+// Event types recorded in the history of a semaphore.
+const (
+	// EventLock is recorded when a machine takes the semaphore.
+	EventLock = "lock"
+	// EventUnlock is recorded when a machine releases the semaphore.
+	EventUnlock = "unlock"
+	// EventForceUnlock is recorded when the semaphore of a machine is
+	// released on its behalf, e.g. with locksmithctl unlock.
+	EventForceUnlock = "force-unlock"
+	// EventReclaim is recorded when a machine reclaims the slot of a holder
+	// whose lease has expired.
+	EventReclaim = "reclaim"
+	// EventSetMax is recorded when the maximum number of holders changes.
+	EventSetMax = "set-max"
+	// EventSetRate is recorded when the rate limit of the semaphore
+	// changes.
+	EventSetRate = "set-rate"
+	// EventPause is recorded when the semaphore is paused.
+	EventPause = "pause"
+	// EventResume is recorded when a pause of the semaphore is ended.
+	EventResume = "resume"
+)
+
+// Event is an entry in the history of a semaphore.
+type Event struct {
+	// Type is the kind of event, e.g. EventLock.
+	Type string `json:"type"`
+	// Time is the unix time at which the event happened.
+	Time int64 `json:"time"`
+	// Machine is the id of the holder the event is about, if any.
+	Machine string `json:"machine,omitempty"`
+	// Actor is who caused the event, e.g. the machine itself or the user
+	// who ran locksmithctl.
+	Actor string `json:"actor,omitempty"`
+	// Reason describes why the event happened, if given.
+	Reason string `json:"reason,omitempty"`
+
+	// Semaphore, Max, MaxPercent and Holders are the state of the semaphore right
+	// after the event.
+	Semaphore  int      `json:"semaphore"`
+	Max        int      `json:"max"`
+	MaxPercent int      `json:"maxPercent,omitempty"`
+	Holders    []string `json:"holders,omitempty"`
+}
+
+// record appends an event of the given type to the history of the semaphore,
+// dropping the oldest events beyond maxHistory. It returns the new event.
+func (s *Semaphore) record(typ, machine, actor string) *Event {
+	e := &Event{
+		Type:       typ,
+		Time:       now().Unix(),
+		Machine:    machine,
+		Actor:      actor,
+		Semaphore:  s.Semaphore,
+		Max:        s.Max,
+		MaxPercent: s.MaxPercent,
+		Holders:    append([]string(nil), s.Holders...),
+	}
+	s.History = append(s.History, e)
+
+	if n := len(s.History) - maxHistory; n > 0 {
+		s.History = append([]*Event(nil), s.History[n:]...)
+	}
+
+	return e
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/k8s"
+)
+
+const (
+	// configMapName is the name of the ConfigMap holding the semaphore of
+	// the default group. The ConfigMaps of other groups are named after
+	// the group, prefixed with configMapName and a dash.
+	configMapName = "locksmith-reboot-lock"
+	// semaphoreDataKey is the ConfigMap data key holding the semaphore.
+	semaphoreDataKey = "semaphore"
+	// memberConfigMapName is the name of the ConfigMap holding the members
+	// of the default group, each under its id as data key. The ConfigMaps
+	// of other groups are named like those of their semaphores.
+	memberConfigMapName = "locksmith-members"
+)
+
+var (
+	// dns1123Subdomain matches the names Kubernetes accepts for ConfigMaps.
+	dns1123Subdomain = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	// configMapKey matches the data keys Kubernetes accepts for ConfigMaps.
+	configMapKey = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+)
+
+// ConfigMapAPI is the minimum Kubernetes API KubernetesLockClient needs to do
+// its job.
+type ConfigMapAPI interface {
+	GetConfigMap(ctx context.Context, namespace, name string) (*k8s.ConfigMap, error)
+	CreateConfigMap(ctx context.Context, cm *k8s.ConfigMap) (*k8s.ConfigMap, error)
+	UpdateConfigMap(ctx context.Context, cm *k8s.ConfigMap) (*k8s.ConfigMap, error)
+	WatchConfigMap(ctx context.Context, namespace, name, resourceVersion string) error
+}
+
+// KubernetesLockClient is a LockClient storing the semaphore in a Kubernetes
+// ConfigMap. The resource version of the ConfigMap is used as the index of
+// the semaphore, so updates are only applied if the ConfigMap was not
+// modified since it was read.
+type KubernetesLockClient struct {
+	api       ConfigMapAPI
+	namespace string
+	name      string
+	// members is the name of the ConfigMap holding the members of the
+	// group.
+	members string
+}
+
+// NewKubernetesLockClient creates a new KubernetesLockClient storing the
+// semaphore of group in a ConfigMap in the given namespace. If the group is
+// the empty string, the default semaphore will be used. Group names must be
+// valid Kubernetes object names. The semaphore is initialized within the given
+// context.
+func NewKubernetesLockClient(ctx context.Context, api ConfigMapAPI, namespace, group string) (*KubernetesLockClient, error) {
+	name, members := configMapName, memberConfigMapName
+	if group != "" {
+		name += "-" + group
+		members += "-" + group
+	}
+	if len(name) > 253 || !dns1123Subdomain.MatchString(name) {
+		return nil, fmt.Errorf("group %q is not a valid Kubernetes object name", group)
+	}
+
+	klc := &KubernetesLockClient{api, namespace, name, members}
+	if err := klc.InitContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return klc, nil
+}
+
+// Init is InitContext without a deadline.
+func (c *KubernetesLockClient) Init() error {
+	return c.InitContext(context.Background())
+}
+
+// InitContext creates the ConfigMap with an initial copy of the semaphore if it
+// doesn't exist yet.
+func (c *KubernetesLockClient) InitContext(ctx context.Context) error {
+	b, err := json.Marshal(newSemaphore())
+	if err != nil {
+		return err
+	}
+
+	cm := k8s.NewConfigMap(c.namespace, c.name)
+	cm.Data = map[string]string{semaphoreDataKey: string(b)}
+
+	_, err = c.api.CreateConfigMap(ctx, cm)
+	if k8s.IsAlreadyExists(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Get is GetContext without a deadline.
+func (c *KubernetesLockClient) Get() (*Semaphore, error) {
+	return c.GetContext(context.Background())
+}
+
+// GetContext fetches the Semaphore from the ConfigMap.
+func (c *KubernetesLockClient) GetContext(ctx context.Context) (*Semaphore, error) {
+	cm, err := c.api.GetConfigMap(ctx, c.namespace, c.name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := cm.Data[semaphoreDataKey]
+	if !ok {
+		return nil, ErrSemaphoreNotFound
+	}
+
+	sem := &Semaphore{}
+	if err := json.Unmarshal([]byte(data), sem); err != nil {
+		return nil, err
+	}
+
+	// resource versions are opaque to clients, but the API server uses
+	// the etcd revision, which is what fencing tokens rely on.
+	sem.Index, err = strconv.ParseUint(cm.Metadata.ResourceVersion, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected resource version %q: %v", cm.Metadata.ResourceVersion, err)
+	}
+
+	return sem, nil
+}
+
+// Set is SetContext without a deadline.
+func (c *KubernetesLockClient) Set(sem *Semaphore) error {
+	return c.SetContext(context.Background(), sem)
+}
+
+// SetContext stores a Semaphore in the ConfigMap. The semaphore is only written if
+// the ConfigMap was not modified since the semaphore was read, in which case
+// ErrCompareFailed is returned.
+func (c *KubernetesLockClient) SetContext(ctx context.Context, sem *Semaphore) error {
+	if sem == nil {
+		return errors.New("cannot set nil semaphore")
+	}
+	b, err := json.Marshal(sem)
+	if err != nil {
+		return err
+	}
+
+	cm := k8s.NewConfigMap(c.namespace, c.name)
+	cm.Data = map[string]string{semaphoreDataKey: string(b)}
+	if sem.Index != 0 {
+		cm.Metadata.ResourceVersion = strconv.FormatUint(sem.Index, 10)
+	}
+
+	_, err = c.api.UpdateConfigMap(ctx, cm)
+	if k8s.IsConflict(err) {
+		return ErrCompareFailed
+	}
+
+	return err
+}
+
+// Register stores member m under its id in the ConfigMap holding the members
+// of the group, which is separate from the ConfigMap of the semaphore. The
+// expire time of m is stored along with it, and expired members are removed
+// whenever a member registers.
+func (c *KubernetesLockClient) Register(ctx context.Context, h string, m *Member) error {
+	if !configMapKey.MatchString(h) {
+		return fmt.Errorf("member id %q is not a valid ConfigMap key", h)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxStoreAttempts; attempt++ {
+		cm, err := c.api.GetConfigMap(ctx, c.namespace, c.members)
+		if k8s.IsNotFound(err) {
+			cm = k8s.NewConfigMap(c.namespace, c.members)
+			cm.Data = map[string]string{h: string(b)}
+
+			_, err = c.api.CreateConfigMap(ctx, cm)
+			if k8s.IsAlreadyExists(err) {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		_, expired, err := decodeMembers(cm.Data)
+		if err != nil {
+			return err
+		}
+		for _, id := range expired {
+			delete(cm.Data, id)
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[h] = string(b)
+
+		_, err = c.api.UpdateConfigMap(ctx, cm)
+		if k8s.IsConflict(err) {
+			continue
+		}
+		return err
+	}
+
+	return &ConflictError{Attempts: maxStoreAttempts}
+}
+
+// Members returns the members registered in the group of the semaphore.
+func (c *KubernetesLockClient) Members(ctx context.Context) (map[string]*Member, error) {
+	cm, err := c.api.GetConfigMap(ctx, c.namespace, c.members)
+	if k8s.IsNotFound(err) {
+		return make(map[string]*Member), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	members, _, err := decodeMembers(cm.Data)
+	return members, err
+}
+
+// decodeMembers decodes the members stored in data, returning those which
+// have not expired by id, and the ids of those which have.
+func decodeMembers(data map[string]string) (map[string]*Member, []string, error) {
+	members := make(map[string]*Member)
+	var expired []string
+	t := now()
+	for id, v := range data {
+		m := &Member{}
+		if err := json.Unmarshal([]byte(v), m); err != nil {
+			return nil, nil, err
+		}
+		if m.Expired(t) {
+			expired = append(expired, id)
+			continue
+		}
+		members[id] = m
+	}
+
+	return members, expired, nil
+}
+
+// Watch blocks until the ConfigMap is modified after the given index.
+func (c *KubernetesLockClient) Watch(ctx context.Context, index uint64) error {
+	return c.api.WatchConfigMap(ctx, c.namespace, c.name, strconv.FormatUint(index, 10))
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/k8s"
+)
+
+// testConfigMapAPI is an in-memory Kubernetes ConfigMap store. It is safe
+// for concurrent use.
+type testConfigMapAPI struct {
+	mu  sync.Mutex
+	rv  int
+	cms map[string]k8s.ConfigMap
+}
+
+func newTestConfigMapAPI() *testConfigMapAPI {
+	return &testConfigMapAPI{cms: make(map[string]k8s.ConfigMap)}
+}
+
+func (t *testConfigMapAPI) GetConfigMap(ctx context.Context, namespace, name string) (*k8s.ConfigMap, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cm, ok := t.cms[namespace+"/"+name]
+	if !ok {
+		return nil, &k8s.StatusError{Code: 404, Reason: k8s.ReasonNotFound}
+	}
+	return &cm, nil
+}
+
+func (t *testConfigMapAPI) CreateConfigMap(ctx context.Context, cm *k8s.ConfigMap) (*k8s.ConfigMap, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := cm.Metadata.Namespace + "/" + cm.Metadata.Name
+	if _, ok := t.cms[key]; ok {
+		return nil, &k8s.StatusError{Code: 409, Reason: k8s.ReasonAlreadyExists}
+	}
+	return t.store(key, cm), nil
+}
+
+func (t *testConfigMapAPI) UpdateConfigMap(ctx context.Context, cm *k8s.ConfigMap) (*k8s.ConfigMap, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := cm.Metadata.Namespace + "/" + cm.Metadata.Name
+	old, ok := t.cms[key]
+	if !ok {
+		return nil, &k8s.StatusError{Code: 404, Reason: k8s.ReasonNotFound}
+	}
+	if rv := cm.Metadata.ResourceVersion; rv != "" && rv != old.Metadata.ResourceVersion {
+		return nil, &k8s.StatusError{Code: 409, Reason: k8s.ReasonConflict}
+	}
+	return t.store(key, cm), nil
+}
+
+func (t *testConfigMapAPI) WatchConfigMap(ctx context.Context, namespace, name, resourceVersion string) error {
+	return nil
+}
+
+func (t *testConfigMapAPI) store(key string, cm *k8s.ConfigMap) *k8s.ConfigMap {
+	t.rv++
+	stored := *cm
+	stored.Metadata.ResourceVersion = strconv.Itoa(t.rv)
+	t.cms[key] = stored
+	return &stored
+}
+
+// NewTestKubernetesLockClient returns a KubernetesLockClient backed by an
+// in-memory ConfigMap store, for the conformance tests in package lock_test.
+func NewTestKubernetesLockClient() (*KubernetesLockClient, error) {
+	return NewKubernetesLockClient(context.Background(), newTestConfigMapAPI(), "default", "")
+}
+
+func TestKubernetesLockClientInit(t *testing.T) {
+	api := newTestConfigMapAPI()
+	for i, tt := range []struct {
+		group string
+		name  string
+		err   bool
+	}{
+		{"", "locksmith-reboot-lock", false},
+		{"", "locksmith-reboot-lock", false},
+		{"rack-12", "locksmith-reboot-lock-rack-12", false},
+		{"prod/database", "", true},
+		{"Upper", "", true},
+	} {
+		klc, err := NewKubernetesLockClient(context.Background(), api, "kube-system", tt.group)
+		if (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected error state: %v", i, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+
+		if klc.name != tt.name {
+			t.Errorf("case %d: unexpected ConfigMap name: got %v want %v", i, klc.name, tt.name)
+		}
+	}
+
+	// initializing twice must not reset the semaphore
+	if got := api.cms["kube-system/locksmith-reboot-lock"].Metadata.ResourceVersion; got != "1" {
+		t.Errorf("semaphore was overwritten, resource version is %s", got)
+	}
+}
+
+func TestKubernetesLockClientGetSet(t *testing.T) {
+	api := newTestConfigMapAPI()
+	klc, err := NewKubernetesLockClient(context.Background(), api, "kube-system", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sem, err := klc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Semaphore{Index: 1, Semaphore: 1, Max: 1}); !reflect.DeepEqual(sem, want) {
+		t.Fatalf("bad semaphore: got %#v, want %#v", sem, want)
+	}
+
+	stale := *sem
+	if err := sem.Lock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := klc.Set(sem); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := klc.Set(&stale); err != ErrCompareFailed {
+		t.Errorf("setting a stale semaphore should fail with ErrCompareFailed, got %v", err)
+	}
+
+	sem, err = klc.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) || sem.Index != 2 {
+		t.Errorf("unexpected semaphore: %#v", sem)
+	}
+
+	if err := klc.Set(nil); err == nil {
+		t.Error("setting a nil semaphore should fail")
+	}
+
+	for i, cm := range []k8s.ConfigMap{
+		{Metadata: k8s.ObjectMeta{ResourceVersion: "3"}},
+		{Metadata: k8s.ObjectMeta{ResourceVersion: "3"}, Data: map[string]string{semaphoreDataKey: "{"}},
+		{Metadata: k8s.ObjectMeta{ResourceVersion: "abc"}, Data: map[string]string{semaphoreDataKey: "{}"}},
+	} {
+		api.cms["kube-system/locksmith-reboot-lock"] = cm
+		if _, err := klc.Get(); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
+
+func TestKubernetesLockClientMembers(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	api := newTestConfigMapAPI()
+	klc, err := NewKubernetesLockClient(context.Background(), api, "kube-system", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sem := api.cms["kube-system/locksmith-reboot-lock-db"]
+
+	if err := New("a", klc).Heartbeat(context.Background(), Member{}); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(memberExpiry + time.Second)
+	if err := New("b", klc).Heartbeat(context.Background(), Member{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := New("b/c", klc).Heartbeat(context.Background(), Member{}); err == nil {
+		t.Error("member ids which are not ConfigMap keys should be refused")
+	}
+
+	members, err := klc.Members(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := members["b"]; !ok || len(members) != 1 {
+		t.Errorf("unexpected members: %v", members)
+	}
+
+	cm := api.cms["kube-system/locksmith-members-db"]
+	if _, ok := cm.Data["a"]; ok || len(cm.Data) != 1 {
+		t.Errorf("expired member was not removed: %v", cm.Data)
+	}
+	if got := api.cms["kube-system/locksmith-reboot-lock-db"]; !reflect.DeepEqual(got, sem) {
+		t.Errorf("heartbeats modified the semaphore ConfigMap: %#v", got)
+	}
+}
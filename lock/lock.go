@@ -14,43 +14,143 @@
 
 package lock
 
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// maxStoreAttempts is the number of times an update of the semaphore is
+	// attempted before giving up because of concurrent modifications.
+	maxStoreAttempts = 10
+
+	// acquirePollInterval is the longest Acquire waits before trying to take
+	// the semaphore again, even if it has not changed.
+	acquirePollInterval = time.Minute
+	// minAcquireWait is the shortest Acquire waits for the semaphore to
+	// change.
+	minAcquireWait = time.Second
+
+	// waiterTTL is how long the place of a machine in the queue lasts
+	// without being refreshed. Acquire refreshes it once less than half of
+	// it is left, so it outlives the poll interval and the daemon's retry
+	// backoff.
+	waiterTTL = 10 * time.Minute
+)
+
+var (
+	// ErrInvalidToken is returned by Validate if the fencing token does not
+	// belong to the current holding of the semaphore by this lock id.
+	ErrInvalidToken = errors.New("invalid fencing token")
+)
+
+// NotStaleError is returned by ForceUnlock if the holder has shown signs of
+// life too recently to be considered stale.
+type NotStaleError struct {
+	LastSeen time.Time
+}
+
+func (e *NotStaleError) Error() string {
+	return fmt.Sprintf("holder is not stale, it was last seen at %s", e.LastSeen.UTC().Format(time.RFC3339))
+}
+
+// ConflictError is returned if the semaphore could not be updated because it
+// kept being modified by other clients.
+type ConflictError struct {
+	Attempts int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("semaphore was modified concurrently, gave up after %d attempts", e.Attempts)
+}
+
+// Condition decides whether a lock may take the semaphore sem, e.g. based on
+// the state of the services the machine runs. A non-nil error refuses the
+// semaphore.
+type Condition func(ctx context.Context, sem *Semaphore) error
+
+// conditionError is an error returned by the condition of a lock.
+type conditionError struct {
+	error
+}
+
 // Lock takes care of locking in generic clients
 type Lock struct {
-	id     string
-	client LockClient
+	id       string
+	client   ContextLockClient
+	registry MemberRegistry
+	ttl      time.Duration
+	info     Holder
+	actor    string
+	cond     Condition
 }
 
 // New returns a new lock with the provided arguments
 func New(id string, client LockClient) (lock *Lock) {
-	return &Lock{id, client}
+	registry, _ := client.(MemberRegistry)
+	return &Lock{id: id, client: withContext(client), registry: registry}
 }
 
-func (l *Lock) store(f func(*Semaphore) error) (err error) {
-	sem, err := l.client.Get()
-	if err != nil {
-		return err
-	}
+// SetTTL sets the lease duration used when this lock is acquired or renewed.
+// Holders whose lease has not been renewed within the ttl may be reclaimed by
+// other machines. A ttl of zero, the default, means the lease never expires.
+func (l *Lock) SetTTL(ttl time.Duration) {
+	l.ttl = ttl
+}
 
-	if err := f(sem); err != nil {
-		return err
-	}
+// store applies f to the current semaphore and stores the result. If the
+// semaphore is modified by another client in the meantime, it is re-read and
+// f applied again, up to maxStoreAttempts times.
+func (l *Lock) store(ctx context.Context, f func(*Semaphore) error) (err error) {
+	for attempt := 0; attempt < maxStoreAttempts; attempt++ {
+		sem, err := l.get(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := f(sem); err != nil {
+			return err
+		}
+
+		err = l.client.SetContext(ctx, sem)
+		if err == ErrCompareFailed {
+			continue
+		}
 
-	err = l.client.Set(sem)
-	if err != nil {
 		return err
 	}
 
-	return nil
+	return &ConflictError{Attempts: maxStoreAttempts}
 }
 
 // Get returns the current semaphore value
 // if the underlying client returns an error, Get passes it through
 func (l *Lock) Get() (sem *Semaphore, err error) {
-	sem, err = l.client.Get()
+	return l.GetContext(context.Background())
+}
+
+// GetContext is Get bounded by the given context.
+func (l *Lock) GetContext(ctx context.Context) (sem *Semaphore, err error) {
+	return l.get(ctx)
+}
+
+// get fetches the semaphore along with the members of its group, if the
+// client registers members.
+func (l *Lock) get(ctx context.Context) (*Semaphore, error) {
+	sem, err := l.client.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if l.registry != nil {
+		if sem.Members, err = l.registry.Members(ctx); err != nil {
+			return nil, err
+		}
+	}
+
 	return sem, nil
 }
 
@@ -59,25 +159,348 @@ func (l *Lock) Get() (sem *Semaphore, err error) {
 // if there is a problem getting or setting the semaphore, this function will
 // pass on errors from the underlying client
 func (l *Lock) SetMax(max int) (sem *Semaphore, oldMax int, err error) {
+	return l.SetMaxContext(context.Background(), max)
+}
+
+// SetMaxContext is SetMax bounded by the given context.
+func (l *Lock) SetMaxContext(ctx context.Context, max int) (sem *Semaphore, oldMax int, err error) {
+	var (
+		semRet *Semaphore
+		old    int
+	)
+
+	return semRet, old, l.store(ctx, func(sem *Semaphore) error {
+		old = sem.Max
+		semRet = sem
+		if err := sem.SetMax(max); err != nil {
+			return err
+		}
+		l.record(sem, EventSetMax, "")
+		return nil
+	})
+}
+
+// SetMaxPercent sets the maximum number of holders the semaphore will allow
+// to a percentage of the live members of the group, see
+// Semaphore.SetMaxPercent. It returns the current semaphore and the previous
+// effective maximum, and passes on errors from the underlying client.
+func (l *Lock) SetMaxPercent(ctx context.Context, pct int) (sem *Semaphore, oldMax int, err error) {
 	var (
 		semRet *Semaphore
 		old    int
 	)
 
-	return semRet, old, l.store(func(sem *Semaphore) error {
+	return semRet, old, l.store(ctx, func(sem *Semaphore) error {
 		old = sem.Max
 		semRet = sem
-		return sem.SetMax(max)
+		if err := sem.SetMaxPercent(pct); err != nil {
+			return err
+		}
+		l.record(sem, EventSetMax, "")
+		return nil
 	})
 }
 
+// Pause stops new holders from taking the semaphore until it is resumed, or
+// until the given time if it is not zero. Holders keep the semaphore, and the
+// maximum is left untouched.
+// if there is a problem getting or setting the semaphore, this function will
+// pass on errors from the underlying client
+func (l *Lock) Pause(ctx context.Context, reason string, until time.Time) error {
+	return l.store(ctx, func(sem *Semaphore) error {
+		sem.Pause(reason, until)
+		l.record(sem, EventPause, "")
+		return nil
+	})
+}
+
+// Resume ends a pause of the semaphore. It returns ErrNotPaused if the
+// semaphore is not paused, and passes on errors from the underlying client.
+func (l *Lock) Resume(ctx context.Context) error {
+	return l.store(ctx, func(sem *Semaphore) error {
+		if err := sem.Resume(); err != nil {
+			return err
+		}
+		l.record(sem, EventResume, "")
+		return nil
+	})
+}
+
+// SetCondition sets a condition which must be met for this lock id to take
+// the semaphore. It is evaluated against the semaphore as it is read, right
+// before this lock id would be added as a holder, every time the semaphore is
+// attempted. While the condition is not met, Acquire does not hold a place in
+// the queue of the semaphore, so that it does not block the machines behind.
+func (l *Lock) SetCondition(cond Condition) {
+	l.cond = cond
+}
+
+// SetActor sets who is recorded in the history of the semaphore as having
+// caused the changes made through this lock, e.g. the user running a command.
+// It defaults to the lock id.
+func (l *Lock) SetActor(actor string) {
+	l.actor = actor
+}
+
+// record appends an event caused by this lock to the history of sem and
+// returns it.
+func (l *Lock) record(sem *Semaphore, typ, machine string) *Event {
+	actor := l.actor
+	if actor == "" {
+		actor = l.id
+	}
+	return sem.record(typ, machine, actor)
+}
+
+// SetInfo sets the metadata, such as hostname and reason, recorded with this
+// lock id when it acquires the semaphore. Start and expire times and the
+// fencing token are ignored.
+func (l *Lock) SetInfo(info Holder) {
+	l.info = info
+}
+
 // Lock adds this lock id as a holder to the semaphore
+// holders whose lease has expired are removed before the lock is attempted.
 // it will return an error if there is a problem getting or setting the
 // semaphore, or if the maximum number of holders has been reached, or if a lock
 // with this id is already a holder
-func (l *Lock) Lock() (err error) {
-	return l.store(func(sem *Semaphore) error {
-		return sem.Lock(l.id)
+func (l *Lock) Lock() error {
+	_, err := l.LockContext(context.Background())
+	return err
+}
+
+// LockContext is Lock bounded by the given context. It returns the fencing
+// token of the acquisition, see Validate.
+func (l *Lock) LockContext(ctx context.Context) (token uint64, err error) {
+	token, _, err = l.lockOnce(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return token, nil
+}
+
+// lockOnce adds this lock id as a holder to the semaphore like Lock. If the
+// semaphore itself refuses the lock id, because it is full or other machines
+// are waiting ahead of it, the semaphore as it was read is returned along
+// with the error, so that the caller can wait for it to change. If the lock
+// id is already a holder, ErrExist is returned along with its token.
+func (l *Lock) lockOnce(ctx context.Context) (token uint64, refused *Semaphore, err error) {
+	err = l.store(ctx, func(sem *Semaphore) error {
+		if err := l.lock(ctx, sem); err != nil {
+			if err == ErrExist {
+				token = sem.token(l.id)
+			} else {
+				refused = sem
+			}
+			return err
+		}
+		token = sem.token(l.id)
+		return nil
+	})
+
+	if cerr, ok := err.(conditionError); ok {
+		err = cerr.error
+	}
+
+	return token, refused, err
+}
+
+// lock adds this lock id as a holder to sem, after reclaiming expired holders,
+// if the condition of the lock is met. Errors of the condition are returned
+// as a conditionError. The index sem was read at becomes the fencing token of the holder: the
+// semaphore is only stored if it was not modified since, so every successful
+// acquisition is made at a distinct index, higher than that of any earlier
+// one.
+func (l *Lock) lock(ctx context.Context, sem *Semaphore) error {
+	if err := l.admit(ctx, sem); err != nil {
+		return err
+	}
+
+	info := l.info
+	info.Token = sem.Index
+	if err := sem.LockWithInfo(l.id, info); err != nil {
+		return err
+	}
+	if err := sem.Renew(l.id, l.ttl); err != nil {
+		return err
+	}
+
+	l.record(sem, EventLock, l.id)
+	return nil
+}
+
+// admit checks whether this lock id may take sem right now, after reclaiming
+// expired holders, see Semaphore.admit. Errors of the condition of the lock
+// are returned as a conditionError.
+func (l *Lock) admit(ctx context.Context, sem *Semaphore) error {
+	for _, h := range sem.Reclaim() {
+		l.record(sem, EventReclaim, h)
+	}
+
+	if l.cond != nil && !sem.hasHolder(l.id) {
+		if err := l.cond(ctx, sem); err != nil {
+			return conditionError{err}
+		}
+	}
+
+	return sem.admit(l.id)
+}
+
+// Acquire adds this lock id as a holder to the semaphore, blocking until it
+// succeeds or the context is done. While the semaphore cannot be taken, the
+// lock id waits in the queue of the semaphore, so that machines are granted
+// the semaphore in the order in which they asked for it, and Acquire waits
+// for the semaphore to change before trying again, watching it if the client
+// supports it and polling it otherwise. The place in the queue is kept if the
+// context is done, so calling Acquire again does not lose it; it expires if
+// it is not refreshed by Acquire for a while. If this lock id is already a
+// holder, Acquire returns nil. Errors getting or setting the semaphore are
+// passed through. Like Lock, Acquire returns the fencing token of the
+// acquisition, or the token recorded for the existing holding.
+func (l *Lock) Acquire(ctx context.Context) (uint64, error) {
+	for {
+		sem, err := l.get(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		if sem.hasHolder(l.id) {
+			return sem.token(l.id), nil
+		}
+
+		index := sem.Index
+		wait := waitTime(sem)
+
+		err = l.lock(ctx, sem)
+		locked := err == nil
+		changed := locked
+		if !locked {
+			if _, ok := err.(conditionError); ok {
+				// leave the queue, so as not to block the machines
+				// behind while the condition is not met.
+				changed = sem.Dequeue(l.id) == nil
+			} else {
+				changed = l.enqueue(sem)
+			}
+		}
+
+		if changed {
+			err = l.client.SetContext(ctx, sem)
+			if err == nil && locked {
+				return sem.token(l.id), nil
+			}
+			if err != nil && err != ErrCompareFailed {
+				return 0, err
+			}
+			// either someone else modified the semaphore, or this lock
+			// id just joined or left the queue and the semaphore may be
+			// taken already; retry right away.
+			continue
+		}
+
+		if err := l.wait(ctx, index, wait); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// enqueue adds this lock id to the queue of sem, or refreshes its place in
+// the queue if less than half of waiterTTL is left. It reports whether sem
+// was modified.
+func (l *Lock) enqueue(sem *Semaphore) bool {
+	if w := sem.waiter(l.id); w != nil && !w.Expired(now().Add(waiterTTL/2)) {
+		return false
+	}
+
+	sem.Enqueue(l.id, waiterTTL)
+	return true
+}
+
+// waitTime returns how long to wait for sem to change before trying to take
+// it again: the poll interval, or less if a holder or waiter expires sooner.
+func waitTime(sem *Semaphore) time.Duration {
+	wait := acquirePollInterval
+	if t, ok := sem.nextExpiry(); ok {
+		if d := t.Sub(now()); d < wait {
+			wait = d
+		}
+	}
+
+	return wait
+}
+
+// wait blocks until the semaphore is modified after index, or for at most
+// the given duration.
+func (l *Lock) wait(ctx context.Context, index uint64, d time.Duration) error {
+	if d < minAcquireWait {
+		d = minAcquireWait
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	if w, ok := l.client.(Watcher); ok {
+		err := w.Watch(wctx, index)
+		if err != nil && wctx.Err() == nil {
+			return err
+		}
+	} else {
+		<-wctx.Done()
+	}
+
+	return ctx.Err()
+}
+
+// Validate checks that token is the fencing token of the current holding of
+// the semaphore by this lock id. It returns ErrInvalidToken if this lock id
+// no longer holds the semaphore, its lease has expired, or it has been
+// acquired again since the token was handed out. Errors getting the semaphore
+// are passed through.
+func (l *Lock) Validate(ctx context.Context, token uint64) error {
+	sem, err := l.client.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if token == 0 || !sem.hasHolder(l.id) || sem.token(l.id) != token {
+		return ErrInvalidToken
+	}
+
+	if info := sem.HolderInfo[l.id]; info.Expired(now()) {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// Renew extends the lease of this lock id by the lock's ttl
+// it returns an error if there is a problem getting or setting the semaphore,
+// or if this lock is not locked.
+func (l *Lock) Renew(ctx context.Context) error {
+	return l.store(ctx, func(sem *Semaphore) error {
+		return sem.Renew(l.id, l.ttl)
+	})
+}
+
+// SetUnlockTime records the time at which this lock id is going to release
+// the semaphore, so that others can tell how long it is going to be held. A
+// zero time clears it.
+// it returns an error if there is a problem getting or setting the semaphore,
+// or if this lock is not locked.
+func (l *Lock) SetUnlockTime(ctx context.Context, t time.Time) error {
+	return l.store(ctx, func(sem *Semaphore) error {
+		return sem.SetUnlockTime(l.id, t)
+	})
+}
+
+// SetGated records whether this lock id keeps the semaphore because its
+// health checks did not pass, see Holder.Gated.
+// it returns an error if there is a problem getting or setting the semaphore,
+// or if this lock is not locked.
+func (l *Lock) SetGated(ctx context.Context, gated bool) error {
+	return l.store(ctx, func(sem *Semaphore) error {
+		return sem.SetGated(l.id, gated)
 	})
 }
 
@@ -85,7 +508,38 @@ func (l *Lock) Lock() (err error) {
 // it returns an error if there is a problem getting or setting the semaphore,
 // or if this lock is not locked.
 func (l *Lock) Unlock() error {
-	return l.store(func(sem *Semaphore) error {
-		return sem.Unlock(l.id)
+	return l.UnlockContext(context.Background())
+}
+
+// UnlockContext is Unlock bounded by the given context.
+func (l *Lock) UnlockContext(ctx context.Context) error {
+	return l.store(ctx, func(sem *Semaphore) error {
+		if err := sem.Unlock(l.id); err != nil {
+			return err
+		}
+		l.record(sem, EventUnlock, l.id)
+		return nil
+	})
+}
+
+// ForceUnlock removes this lock id as a holder of the semaphore like Unlock,
+// on behalf of a machine which cannot release the semaphore itself. It is
+// recorded as a forced unlock in the history of the semaphore, along with the
+// given reason. If staleAfter is not zero, the holder is only removed if it
+// is stale, see Semaphore.Stale; otherwise a *NotStaleError is returned.
+func (l *Lock) ForceUnlock(ctx context.Context, reason string, staleAfter time.Duration) error {
+	return l.store(ctx, func(sem *Semaphore) error {
+		if !sem.hasHolder(l.id) {
+			return ErrNotExist
+		}
+		if staleAfter != 0 && !sem.Stale(l.id, now(), staleAfter) {
+			return &NotStaleError{LastSeen: sem.LastSeen(l.id)}
+		}
+
+		if err := sem.Unlock(l.id); err != nil {
+			return err
+		}
+		l.record(sem, EventForceUnlock, l.id).Reason = reason
+		return nil
 	})
 }
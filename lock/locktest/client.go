@@ -0,0 +1,206 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package locktest provides an in-memory lock.LockClient and a conformance
+// suite for lock.LockClient implementations.
+package locktest
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+// Client is an in-memory lock.LockClient, safe for concurrent use. Like the
+// etcd clients, it only stores a semaphore if it was not modified since it
+// was read, and it can be told to fail updates as if other clients had
+// modified the semaphore concurrently.
+type Client struct {
+	mu        sync.Mutex
+	sem       []byte
+	index     uint64
+	conflicts int
+	changed   chan struct{}
+	members   map[string][]byte
+}
+
+// NewClient returns a new Client holding no semaphore yet.
+func NewClient() *Client {
+	return &Client{changed: make(chan struct{})}
+}
+
+// InjectConflicts makes the next n calls to Set fail with
+// lock.ErrCompareFailed, as if another client had modified the semaphore
+// right before each of them.
+func (c *Client) InjectConflicts(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conflicts = n
+}
+
+// Init is InitContext without a deadline.
+func (c *Client) Init() error {
+	return c.InitContext(context.Background())
+}
+
+// InitContext sets an initial copy of the semaphore if it doesn't exist yet.
+func (c *Client) InitContext(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sem != nil {
+		return nil
+	}
+
+	return c.store(&lock.Semaphore{Semaphore: 1, Max: 1})
+}
+
+// Get is GetContext without a deadline.
+func (c *Client) Get() (*lock.Semaphore, error) {
+	return c.GetContext(context.Background())
+}
+
+// GetContext returns a copy of the stored semaphore.
+func (c *Client) GetContext(ctx context.Context) (*lock.Semaphore, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sem == nil {
+		return nil, errors.New("semaphore not initialized")
+	}
+
+	// the semaphore is kept encoded, so that callers never share memory
+	// with it, and fields which would not survive a real store do not
+	// survive this one either.
+	sem := &lock.Semaphore{}
+	if err := json.Unmarshal(c.sem, sem); err != nil {
+		return nil, err
+	}
+	sem.Index = c.index
+
+	return sem, nil
+}
+
+// Set is SetContext without a deadline.
+func (c *Client) Set(sem *lock.Semaphore) error {
+	return c.SetContext(context.Background(), sem)
+}
+
+// SetContext stores sem if the stored semaphore was not modified since sem
+// was read, and returns lock.ErrCompareFailed otherwise.
+func (c *Client) SetContext(ctx context.Context, sem *lock.Semaphore) error {
+	if sem == nil {
+		return errors.New("cannot set nil semaphore")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sem == nil {
+		return errors.New("semaphore not initialized")
+	}
+
+	if c.conflicts > 0 {
+		c.conflicts--
+		c.modified()
+		return lock.ErrCompareFailed
+	}
+
+	if sem.Index != 0 && sem.Index != c.index {
+		return lock.ErrCompareFailed
+	}
+
+	return c.store(sem)
+}
+
+// Register stores member m under id h. Registering members does not modify
+// the semaphore.
+func (c *Client) Register(ctx context.Context, h string, m *lock.Member) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.members == nil {
+		c.members = make(map[string][]byte)
+	}
+	c.members[h] = b
+	return nil
+}
+
+// Members returns copies of the registered members which have not expired.
+func (c *Client) Members(ctx context.Context) (map[string]*lock.Member, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := make(map[string]*lock.Member)
+	t := time.Now()
+	for id, b := range c.members {
+		m := &lock.Member{}
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, err
+		}
+		if !m.Expired(t) {
+			members[id] = m
+		}
+	}
+
+	return members, nil
+}
+
+// Watch blocks until the semaphore is modified after the given index.
+func (c *Client) Watch(ctx context.Context, index uint64) error {
+	c.mu.Lock()
+	if c.index != index {
+		c.mu.Unlock()
+		return nil
+	}
+	ch := c.changed
+	c.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// store encodes and stores sem. c.mu must be held.
+func (c *Client) store(sem *lock.Semaphore) error {
+	b, err := json.Marshal(sem)
+	if err != nil {
+		return err
+	}
+
+	c.sem = b
+	c.modified()
+	return nil
+}
+
+// modified bumps the index and wakes up watchers. c.mu must be held.
+func (c *Client) modified() {
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
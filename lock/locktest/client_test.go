@@ -0,0 +1,51 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locktest
+
+import (
+	"testing"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+func TestClient(t *testing.T) {
+	TestLockClient(t, func(t *testing.T) lock.LockClient {
+		c := NewClient()
+		if err := c.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
+
+func TestInjectConflicts(t *testing.T) {
+	c := NewClient()
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	l := lock.New("a", c)
+
+	c.InjectConflicts(3)
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock should retry past a few conflicts: %v", err)
+	}
+
+	c.InjectConflicts(100)
+	if err := l.Unlock(); err == nil {
+		t.Fatal("Unlock should give up after too many conflicts")
+	} else if _, ok := err.(*lock.ConflictError); !ok {
+		t.Errorf("expected a ConflictError, got %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locktest
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+const (
+	// concurrentMachines is the number of goroutines competing for the
+	// semaphore in the concurrency test, each standing for a machine.
+	concurrentMachines = 8
+	// concurrentRounds is how often each of them takes the semaphore.
+	concurrentRounds = 3
+	// concurrentTimeout bounds the concurrency test.
+	concurrentTimeout = 30 * time.Second
+)
+
+// TestLockClient runs the conformance suite against the LockClient
+// implementation returned by newClient. Every call to newClient must return
+// an initialized client for a new semaphore, which is safe for concurrent use.
+// Registering members is only tested if the client is a lock.MemberRegistry.
+func TestLockClient(t *testing.T, newClient func(t *testing.T) lock.LockClient) {
+	for _, tt := range []struct {
+		name string
+		test func(t *prefixT, c lock.LockClient)
+	}{
+		{"Init", testInit},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"HolderInfo", testHolderInfo},
+		{"IdempotentUnlock", testIdempotentUnlock},
+		{"SetMaxWhileHeld", testSetMaxWhileHeld},
+		{"FencingTokens", testFencingTokens},
+		{"Concurrent", testConcurrent},
+		{"Members", testMembers},
+	} {
+		tt.test(&prefixT{T: t, prefix: tt.name + ": "}, newClient(t))
+	}
+}
+
+// prefixT prefixes failures with the name of the test that failed, as
+// subtests need go 1.7.
+type prefixT struct {
+	*testing.T
+	prefix string
+}
+
+func (t *prefixT) Error(args ...interface{}) {
+	t.T.Error(t.prefix + fmt.Sprint(args...))
+}
+
+func (t *prefixT) Errorf(format string, args ...interface{}) {
+	t.T.Errorf(t.prefix+format, args...)
+}
+
+func (t *prefixT) Fatal(args ...interface{}) {
+	t.T.Fatal(t.prefix + fmt.Sprint(args...))
+}
+
+func (t *prefixT) Fatalf(format string, args ...interface{}) {
+	t.T.Fatalf(t.prefix+format, args...)
+}
+
+func getSemaphore(t *prefixT, c lock.LockClient) *lock.Semaphore {
+	sem, err := c.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return sem
+}
+
+func testInit(t *prefixT, c lock.LockClient) {
+	if err := c.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	sem := getSemaphore(t, c)
+	if sem.Semaphore != 1 || sem.Max != 1 || len(sem.Holders) != 0 {
+		t.Errorf("unexpected initial semaphore: %#v", sem)
+	}
+
+	// initializing again must not reset the semaphore
+	if err := lock.New("a", c).Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if sem := getSemaphore(t, c); !reflect.DeepEqual(sem.Holders, []string{"a"}) {
+		t.Errorf("Init reset the semaphore: %#v", sem)
+	}
+}
+
+func testCompareAndSwap(t *prefixT, c lock.LockClient) {
+	sem := getSemaphore(t, c)
+	stale := getSemaphore(t, c)
+
+	if err := sem.Lock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(sem); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	if err := stale.Lock("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(stale); err != lock.ErrCompareFailed {
+		t.Errorf("setting a stale semaphore should fail with ErrCompareFailed, got %v", err)
+	}
+
+	sem = getSemaphore(t, c)
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) {
+		t.Errorf("unexpected holders: %v", sem.Holders)
+	}
+	if sem.Index == stale.Index {
+		t.Errorf("index did not change after Set: %d", sem.Index)
+	}
+
+	if err := c.Set(nil); err == nil {
+		t.Error("setting a nil semaphore should fail")
+	}
+}
+
+func testHolderInfo(t *prefixT, c lock.LockClient) {
+	l := lock.New("a", c)
+	l.SetTTL(time.Hour)
+	l.SetInfo(lock.Holder{Hostname: "host-a", Reason: "update", Version: "1235.0.0", Strategy: "etcd-lock"})
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, ok := getSemaphore(t, c).HolderInfo["a"]
+	if !ok {
+		t.Fatal("holder info was not stored")
+	}
+	if info.Hostname != "host-a" || info.Reason != "update" || info.Version != "1235.0.0" || info.Strategy != "etcd-lock" {
+		t.Errorf("holder info was not stored faithfully: %#v", info)
+	}
+	if info.StartTime == 0 || info.ExpireTime <= info.StartTime {
+		t.Errorf("lease was not stored: %#v", info)
+	}
+}
+
+func testIdempotentUnlock(t *prefixT, c lock.LockClient) {
+	l := lock.New("a", c)
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.Unlock(); err != lock.ErrNotExist {
+			t.Errorf("unlocking a released lock should fail with ErrNotExist, got %v", err)
+		}
+	}
+
+	sem := getSemaphore(t, c)
+	if sem.Semaphore != 1 || sem.Max != 1 || len(sem.Holders) != 0 {
+		t.Errorf("repeated unlocks changed the semaphore: %#v", sem)
+	}
+}
+
+func testSetMaxWhileHeld(t *prefixT, c lock.LockClient) {
+	al, bl, cl := lock.New("a", c), lock.New("b", c), lock.New("c", c)
+	mustLock := func(l *lock.Lock, ok bool) {
+		err := l.Lock()
+		if (err == nil) != ok {
+			t.Fatalf("unexpected lock result: %v (semaphore %v)", err, getSemaphore(t, c))
+		}
+	}
+	mustUnlock := func(l *lock.Lock) {
+		if err := l.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMax := func(max, wantAvailable int) {
+		sem, _, err := lock.New("", c).SetMax(max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sem.Max != max || sem.Semaphore != wantAvailable {
+			t.Fatalf("unexpected semaphore after SetMax(%d): %#v", max, sem)
+		}
+	}
+
+	mustLock(al, true)
+	setMax(2, 1)
+	mustLock(bl, true)
+	mustLock(cl, false)
+
+	// lowering the maximum keeps the current holders.
+	setMax(1, -1)
+	mustUnlock(al)
+	mustLock(cl, false)
+	mustUnlock(bl)
+	mustLock(cl, true)
+
+	if sem := getSemaphore(t, c); !reflect.DeepEqual(sem.Holders, []string{"c"}) || sem.Semaphore != 0 {
+		t.Errorf("unexpected semaphore: %#v", sem)
+	}
+}
+
+func testFencingTokens(t *prefixT, c lock.LockClient) {
+	l := lock.New("a", c)
+
+	var last uint64
+	for i := 0; i < 3; i++ {
+		token, err := l.LockContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token <= last {
+			t.Errorf("token %d is not higher than the previous token %d", token, last)
+		}
+		if err := l.Validate(context.Background(), token); err != nil {
+			t.Errorf("Validate: %v", err)
+		}
+		if err := l.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Validate(context.Background(), token); err != lock.ErrInvalidToken {
+			t.Errorf("token of a released lock should be invalid, got %v", err)
+		}
+		last = token
+	}
+}
+
+func testConcurrent(t *prefixT, c lock.LockClient) {
+	const max = 2
+	if _, _, err := lock.New("", c).SetMax(max); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), concurrentTimeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		held int32
+	)
+	for i := 0; i < concurrentMachines; i++ {
+		wg.Add(1)
+		go func(l *lock.Lock) {
+			defer wg.Done()
+
+			for round := 0; round < concurrentRounds; round++ {
+				// the semaphore being full, or being modified by
+				// the others too often, are expected; keep trying.
+				for {
+					_, err := l.LockContext(ctx)
+					if err == nil {
+						break
+					}
+					if ctx.Err() != nil {
+						t.Errorf("lock not acquired in time, last error: %v", err)
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+
+				if n := atomic.AddInt32(&held, 1); n > max {
+					t.Errorf("%d holders, want at most %d", n, max)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&held, -1)
+
+				for {
+					err := l.UnlockContext(ctx)
+					if err == nil {
+						break
+					}
+					if ctx.Err() != nil {
+						t.Errorf("lock not released in time, last error: %v", err)
+						return
+					}
+				}
+			}
+		}(lock.New(fmt.Sprint("machine-", i), c))
+	}
+	wg.Wait()
+
+	sem := getSemaphore(t, c)
+	if sem.Semaphore != max || len(sem.Holders) != 0 {
+		t.Errorf("semaphore not released after concurrent use: %#v", sem)
+	}
+}
+
+func testMembers(t *prefixT, c lock.LockClient) {
+	if _, ok := c.(lock.MemberRegistry); !ok {
+		return
+	}
+
+	before := getSemaphore(t, c)
+	for _, m := range []struct {
+		id       string
+		hostname string
+	}{
+		{"a", "host-a"},
+		{"b", "host-b"},
+		{"a", "host-a2"},
+	} {
+		if err := lock.New(m.id, c).Heartbeat(context.Background(), lock.Member{Hostname: m.hostname}); err != nil {
+			t.Fatalf("Heartbeat: %v", err)
+		}
+	}
+
+	sem, err := lock.New("", c).Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if sem.Index != before.Index {
+		t.Errorf("heartbeats modified the semaphore: index %d, was %d", sem.Index, before.Index)
+	}
+	if len(sem.Members) != 2 || sem.Members["a"] == nil || sem.Members["b"] == nil {
+		t.Fatalf("unexpected members: %v", sem.Members)
+	}
+	if a := sem.Members["a"]; a.Hostname != "host-a2" || !a.Alive(time.Now()) {
+		t.Errorf("member was not updated: %#v", a)
+	}
+	if b := sem.Members["b"]; b.Hostname != "host-b" || !b.Alive(time.Now()) {
+		t.Errorf("member was not stored faithfully: %#v", b)
+	}
+}
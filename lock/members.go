@@ -0,0 +1,131 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// HeartbeatInterval is how often members are expected to heartbeat.
+	HeartbeatInterval = time.Minute
+	// memberTimeout is how long a member is considered alive after its
+	// last heartbeat.
+	memberTimeout = 5 * HeartbeatInterval
+	// memberExpiry is how long a member is kept in the registry after its
+	// last heartbeat, so that machines which went away are still listed
+	// for a while before they are forgotten.
+	memberExpiry = 24 * time.Hour
+	// memberBranch is the key next to the semaphore below which the
+	// members of its group are stored, one key per member.
+	memberBranch = "members"
+)
+
+// ErrNoMembers is returned by Lock.Heartbeat if the client of the lock cannot
+// register members.
+var ErrNoMembers = errors.New("lock client cannot register members")
+
+// MemberRegistry is implemented by LockClients which can register the members
+// of the group of the semaphore. Every member is stored on its own, apart
+// from the semaphore, so that heartbeats neither conflict with updates of the
+// semaphore nor wake up the machines waiting for it. All LockClients of this
+// package implement it.
+type MemberRegistry interface {
+	// Register stores member m under id h, replacing an earlier
+	// registration of h. The member is forgotten once its ExpireTime has
+	// passed.
+	Register(ctx context.Context, h string, m *Member) error
+	// Members returns the registered members which have not expired yet,
+	// by id.
+	Members(ctx context.Context) (map[string]*Member, error)
+}
+
+// Member describes a machine registered in the group of a semaphore.
+type Member struct {
+	// Hostname is the hostname of the machine.
+	Hostname string `json:"hostname,omitempty"`
+	// Version is the OS version the machine runs.
+	Version string `json:"version,omitempty"`
+	// Strategy is the reboot strategy of the machine.
+	Strategy string `json:"strategy,omitempty"`
+	// Operation is the current operation of the update engine of the
+	// machine, e.g. UPDATE_STATUS_IDLE.
+	Operation string `json:"operation,omitempty"`
+	// EtcdMember is the id of the etcd member the machine runs, if any.
+	EtcdMember string `json:"etcdMember,omitempty"`
+	// LastHeartbeat is the unix time of the latest heartbeat of the
+	// machine.
+	LastHeartbeat int64 `json:"lastHeartbeat"`
+	// ExpireTime is the unix time at which the member is forgotten unless
+	// it heartbeats again.
+	ExpireTime int64 `json:"expireTime,omitempty"`
+}
+
+// Alive reports whether the member has heartbeated recently enough at time t
+// to be considered alive.
+func (m *Member) Alive(t time.Time) bool {
+	return t.Sub(time.Unix(m.LastHeartbeat, 0)) <= memberTimeout
+}
+
+// Expired reports whether the registration of the member has run out at time
+// t.
+func (m *Member) Expired(t time.Time) bool {
+	return m.ExpireTime != 0 && t.Unix() > m.ExpireTime
+}
+
+// ttl returns the number of seconds left until the registration of the member
+// runs out at time t, at least 1.
+func (m *Member) ttl(t time.Time) int64 {
+	ttl := m.ExpireTime - t.Unix()
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	return ttl
+}
+
+// Heartbeat registers this lock id as a member of the group of the semaphore,
+// or refreshes its registration, recording m with the current time as its
+// last heartbeat. It should be called every HeartbeatInterval for the member
+// to be considered alive. Members which have not heartbeated for a long time
+// are forgotten. The semaphore itself is not modified.
+// it returns ErrNoMembers if the client cannot register members, and passes
+// on errors from the underlying client.
+func (l *Lock) Heartbeat(ctx context.Context, m Member) error {
+	if l.registry == nil {
+		return ErrNoMembers
+	}
+
+	t := now()
+	m.LastHeartbeat = t.Unix()
+	m.ExpireTime = t.Add(memberExpiry).Unix()
+	return l.registry.Register(ctx, l.id, &m)
+}
+
+// Heartbeat registers this id as a member of every group, see Lock.Heartbeat.
+// All groups are heartbeated even if one of them fails; the first error is
+// returned.
+func (m *MultiLock) Heartbeat(ctx context.Context, member Member) (err error) {
+	for _, l := range m.locks {
+		if herr := l.Heartbeat(ctx, member); herr != nil && err == nil {
+			err = herr
+		}
+	}
+
+	return err
+}
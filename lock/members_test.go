@@ -0,0 +1,159 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestHeartbeat(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	c := newWatchLockClient()
+	index := c.sem.Index
+	m := NewMulti("a", c)
+	if err := m.Heartbeat(context.Background(), Member{Hostname: "core-01", Operation: "UPDATE_STATUS_IDLE"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := New("b", c).Heartbeat(context.Background(), Member{Hostname: "core-02"}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock = clock.Add(2 * time.Minute)
+	if err := m.Heartbeat(context.Background(), Member{Hostname: "core-01", Operation: "UPDATE_STATUS_UPDATED_NEED_REBOOT"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sem, err := New("", c).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*Member{
+		"a": {Hostname: "core-01", Operation: "UPDATE_STATUS_UPDATED_NEED_REBOOT", LastHeartbeat: 100120, ExpireTime: 100120 + 86400},
+		"b": {Hostname: "core-02", LastHeartbeat: 100000, ExpireTime: 100000 + 86400},
+	}
+	if !reflect.DeepEqual(sem.Members, want) {
+		t.Fatalf("unexpected members: got %v want %v", sem.Members, want)
+	}
+	if sem.Index != index || len(sem.History) != 0 {
+		t.Errorf("heartbeats should not modify the semaphore: index %d, history %v", sem.Index, sem.History)
+	}
+
+	for i, tt := range []struct {
+		after time.Duration
+		alive bool
+	}{
+		{0, true},
+		{memberTimeout, true},
+		{memberTimeout + time.Second, false},
+	} {
+		if got := sem.Members["b"].Alive(time.Unix(100000, 0).Add(tt.after)); got != tt.alive {
+			t.Errorf("case %d: got alive %v want %v", i, got, tt.alive)
+		}
+	}
+
+	// members which stopped heartbeating long ago are forgotten.
+	clock = time.Unix(100000, 0).Add(memberExpiry + time.Second)
+	sem, err = New("", c).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sem.Members["b"]; ok {
+		t.Error("expired member was not removed")
+	}
+	if _, ok := sem.Members["a"]; !ok {
+		t.Error("member was removed before it expired")
+	}
+
+	if err := New("a", &testLockClient{}).Heartbeat(context.Background(), Member{}); err != ErrNoMembers {
+		t.Errorf("heartbeat without a registry should fail with ErrNoMembers, got %v", err)
+	}
+}
+
+// addMember registers a live member h in sem, as Lock does when it reads the
+// semaphore.
+func addMember(sem *Semaphore, h string) {
+	if sem.Members == nil {
+		sem.Members = make(map[string]*Member)
+	}
+	sem.Members[h] = &Member{LastHeartbeat: now().Unix(), ExpireTime: now().Add(memberExpiry).Unix()}
+}
+
+func TestMaxPercent(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	sem := newSemaphore()
+	for i, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"} {
+		addMember(sem, id)
+		if i == 0 {
+			// a stops heartbeating
+			clock = clock.Add(memberTimeout + time.Second)
+		}
+	}
+
+	if err := sem.SetMaxPercent(0); err == nil {
+		t.Error("0% should be refused")
+	}
+	if err := sem.SetMaxPercent(101); err == nil {
+		t.Error("101% should be refused")
+	}
+
+	// 20% of the 10 live members
+	if err := sem.SetMaxPercent(20); err != nil {
+		t.Fatal(err)
+	}
+	if sem.Max != 2 || sem.Semaphore != 2 {
+		t.Fatalf("unexpected maximum: max %d, available %d", sem.Max, sem.Semaphore)
+	}
+	for _, h := range []string{"b", "c"} {
+		if err := sem.Lock(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sem.Lock("d"); err == nil {
+		t.Error("d should not get the semaphore beyond 20%")
+	}
+
+	// as members go away, the maximum shrinks, but never below 1.
+	clock = clock.Add(memberTimeout + time.Second)
+	if got := sem.EffectiveMax(clock); got != 1 {
+		t.Errorf("effective maximum without live members: got %d want 1", got)
+	}
+	if err := sem.Unlock("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sem.Lock("d"); err == nil {
+		t.Error("d should not get the semaphore while c holds the only slot")
+	}
+	if sem.Max != 1 || sem.Semaphore != 0 {
+		t.Errorf("maximum was not updated on lock: max %d, available %d", sem.Max, sem.Semaphore)
+	}
+
+	// setting an absolute maximum drops the percentage.
+	if err := sem.SetMax(3); err != nil {
+		t.Fatal(err)
+	}
+	if sem.MaxPercent != 0 || sem.EffectiveMax(clock) != 3 {
+		t.Errorf("absolute maximum did not replace the percentage: %d%%, max %d", sem.MaxPercent, sem.EffectiveMax(clock))
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// releaseTimeout bounds how long MultiLock tries to release the slots it
+// took when it cannot take all of them. Releasing is not bound to the context
+// of the acquisition, as that context being done is a common reason for the
+// acquisition to fail.
+const releaseTimeout = 30 * time.Second
+
+// rollbackReason is recorded with the unlock of a slot MultiLock gives back
+// because it could not take all of them.
+const rollbackReason = "rolled back, not every group could be locked"
+
+// PartialUnlockError is returned by MultiLock.ForceUnlock if the holder was
+// only removed from some of the semaphores.
+type PartialUnlockError struct {
+	// Unlocked are the indexes of the clients of the semaphores the holder
+	// was removed from.
+	Unlocked []int
+	// Err is the error releasing the next semaphore failed with.
+	Err error
+}
+
+func (e *PartialUnlockError) Error() string {
+	return fmt.Sprintf("unlocked only %d of the semaphores: %v", len(e.Unlocked), e.Err)
+}
+
+// MultiLock takes a slot in the semaphores of several groups at once, e.g.
+// of a rack, a zone and the whole cluster. A slot is held either in all of
+// the semaphores or in none of them.
+//
+// The semaphores are always taken in the order the clients were given in, so
+// all machines sharing groups should list them in the same order. Acquire
+// joins the queue of a semaphore only once it is first in line for all of the
+// semaphores before it, so that machines waiting for several groups cannot
+// block each other, and takes the slots only once it is first in line
+// everywhere.
+type MultiLock struct {
+	locks []*Lock
+}
+
+// NewMulti returns a new MultiLock for the given id, holding a slot in the
+// semaphore of every client.
+func NewMulti(id string, clients ...LockClient) *MultiLock {
+	m := &MultiLock{}
+	for _, c := range clients {
+		m.locks = append(m.locks, New(id, c))
+	}
+
+	return m
+}
+
+// SetTTL sets the lease duration of every semaphore, see Lock.SetTTL.
+func (m *MultiLock) SetTTL(ttl time.Duration) {
+	for _, l := range m.locks {
+		l.SetTTL(ttl)
+	}
+}
+
+// SetInfo sets the holder metadata of every semaphore, see Lock.SetInfo.
+func (m *MultiLock) SetInfo(info Holder) {
+	for _, l := range m.locks {
+		l.SetInfo(info)
+	}
+}
+
+// SetCondition sets the condition for taking every semaphore, see
+// Lock.SetCondition.
+func (m *MultiLock) SetCondition(cond Condition) {
+	for _, l := range m.locks {
+		l.SetCondition(cond)
+	}
+}
+
+// SetActor sets who is recorded in the history of every semaphore, see
+// Lock.SetActor.
+func (m *MultiLock) SetActor(actor string) {
+	for _, l := range m.locks {
+		l.SetActor(actor)
+	}
+}
+
+// Lock takes a slot in every semaphore and returns the fencing tokens of the
+// acquisitions, in the order of the clients. If any of the semaphores cannot
+// be taken, the slots taken so far are released again and the error is
+// returned. Semaphores this id already holds count as taken, and are left
+// alone when releasing.
+func (m *MultiLock) Lock(ctx context.Context) ([]uint64, error) {
+	tokens, _, _, err := m.lockAll(ctx, false)
+	return tokens, err
+}
+
+// lockAll takes a slot in every semaphore, like Lock. If a semaphore refuses
+// the slot, its index and the semaphore as it was read are returned along
+// with the error. With requeue, this id is put back at the front of the
+// queues of the slots it gives back, see release.
+func (m *MultiLock) lockAll(ctx context.Context, requeue bool) (tokens []uint64, failed int, refused *Semaphore, err error) {
+	var taken []*Lock
+	for i, l := range m.locks {
+		token, sem, err := l.lockOnce(ctx)
+		switch err {
+		case nil:
+			taken = append(taken, l)
+		case ErrExist:
+		default:
+			if rerr := release(taken, requeue); rerr != nil {
+				err = fmt.Errorf("%v, releasing the semaphores taken so far failed: %v", err, rerr)
+			}
+			return nil, i, sem, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, 0, nil, nil
+}
+
+// release rolls back locks in reverse order, returning the first error. With
+// requeue, the lock ids are put back at the front of the queues, as they
+// were first in line for the slots they give back.
+func release(locks []*Lock, requeue bool) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+
+	for i := len(locks) - 1; i >= 0; i-- {
+		if uerr := locks[i].rollback(ctx, requeue); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+
+	return err
+}
+
+// rollback releases the slot this lock id took as part of an acquisition
+// which failed as a whole, putting it back at the front of the queue with
+// requeue. As the machine never got to reboot, the rate limit token it used
+// up is refunded. The unlock is recorded with rollbackReason, so that the
+// lock recorded before has a matching unlock in the history.
+func (l *Lock) rollback(ctx context.Context, requeue bool) error {
+	return l.store(ctx, func(sem *Semaphore) error {
+		if err := sem.Unlock(l.id); err != nil {
+			return err
+		}
+		if sem.Rate != nil {
+			sem.Rate.refund(now())
+		}
+		if requeue {
+			sem.requeue(l.id, waiterTTL)
+		}
+		l.record(sem, EventUnlock, l.id).Reason = rollbackReason
+		return nil
+	})
+}
+
+// queue joins the queue of the semaphore, or refreshes the place of this lock
+// id in it, and reports whether the lock id may take the semaphore right
+// away: because it holds it already, or because it is first in line for a
+// free slot. While the condition of the lock is not met, the lock id leaves
+// the queue instead. The semaphore is only stored if the queue changed, and
+// returned as it was last read.
+func (l *Lock) queue(ctx context.Context) (ready bool, sem *Semaphore, err error) {
+	for attempt := 0; attempt < maxStoreAttempts; attempt++ {
+		sem, err := l.get(ctx)
+		if err != nil {
+			return false, nil, err
+		}
+		if sem.hasHolder(l.id) {
+			return true, sem, nil
+		}
+
+		err = l.admit(ctx, sem)
+		var changed bool
+		if _, ok := err.(conditionError); ok {
+			changed = sem.Dequeue(l.id) == nil
+		} else {
+			changed = l.enqueue(sem)
+		}
+		if !changed {
+			return err == nil, sem, nil
+		}
+
+		// whether the semaphore can be taken is decided once the queue
+		// is stored and read again.
+		if err := l.client.SetContext(ctx, sem); err != nil && err != ErrCompareFailed {
+			return false, nil, err
+		}
+	}
+
+	return false, nil, &ConflictError{Attempts: maxStoreAttempts}
+}
+
+// leave removes this lock id from the queue of the semaphore, if it is
+// waiting.
+func (l *Lock) leave(ctx context.Context) error {
+	err := l.store(ctx, func(sem *Semaphore) error {
+		return sem.Dequeue(l.id)
+	})
+	if err == ErrNotExist {
+		return nil
+	}
+
+	return err
+}
+
+// Acquire takes a slot in every semaphore like Lock, blocking until it
+// succeeds or the context is done. It waits in the queues of the semaphores
+// in order: this id only joins the queue of a semaphore once it is first in
+// line for the ones before it, and leaves the queues after a semaphore it has
+// to wait for. The slots are only taken once this id is first in line for all
+// of them, so no slot is held while waiting. Like Lock.Acquire, the places in
+// the queues are kept if the context is done. With a single semaphore,
+// Acquire is Lock.Acquire. Errors getting or setting the semaphores are
+// passed through.
+func (m *MultiLock) Acquire(ctx context.Context) ([]uint64, error) {
+	if len(m.locks) == 1 {
+		token, err := m.locks[0].Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []uint64{token}, nil
+	}
+
+	for {
+		i, sem, err := m.queue(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if sem == nil {
+			tokens, failed, refused, err := m.lockAll(ctx, true)
+			if err == nil {
+				return tokens, nil
+			}
+			if refused == nil {
+				return nil, err
+			}
+			// the semaphore changed since this id was first in line.
+			i, sem = failed, refused
+		}
+
+		if err := m.locks[i].wait(ctx, sem.Index, waitTime(sem)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// queue waits in the queues of the semaphores in order, see Lock.queue,
+// until one of them cannot be taken right away. That semaphore is returned as
+// it was read, along with its index, and this id leaves the queues of the
+// semaphores after it. The semaphore is nil if all of them can be taken.
+func (m *MultiLock) queue(ctx context.Context) (int, *Semaphore, error) {
+	for i, l := range m.locks {
+		ready, sem, err := l.queue(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		if ready {
+			continue
+		}
+
+		for _, later := range m.locks[i+1:] {
+			if err := later.leave(ctx); err != nil {
+				return 0, nil, err
+			}
+		}
+		return i, sem, nil
+	}
+
+	return 0, nil, nil
+}
+
+// Held reports whether this id holds a slot in any of the semaphores. Errors
+// getting the semaphores are passed through.
+func (m *MultiLock) Held(ctx context.Context) (bool, error) {
+	for _, l := range m.locks {
+		sem, err := l.GetContext(ctx)
+		if err != nil {
+			return false, err
+		}
+		if sem.hasHolder(l.id) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// HolderInfo returns the information recorded with this id in the first of
+// the semaphores it holds, or nil if it holds none of them. Errors getting the
+// semaphores are passed through.
+func (m *MultiLock) HolderInfo(ctx context.Context) (*Holder, error) {
+	for _, l := range m.locks {
+		sem, err := l.GetContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !sem.hasHolder(l.id) {
+			continue
+		}
+
+		if info, ok := sem.HolderInfo[l.id]; ok {
+			return info, nil
+		}
+		return &Holder{}, nil
+	}
+
+	return nil, nil
+}
+
+// Renew extends the lease of every semaphore, see Lock.Renew. All semaphores
+// are renewed even if renewing one of them fails; the first error is
+// returned.
+func (m *MultiLock) Renew(ctx context.Context) (err error) {
+	for _, l := range m.locks {
+		if rerr := l.Renew(ctx); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	return err
+}
+
+// Unlock releases the slot of every semaphore this id holds. It returns
+// ErrNotExist if none of them were held. All semaphores are released even if
+// releasing one of them fails; the first error is returned.
+func (m *MultiLock) Unlock(ctx context.Context) error {
+	return m.eachHeld(func(l *Lock) error {
+		return l.UnlockContext(ctx)
+	})
+}
+
+// ForceUnlock releases the slot of every semaphore this id holds like Unlock,
+// recording forced unlocks, see Lock.ForceUnlock. If staleAfter is not zero,
+// the holder must be stale in every semaphore it holds: otherwise none of
+// them is changed, and a *NotStaleError is returned with the latest time it
+// was seen. The semaphores are released in order, stopping at the first
+// error. If the holder was removed from some of them by then, e.g. because it
+// showed signs of life in the meantime, a *PartialUnlockError is returned.
+func (m *MultiLock) ForceUnlock(ctx context.Context, reason string, staleAfter time.Duration) error {
+	if staleAfter != 0 {
+		if err := m.checkStale(ctx, staleAfter); err != nil {
+			return err
+		}
+	}
+
+	var unlocked []int
+	for i, l := range m.locks {
+		err := l.ForceUnlock(ctx, reason, staleAfter)
+		switch {
+		case err == nil:
+			unlocked = append(unlocked, i)
+		case err == ErrNotExist:
+		case len(unlocked) > 0:
+			return &PartialUnlockError{Unlocked: unlocked, Err: err}
+		default:
+			return err
+		}
+	}
+
+	if len(unlocked) == 0 {
+		return ErrNotExist
+	}
+
+	return nil
+}
+
+// checkStale returns a *NotStaleError if this id holds any of the semaphores
+// without being stale in it, see Semaphore.Stale, with the latest time it was
+// seen in any of them. Errors getting the semaphores are passed through.
+func (m *MultiLock) checkStale(ctx context.Context, staleAfter time.Duration) error {
+	var (
+		fresh bool
+		last  time.Time
+	)
+	t := now()
+	for _, l := range m.locks {
+		sem, err := l.GetContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !sem.hasHolder(l.id) || sem.Stale(l.id, t, staleAfter) {
+			continue
+		}
+
+		fresh = true
+		if seen := sem.LastSeen(l.id); seen.After(last) {
+			last = seen
+		}
+	}
+
+	if fresh {
+		return &NotStaleError{LastSeen: last}
+	}
+
+	return nil
+}
+
+// SetUnlockTime records the time at which this id is going to release every
+// semaphore it holds, see Lock.SetUnlockTime. It returns ErrNotExist if none
+// of them were held.
+func (m *MultiLock) SetUnlockTime(ctx context.Context, t time.Time) error {
+	return m.eachHeld(func(l *Lock) error {
+		return l.SetUnlockTime(ctx, t)
+	})
+}
+
+// SetGated records whether this id keeps every semaphore it holds because its
+// health checks did not pass, see Lock.SetGated. It returns ErrNotExist if
+// none of them were held.
+func (m *MultiLock) SetGated(ctx context.Context, gated bool) error {
+	return m.eachHeld(func(l *Lock) error {
+		return l.SetGated(ctx, gated)
+	})
+}
+
+// eachHeld calls f with the lock of every semaphore, where f returns
+// ErrNotExist for semaphores this id does not hold. It returns ErrNotExist if
+// none of them were held, or the first other error.
+func (m *MultiLock) eachHeld(f func(*Lock) error) error {
+	held := false
+	var err error
+	for _, l := range m.locks {
+		uerr := f(l)
+		switch {
+		case uerr == nil:
+			held = true
+		case uerr != ErrNotExist && err == nil:
+			err = uerr
+		}
+	}
+
+	if err == nil && !held {
+		return ErrNotExist
+	}
+
+	return err
+}
@@ -0,0 +1,343 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestMultiLock(t *testing.T) {
+	rack, global := newWatchLockClient(), newWatchLockClient()
+	global.sem.Max, global.sem.Semaphore = 2, 2
+
+	am := NewMulti("a", rack, global)
+	tokens, err := am.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0] == 0 || tokens[1] == 0 {
+		t.Errorf("unexpected tokens: %v", tokens)
+	}
+
+	// b shares the global group but not the rack, c shares both.
+	bm := NewMulti("b", newWatchLockClient(), global)
+	if _, err := bm.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := NewMulti("c", global, rack)
+	if _, err := cm.Lock(context.Background()); err == nil {
+		t.Fatal("c should not get the lock while the global group is full")
+	}
+
+	if err := bm.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm.Lock(context.Background()); err == nil {
+		t.Fatal("c should not get the lock while a holds the rack")
+	}
+
+	// c took the global slot before the rack refused it, and must have
+	// released it again.
+	sem, _ := global.Get()
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) {
+		t.Errorf("unexpected global holders: %v", sem.Holders)
+	}
+
+	if err := am.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.Unlock(context.Background()); err != ErrNotExist {
+		t.Errorf("unlocking twice should return ErrNotExist, got %v", err)
+	}
+
+	if _, err := cm.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []*watchLockClient{rack, global} {
+		sem, _ := c.Get()
+		if !reflect.DeepEqual(sem.Holders, []string{"c"}) {
+			t.Errorf("case %d: unexpected holders: %v", i, sem.Holders)
+		}
+	}
+}
+
+func TestMultiLockRollback(t *testing.T) {
+	rack, global := newWatchLockClient(), newWatchLockClient()
+	if err := global.sem.SetRate(1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := New("x", rack).Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a takes the global slot before the rack refuses it.
+	if _, err := NewMulti("a", global, rack).Lock(context.Background()); err == nil {
+		t.Fatal("a should not get the lock while the rack is full")
+	}
+
+	sem, _ := global.Get()
+	if len(sem.Holders) != 0 {
+		t.Errorf("global slot was not released: %v", sem.Holders)
+	}
+	if tokens := sem.Rate.Available(time.Now()); tokens < 1 {
+		t.Errorf("rate limit token was not refunded: %v tokens", tokens)
+	}
+	var types []string
+	for _, e := range sem.History {
+		types = append(types, e.Type)
+	}
+	if !reflect.DeepEqual(types, []string{EventLock, EventUnlock}) {
+		t.Errorf("unexpected history: %v", types)
+	} else if e := sem.History[1]; e.Machine != "a" || e.Reason != rollbackReason {
+		t.Errorf("rollback was not recorded as an unlock of a: %#v", e)
+	}
+
+	// the refunded token admits the next machine.
+	if err := New("b", global).Lock(); err != nil {
+		t.Errorf("b should get the lock after a rolled back: %v", err)
+	}
+}
+
+func TestMultiLockAcquire(t *testing.T) {
+	rack, global := newWatchLockClient(), newWatchLockClient()
+
+	bl := New("b", global)
+	if err := bl.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	am := NewMulti("a", rack, global)
+	done := make(chan error, 1)
+	go func() {
+		_, err := am.Acquire(context.Background())
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("a acquired the lock while b held the global group: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a must not hold the rack while it waits for the global group.
+	sem, _ := rack.Get()
+	if len(sem.Holders) != 0 {
+		t.Errorf("rack is held while waiting: %v", sem.Holders)
+	}
+
+	if err := bl.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(minAcquireWait / 2):
+		t.Fatal("a did not acquire the lock after b released it")
+	}
+
+	// both groups are full now, which must not keep a from acquiring the
+	// slots it holds.
+	ctx, cancel := context.WithTimeout(context.Background(), minAcquireWait/2)
+	defer cancel()
+	if _, err := am.Acquire(ctx); err != nil {
+		t.Errorf("acquiring a held lock should succeed: %v", err)
+	}
+}
+
+func TestMultiLockAcquireQueue(t *testing.T) {
+	rack, global := newWatchLockClient(), newWatchLockClient()
+
+	xl := New("x", global)
+	if err := xl.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	am := NewMulti("a", rack, global)
+	done := make(chan error, 1)
+	go func() {
+		_, err := am.Acquire(context.Background())
+		done <- err
+	}()
+	waitQueued(t, global, "a")
+
+	// single-group machines keep arriving while a waits, and must queue
+	// up behind it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, id := range []string{"b", "c"} {
+		go New(id, global).Acquire(ctx)
+		waitQueued(t, global, id)
+	}
+
+	if err := xl.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(minAcquireWait / 2):
+		t.Fatal("a did not get its turn after x released the lock")
+	}
+
+	for i, c := range []*watchLockClient{rack, global} {
+		sem, _ := c.Get()
+		if !reflect.DeepEqual(sem.Holders, []string{"a"}) {
+			t.Errorf("case %d: unexpected holders: %v", i, sem.Holders)
+		}
+		if sem.Position("a") >= 0 {
+			t.Errorf("case %d: a is still waiting", i)
+		}
+	}
+}
+
+// waitQueued waits for id to join the queue of the semaphore of c.
+func waitQueued(t *testing.T, c *watchLockClient, id string) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if sem, _ := c.Get(); sem.Position(id) >= 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s did not join the queue", id)
+}
+
+func TestMultiLockForceUnlock(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	rack, global := newWatchLockClient(), newWatchLockClient()
+	am := NewMulti("a", rack, global)
+	if _, err := am.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a only renewed its lease in the global group.
+	clock = clock.Add(50 * time.Minute)
+	if err := New("a", global).Renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(20 * time.Minute)
+
+	err := am.ForceUnlock(context.Background(), "", time.Hour)
+	if nerr, ok := err.(*NotStaleError); !ok || nerr.LastSeen.Unix() != 103000 {
+		t.Fatalf("a should not be stale, got %v", err)
+	}
+	for i, c := range []*watchLockClient{rack, global} {
+		sem, _ := c.Get()
+		if !reflect.DeepEqual(sem.Holders, []string{"a"}) {
+			t.Errorf("case %d: a was unlocked although it is not stale: %v", i, sem.Holders)
+		}
+	}
+
+	clock = clock.Add(time.Hour)
+	if err := am.ForceUnlock(context.Background(), "gone", time.Hour); err != nil {
+		t.Fatalf("a should be stale in every group: %v", err)
+	}
+	for i, c := range []*watchLockClient{rack, global} {
+		sem, _ := c.Get()
+		if len(sem.Holders) != 0 {
+			t.Errorf("case %d: a was not unlocked: %v", i, sem.Holders)
+		}
+	}
+	if err := am.ForceUnlock(context.Background(), "", 0); err != ErrNotExist {
+		t.Errorf("unlocking twice should return ErrNotExist, got %v", err)
+	}
+
+	// releasing the global group fails after the rack was released.
+	broken := &failSetClient{newWatchLockClient()}
+	if err := New("b", rack).Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := New("b", broken.watchLockClient).Lock(); err != nil {
+		t.Fatal(err)
+	}
+	err = NewMulti("b", rack, broken).ForceUnlock(context.Background(), "", 0)
+	if perr, ok := err.(*PartialUnlockError); !ok || !reflect.DeepEqual(perr.Unlocked, []int{0}) {
+		t.Errorf("expected a PartialUnlockError for the rack, got %v", err)
+	}
+}
+
+// failSetClient is a watchLockClient which cannot be written to.
+type failSetClient struct {
+	*watchLockClient
+}
+
+func (c *failSetClient) Set(sem *Semaphore) error {
+	return errors.New("semaphore is read-only")
+}
+
+func TestMultiLockHeld(t *testing.T) {
+	rack, global := newWatchLockClient(), newWatchLockClient()
+	if err := New("a", rack).Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := time.Unix(100600, 0)
+	if err := NewMulti("a", rack, global).SetUnlockTime(context.Background(), unlock); err != nil {
+		t.Fatal(err)
+	}
+	sem, _ := rack.Get()
+	if got := sem.HolderInfo["a"].UnlockTime; got != unlock.Unix() {
+		t.Errorf("unexpected unlock time: got %v want %v", got, unlock.Unix())
+	}
+
+	if err := NewMulti("a", rack, global).SetGated(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	info, err := NewMulti("a", global, rack).HolderInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || !info.Gated || info.UnlockTime != unlock.Unix() {
+		t.Errorf("unexpected holder info: %#v", info)
+	}
+	if info, err := NewMulti("b", rack, global).HolderInfo(context.Background()); err != nil || info != nil {
+		t.Errorf("b holds no lock, got %#v, %v", info, err)
+	}
+
+	if err := NewMulti("b", rack, global).SetUnlockTime(context.Background(), unlock); err != ErrNotExist {
+		t.Errorf("setting the unlock time of a non-holder should return ErrNotExist, got %v", err)
+	}
+
+	for i, tt := range []struct {
+		id   string
+		held bool
+	}{
+		{"a", true},
+		{"b", false},
+	} {
+		held, err := NewMulti(tt.id, global, rack).Held(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if held != tt.held {
+			t.Errorf("case %d: got held %v want %v", i, held, tt.held)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RateLimitedError is the error returned if a holder cannot take the
+// semaphore because the rate limit of the semaphore has been reached.
+type RateLimitedError struct {
+	Rate Rate
+	// Next is the time at which the semaphore may be taken again.
+	Next time.Time
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("reboot rate limit of %s reached, next reboot allowed at %s", e.Rate.String(), e.Next.UTC().Format(time.RFC3339))
+}
+
+// Rate limits how many holders may take the semaphore over time. It is a
+// token bucket holding up to Reboots tokens, refilled at Reboots tokens per
+// Interval. Taking the semaphore uses up a token.
+type Rate struct {
+	// Reboots is the number of holders which may take the semaphore per
+	// Interval.
+	Reboots int `json:"reboots"`
+	// Interval is the length of the interval in seconds.
+	Interval int64 `json:"interval"`
+	// Tokens is the number of tokens left in the bucket as of UpdateTime.
+	Tokens float64 `json:"tokens"`
+	// UpdateTime is the unix time at which Tokens was last updated.
+	UpdateTime int64 `json:"updateTime"`
+}
+
+// String describes the rate, e.g. "6 per 1h0m0s".
+func (r *Rate) String() string {
+	return fmt.Sprintf("%d per %s", r.Reboots, time.Duration(r.Interval)*time.Second)
+}
+
+// Available returns the number of tokens in the bucket at time t, including
+// a fraction of the next token.
+func (r *Rate) Available(t time.Time) float64 {
+	elapsed := t.Unix() - r.UpdateTime
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	tokens := r.Tokens + float64(elapsed)*float64(r.Reboots)/float64(r.Interval)
+	return math.Min(tokens, float64(r.Reboots))
+}
+
+// Next returns the earliest time at or after t at which a token is
+// available.
+func (r *Rate) Next(t time.Time) time.Time {
+	missing := 1 - r.Available(t)
+	if missing <= 0 {
+		return t
+	}
+
+	secs := math.Ceil(missing * float64(r.Interval) / float64(r.Reboots))
+	return time.Unix(t.Unix()+int64(secs), 0)
+}
+
+// take uses up a token at time t. It reports false, leaving the bucket
+// untouched, if no token is available.
+func (r *Rate) take(t time.Time) bool {
+	tokens := r.Available(t)
+	if tokens < 1 {
+		return false
+	}
+
+	r.Tokens = tokens - 1
+	r.UpdateTime = t.Unix()
+	return true
+}
+
+// refund returns a token used up before time t to the bucket, up to its
+// capacity.
+func (r *Rate) refund(t time.Time) {
+	r.Tokens = math.Min(r.Available(t)+1, float64(r.Reboots))
+	r.UpdateTime = t.Unix()
+}
+
+// SetRate limits the semaphore to be taken at most reboots times per
+// interval, spread over time: once the limit is used up, a new holder is
+// admitted every interval/reboots. A reboots of zero removes the limit.
+// Tokens left from a previous limit are kept, up to the new limit; a new
+// limit starts out with all of its tokens.
+func (s *Semaphore) SetRate(reboots int, interval time.Duration) error {
+	if reboots < 0 {
+		return fmt.Errorf("invalid number of reboots %v", reboots)
+	}
+	if reboots == 0 {
+		s.Rate = nil
+		return nil
+	}
+	if interval < time.Second {
+		return fmt.Errorf("invalid rate interval %v", interval)
+	}
+
+	t := now()
+	tokens := float64(reboots)
+	if s.Rate != nil {
+		tokens = math.Min(s.Rate.Available(t), tokens)
+	}
+
+	s.Rate = &Rate{
+		Reboots:    reboots,
+		Interval:   int64(interval / time.Second),
+		Tokens:     tokens,
+		UpdateTime: t.Unix(),
+	}
+	return nil
+}
+
+// SetRate limits the number of holders which may take the semaphore per
+// interval, see Semaphore.SetRate. It returns the current semaphore and the
+// previous rate limit, nil if there was none.
+// if there is a problem getting or setting the semaphore, this function will
+// pass on errors from the underlying client
+func (l *Lock) SetRate(ctx context.Context, reboots int, interval time.Duration) (sem *Semaphore, old *Rate, err error) {
+	var (
+		semRet  *Semaphore
+		oldRate *Rate
+	)
+
+	return semRet, oldRate, l.store(ctx, func(sem *Semaphore) error {
+		oldRate = sem.Rate
+		semRet = sem
+		if err := sem.SetRate(reboots, interval); err != nil {
+			return err
+		}
+		l.record(sem, EventSetRate, "")
+		return nil
+	})
+}
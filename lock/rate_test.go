@@ -0,0 +1,131 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRate(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	s := &Semaphore{Semaphore: 10, Max: 10}
+	if err := s.SetRate(2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bucket starts out full, then admits one holder per 30 minutes.
+	for i, tt := range []struct {
+		after  time.Duration
+		holder string
+		next   int64
+	}{
+		{0, "a", 0},
+		{0, "b", 0},
+		{0, "c", 101800},
+		{29 * time.Minute, "c", 101800},
+		{30 * time.Minute, "c", 0},
+		{31 * time.Minute, "d", 103600},
+	} {
+		clock = time.Unix(100000, 0).Add(tt.after)
+		err := s.Lock(tt.holder)
+		if tt.next == 0 {
+			if err != nil {
+				t.Errorf("case %d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+
+		rerr, ok := err.(*RateLimitedError)
+		if !ok {
+			t.Errorf("case %d: expected *RateLimitedError, got %v", i, err)
+			continue
+		}
+		if rerr.Next.Unix() != tt.next {
+			t.Errorf("case %d: got next %v want %v", i, rerr.Next.Unix(), tt.next)
+		}
+		if next, ok := s.nextExpiry(); !ok || next.Unix() != tt.next {
+			t.Errorf("case %d: waiters should wake up at %v, got %v", i, tt.next, next.Unix())
+		}
+	}
+
+	// holders unlocking do not give tokens back.
+	for _, h := range []string{"a", "b", "c"} {
+		if err := s.Unlock(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.Rate.Available(clock); got >= 1 {
+		t.Errorf("unlocking refilled the bucket: %v", got)
+	}
+
+	// a new limit keeps the tokens left, up to the new limit.
+	clock = time.Unix(100000, 0).Add(5 * time.Hour)
+	if err := s.SetRate(1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Rate.Available(clock); got != 1 {
+		t.Errorf("unexpected tokens after changing the rate: %v", got)
+	}
+
+	for i, tt := range []struct {
+		reboots  int
+		interval time.Duration
+	}{
+		{-1, time.Hour},
+		{1, 0},
+		{1, time.Millisecond},
+	} {
+		if err := s.SetRate(tt.reboots, tt.interval); err == nil {
+			t.Errorf("case %d: expected error", i)
+		}
+	}
+
+	if err := s.SetRate(0, 0); err != nil || s.Rate != nil {
+		t.Errorf("rate limit was not removed: %v %v", s.Rate, err)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	c := newWatchLockClient()
+	l := New("a", c)
+	l.SetActor("core@admin")
+
+	sem, old, err := l.SetRate(context.Background(), 6, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != nil || sem.Rate == nil || sem.Rate.String() != "6 per 1h0m0s" {
+		t.Fatalf("unexpected rate: old %v new %v", old, sem.Rate)
+	}
+
+	_, old, err = l.SetRate(context.Background(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old == nil || old.Reboots != 6 {
+		t.Errorf("unexpected old rate: %v", old)
+	}
+
+	sem, _ = c.Get()
+	if len(sem.History) != 2 || sem.History[0].Type != EventSetRate || sem.History[0].Actor != "core@admin" {
+		t.Errorf("unexpected history: %v", sem.History)
+	}
+}
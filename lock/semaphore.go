@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 )
 
 var (
@@ -28,24 +29,210 @@ var (
 	// ErrNotExist is the error returned if there is no holder with the
 	// specified id holding the semaphore
 	ErrNotExist = errors.New("holder does not exist")
+	// ErrNotFirst is the error returned if a holder cannot take the
+	// semaphore because other machines are waiting ahead of it
+	ErrNotFirst = errors.New("other machines are waiting ahead in the queue")
+	// ErrNotPaused is the error returned if the semaphore is resumed while
+	// it is not paused
+	ErrNotPaused = errors.New("semaphore is not paused")
 )
 
+// PausedError is the error returned if a holder cannot take the semaphore
+// because it is paused.
+type PausedError struct {
+	Pause Pause
+}
+
+func (e *PausedError) Error() string {
+	msg := "reboots are paused"
+	if e.Pause.Until != 0 {
+		msg += " until " + time.Unix(e.Pause.Until, 0).UTC().Format(time.RFC3339)
+	}
+	if e.Pause.Reason != "" {
+		msg += ": " + e.Pause.Reason
+	}
+	return msg
+}
+
+// now returns the current time. It is a variable so tests can control the
+// clock used for holder leases.
+var now = time.Now
+
 // Semaphore is a struct representation of the information held by the semaphore
 type Semaphore struct {
 	Index     uint64   `json:"-"`
 	Semaphore int      `json:"semaphore"`
 	Max       int      `json:"max"`
 	Holders   []string `json:"holders"`
+	// MaxPercent, if not zero, sets Max to this percentage of the live
+	// members of the group, at least 1, whenever the semaphore is taken.
+	// Max then is the effective maximum as of the latest acquisition.
+	MaxPercent int `json:"maxPercent,omitempty"`
+	// HolderInfo carries per-holder lease information and metadata, keyed by
+	// holder id. It is kept separate from Holders so that older clients, which only
+	// know about the list of ids, can still read and write the semaphore.
+	HolderInfo map[string]*Holder `json:"holderInfo,omitempty"`
+	// Waiters is the queue of machines waiting to take the semaphore, in
+	// the order in which they will be granted it.
+	Waiters []*Waiter `json:"waiters,omitempty"`
+	// Rate, if set, limits how many holders may take the semaphore over
+	// time, regardless of how many slots are free.
+	Rate *Rate `json:"rate,omitempty"`
+	// Paused is set while no new holders may take the semaphore, regardless
+	// of how many slots are free.
+	Paused *Pause `json:"paused,omitempty"`
+	// History lists the most recent changes of the semaphore, oldest
+	// first. It is bounded, see maxHistory.
+	History []*Event `json:"history,omitempty"`
+	// Members are the machines registered in the group of the semaphore,
+	// keyed by machine id, see Lock.Heartbeat. They are stored apart from
+	// the semaphore by the MemberRegistry of the client, and filled in by
+	// Lock when it reads the semaphore.
+	Members map[string]*Member `json:"-"`
+}
+
+// Pause describes a pause of the semaphore.
+type Pause struct {
+	// Reason describes why the semaphore was paused.
+	Reason string `json:"reason,omitempty"`
+	// StartTime is the unix time at which the semaphore was paused.
+	StartTime int64 `json:"startTime"`
+	// Until is the unix time at which the pause ends by itself. Zero means
+	// the pause lasts until the semaphore is resumed.
+	Until int64 `json:"until,omitempty"`
+}
+
+// Active reports whether the pause is still in effect at time t.
+func (p *Pause) Active(t time.Time) bool {
+	return p.Until == 0 || t.Unix() < p.Until
+}
+
+// Holder describes a single holder of the semaphore.
+type Holder struct {
+	// StartTime is the unix time at which the holder acquired the semaphore.
+	StartTime int64 `json:"startTime"`
+	// ExpireTime is the unix time after which the holder's lease is
+	// considered expired. Zero means the lease never expires.
+	ExpireTime int64 `json:"expireTime,omitempty"`
+	// Token is the fencing token handed out when the holder acquired the
+	// semaphore. Zero means no token was recorded.
+	Token uint64 `json:"token,omitempty"`
+	// RenewTime is the unix time at which the holder last renewed its
+	// lease.
+	RenewTime int64 `json:"renewTime,omitempty"`
+	// UnlockTime is the unix time at which the holder is going to release
+	// the semaphore, once it has been up for a while after its reboot.
+	// Zero means the holder has not rebooted yet.
+	UnlockTime int64 `json:"unlockTime,omitempty"`
+	// Gated is set while the holder keeps the semaphore after its reboot
+	// because its health checks did not pass. It neither releases the
+	// semaphore nor reboots until the semaphore is released by hand.
+	Gated bool `json:"gated,omitempty"`
+
+	// Hostname is the hostname of the holder.
+	Hostname string `json:"hostname,omitempty"`
+	// Reason describes why the holder took the semaphore.
+	Reason string `json:"reason,omitempty"`
+	// Version is the OS version the holder is updating to.
+	Version string `json:"version,omitempty"`
+	// Strategy is the reboot strategy that took the semaphore.
+	Strategy string `json:"strategy,omitempty"`
+	// EtcdMember is the id of the etcd member the holder runs, if any.
+	EtcdMember string `json:"etcdMember,omitempty"`
+}
+
+// Waiter describes a machine waiting in the queue of the semaphore.
+type Waiter struct {
+	// ID is the id the machine will hold the semaphore with.
+	ID string `json:"id"`
+	// EnqueueTime is the unix time at which the machine joined the queue.
+	EnqueueTime int64 `json:"enqueueTime"`
+	// ExpireTime is the unix time after which the machine is no longer
+	// considered to be waiting, unless it refreshes its place in the queue.
+	ExpireTime int64 `json:"expireTime"`
+}
+
+// Expired reports whether the waiter's place in the queue has expired at
+// time t.
+func (w *Waiter) Expired(t time.Time) bool {
+	return t.Unix() > w.ExpireTime
+}
+
+// HeldFor returns how long the holder has held the semaphore at time t, or
+// zero if the start time is unknown.
+func (h *Holder) HeldFor(t time.Time) time.Duration {
+	if h.StartTime == 0 {
+		return 0
+	}
+
+	return t.Sub(time.Unix(h.StartTime, 0))
+}
+
+// Expired reports whether the holder's lease has expired at time t.
+func (h *Holder) Expired(t time.Time) bool {
+	return h.ExpireTime != 0 && t.Unix() > h.ExpireTime
 }
 
 // SetMax sets the maximum number of holders of the semaphore
+// Current holders keep the semaphore if the maximum drops below their number;
+// no new holders are admitted until enough of them have unlocked. A maximum
+// relative to the number of members set by SetMaxPercent is replaced.
 func (s *Semaphore) SetMax(max int) error {
+	if max < 0 {
+		return fmt.Errorf("invalid maximum %v", max)
+	}
+
+	s.MaxPercent = 0
+	s.setMax(max)
+	return nil
+}
+
+// SetMaxPercent sets the maximum number of holders of the semaphore to pct
+// percent of the live members of the group, rounded down but at least 1. The
+// maximum follows the number of members as they come and go.
+func (s *Semaphore) SetMaxPercent(pct int) error {
+	if pct < 1 || pct > 100 {
+		return fmt.Errorf("invalid maximum percentage %v", pct)
+	}
+
+	s.MaxPercent = pct
+	s.setMax(s.EffectiveMax(now()))
+	return nil
+}
+
+// EffectiveMax returns the maximum number of holders at time t: Max, or the
+// MaxPercent share of the members alive at time t, at least 1.
+func (s *Semaphore) EffectiveMax(t time.Time) int {
+	if s.MaxPercent == 0 {
+		return s.Max
+	}
+
+	max := s.LiveMembers(t) * s.MaxPercent / 100
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
+
+// LiveMembers returns the number of members of the group which are alive at
+// time t.
+func (s *Semaphore) LiveMembers(t time.Time) int {
+	live := 0
+	for _, m := range s.Members {
+		if m.Alive(t) {
+			live++
+		}
+	}
+	return live
+}
+
+// setMax sets the maximum number of holders, adjusting the number of
+// available slots by the difference.
+func (s *Semaphore) setMax(max int) {
 	diff := s.Max - max
 
 	s.Semaphore = s.Semaphore - diff
 	s.Max = s.Max - diff
-
-	return nil
 }
 
 // String returns a json representation of the semaphore
@@ -56,6 +243,12 @@ func (s *Semaphore) String() string {
 	return string(b)
 }
 
+// hasHolder reports whether id h is in the list of holders in the semaphore.
+func (s *Semaphore) hasHolder(h string) bool {
+	loc := sort.SearchStrings(s.Holders, h)
+	return loc < len(s.Holders) && s.Holders[loc] == h
+}
+
 // addHolder adds a holder with id h to the list of holders in the semaphore
 // it returns ErrExist if the given id is in the list
 func (s *Semaphore) addHolder(h string) error {
@@ -90,19 +283,79 @@ func (s *Semaphore) removeHolder(h string) error {
 // exists, then it subtracts one from the semaphore. If the semaphore is already
 // held by the maximum number of people it returns an error.
 func (s *Semaphore) Lock(h string) error {
-	if s.Semaphore <= 0 {
-		return fmt.Errorf("semaphore is at %v", s.Semaphore)
+	return s.LockWithInfo(h, Holder{})
+}
+
+// LockWithInfo adds a holder with id h to the semaphore like Lock, recording
+// the given holder metadata. The start time of the holder is set to the
+// current time.
+// If machines are waiting in the queue, only the first of them, as many as
+// there are free slots, may take the semaphore; anyone else gets ErrNotFirst.
+// h is removed from the queue once it holds the semaphore. While the semaphore
+// is paused, a *PausedError is returned instead, and a *RateLimitedError if the
+// rate limit of the semaphore has been reached.
+func (s *Semaphore) LockWithInfo(h string, info Holder) error {
+	if err := s.admit(h); err != nil {
+		return err
+	}
+
+	if s.Rate != nil && !s.Rate.take(now()) {
+		return &RateLimitedError{*s.Rate, s.Rate.Next(now())}
 	}
 
 	if err := s.addHolder(h); err != nil {
 		return err
 	}
+	s.Dequeue(h)
+
+	if s.HolderInfo == nil {
+		s.HolderInfo = make(map[string]*Holder)
+	}
+	info.StartTime = now().Unix()
+	info.ExpireTime = 0
+	s.HolderInfo[h] = &info
 
 	s.Semaphore = s.Semaphore - 1
 
 	return nil
 }
 
+// admit checks whether h may take the semaphore right now, returning the
+// error LockWithInfo would return otherwise, but leaves the holders and the
+// rate limit alone.
+func (s *Semaphore) admit(h string) error {
+	if s.Paused != nil && s.Paused.Active(now()) && !s.hasHolder(h) {
+		return &PausedError{*s.Paused}
+	}
+
+	if s.MaxPercent != 0 {
+		s.setMax(s.EffectiveMax(now()))
+	}
+
+	// holders of a full semaphore hold it already.
+	if s.hasHolder(h) {
+		return ErrExist
+	}
+
+	if s.Semaphore <= 0 {
+		return fmt.Errorf("semaphore is at %v", s.Semaphore)
+	}
+
+	ahead := s.Position(h)
+	if ahead < 0 {
+		ahead = len(s.liveWaiters())
+	}
+	if ahead >= s.Semaphore {
+		return ErrNotFirst
+	}
+
+	if s.Rate != nil && s.Rate.Available(now()) < 1 {
+		return &RateLimitedError{*s.Rate, s.Rate.Next(now())}
+	}
+
+	return nil
+}
+
 // Unlock removes a holder with id h from the semaphore
 // It removes the id h from the list of holders, returning ErrNotExist if the id
 // does not exist in the list, then adds one to the semaphore.
@@ -111,16 +364,297 @@ func (s *Semaphore) Unlock(h string) error {
 		return err
 	}
 
+	delete(s.HolderInfo, h)
+
 	s.Semaphore = s.Semaphore + 1
 
 	return nil
 }
 
-func newSemaphore() (sem *Semaphore) {
-	return &Semaphore{0, 1, 1, nil}
+// LastSeen returns the latest time holder h showed signs of life: when it
+// took the semaphore, last renewed its lease, or last heartbeated as a
+// member of the group. It returns the zero time if none of them is known.
+func (s *Semaphore) LastSeen(h string) time.Time {
+	var last int64
+	if info, ok := s.HolderInfo[h]; ok {
+		last = info.StartTime
+		if info.RenewTime > last {
+			last = info.RenewTime
+		}
+	}
+	if m, ok := s.Members[h]; ok && m.LastHeartbeat > last {
+		last = m.LastHeartbeat
+	}
+
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(last, 0)
+}
+
+// Stale reports whether holder h is stale at time t: its lease has expired,
+// or it has not shown signs of life for longer than after, see LastSeen.
+// Holders without any sign of life recorded are stale.
+func (s *Semaphore) Stale(h string, t time.Time, after time.Duration) bool {
+	if info, ok := s.HolderInfo[h]; ok && info.Expired(t) {
+		return true
+	}
+
+	last := s.LastSeen(h)
+	return last.IsZero() || t.Sub(last) > after
 }
 
-type holder struct {
-	ID        string `json:"-"`
-	StartTime int64  `json:"startTime"`
+// Renew extends the lease of the holder with id h so that it expires ttl from
+// now. A ttl of zero makes the lease never expire. It returns ErrNotExist if
+// the id is not a holder of the semaphore.
+func (s *Semaphore) Renew(h string, ttl time.Duration) error {
+	if !s.hasHolder(h) {
+		return ErrNotExist
+	}
+
+	if s.HolderInfo == nil {
+		s.HolderInfo = make(map[string]*Holder)
+	}
+	info, ok := s.HolderInfo[h]
+	if !ok {
+		// the holder was added by a client which did not record any
+		// information about it, so the start time is unknown.
+		info = &Holder{}
+		s.HolderInfo[h] = info
+	}
+
+	t := now()
+	info.RenewTime = t.Unix()
+	info.ExpireTime = 0
+	if ttl > 0 {
+		info.ExpireTime = t.Add(ttl).Unix()
+	}
+
+	return nil
+}
+
+// SetUnlockTime records the time at which holder h is going to release the
+// semaphore, or clears it if t is zero. It returns ErrNotExist if the id is
+// not a holder of the semaphore.
+func (s *Semaphore) SetUnlockTime(h string, t time.Time) error {
+	if !s.hasHolder(h) {
+		return ErrNotExist
+	}
+
+	if s.HolderInfo == nil {
+		s.HolderInfo = make(map[string]*Holder)
+	}
+	info, ok := s.HolderInfo[h]
+	if !ok {
+		info = &Holder{}
+		s.HolderInfo[h] = info
+	}
+
+	info.UnlockTime = 0
+	if !t.IsZero() {
+		info.UnlockTime = t.Unix()
+	}
+	return nil
+}
+
+// SetGated records whether holder h keeps the semaphore because its health
+// checks did not pass, see Holder.Gated. It returns ErrNotExist if the id is
+// not a holder of the semaphore.
+func (s *Semaphore) SetGated(h string, gated bool) error {
+	if !s.hasHolder(h) {
+		return ErrNotExist
+	}
+
+	if s.HolderInfo == nil {
+		s.HolderInfo = make(map[string]*Holder)
+	}
+	info, ok := s.HolderInfo[h]
+	if !ok {
+		info = &Holder{}
+		s.HolderInfo[h] = info
+	}
+
+	info.Gated = gated
+	return nil
+}
+
+// Pause stops new holders from taking the semaphore until it is resumed, or
+// until the given time if it is not zero. Current holders are not affected.
+// Pausing a paused semaphore replaces the pause.
+func (s *Semaphore) Pause(reason string, until time.Time) {
+	p := &Pause{Reason: reason, StartTime: now().Unix()}
+	if !until.IsZero() {
+		p.Until = until.Unix()
+	}
+	s.Paused = p
+}
+
+// Resume ends a pause of the semaphore. It returns ErrNotPaused if the
+// semaphore is not paused.
+func (s *Semaphore) Resume() error {
+	if s.Paused == nil || !s.Paused.Active(now()) {
+		s.Paused = nil
+		return ErrNotPaused
+	}
+
+	s.Paused = nil
+	return nil
+}
+
+// Enqueue adds h to the end of the queue of waiters, or refreshes its place
+// in the queue if it is already waiting. The place expires ttl from now. It
+// returns the position of h in the queue, counting from zero.
+func (s *Semaphore) Enqueue(h string, ttl time.Duration) int {
+	t := now()
+	for _, w := range s.Waiters {
+		if w.ID == h {
+			w.ExpireTime = t.Add(ttl).Unix()
+			return s.Position(h)
+		}
+	}
+
+	s.Waiters = append(s.Waiters, &Waiter{ID: h, EnqueueTime: t.Unix(), ExpireTime: t.Add(ttl).Unix()})
+	return s.Position(h)
+}
+
+// requeue puts h at the front of the queue of waiters, e.g. when it gives
+// back a slot it took as the first in line. The place expires ttl from now.
+func (s *Semaphore) requeue(h string, ttl time.Duration) {
+	s.Dequeue(h)
+
+	t := now()
+	w := &Waiter{ID: h, EnqueueTime: t.Unix(), ExpireTime: t.Add(ttl).Unix()}
+	s.Waiters = append([]*Waiter{w}, s.Waiters...)
+}
+
+// Dequeue removes h from the queue of waiters. It returns ErrNotExist if h
+// is not waiting.
+func (s *Semaphore) Dequeue(h string) error {
+	for i, w := range s.Waiters {
+		if w.ID == h {
+			s.Waiters = append(s.Waiters[:i], s.Waiters[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotExist
+}
+
+// waiter returns the queue entry of h, or nil if h is not waiting.
+func (s *Semaphore) waiter(h string) *Waiter {
+	for _, w := range s.Waiters {
+		if w.ID == h {
+			return w
+		}
+	}
+
+	return nil
+}
+
+// Position returns the position of h among the waiters whose place has not
+// expired, counting from zero, or -1 if h is not waiting.
+func (s *Semaphore) Position(h string) int {
+	for i, w := range s.liveWaiters() {
+		if w.ID == h {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// liveWaiters returns the waiters whose place in the queue has not expired.
+func (s *Semaphore) liveWaiters() []*Waiter {
+	var live []*Waiter
+	t := now()
+	for _, w := range s.Waiters {
+		if !w.Expired(t) {
+			live = append(live, w)
+		}
+	}
+
+	return live
+}
+
+// Reclaim removes all holders whose lease has expired, returning the ids of
+// the removed holders. Holders without lease information never expire.
+// Waiters whose place in the queue has expired are removed as well, and so is
+// a pause which has ended.
+func (s *Semaphore) Reclaim() []string {
+	var expired []string
+	t := now()
+
+	if s.Paused != nil && !s.Paused.Active(t) {
+		s.Paused = nil
+	}
+
+	if len(s.Waiters) > 0 {
+		s.Waiters = s.liveWaiters()
+	}
+
+	for _, h := range s.Holders {
+		if info, ok := s.HolderInfo[h]; ok && info.Expired(t) {
+			expired = append(expired, h)
+		}
+	}
+
+	for _, h := range expired {
+		s.Unlock(h)
+	}
+
+	return expired
+}
+
+// nextExpiry returns the earliest time at which the lease of a holder, the
+// place of a waiter or a pause expires, or at which the rate limit admits a
+// new holder again. ok is false if nothing expires.
+func (s *Semaphore) nextExpiry() (t time.Time, ok bool) {
+	for _, h := range s.Holders {
+		info, exists := s.HolderInfo[h]
+		if !exists || info.ExpireTime == 0 {
+			continue
+		}
+
+		// leases expire once the expire time has passed.
+		expire := time.Unix(info.ExpireTime+1, 0)
+		if !ok || expire.Before(t) {
+			t, ok = expire, true
+		}
+	}
+
+	for _, w := range s.Waiters {
+		expire := time.Unix(w.ExpireTime+1, 0)
+		if !ok || expire.Before(t) {
+			t, ok = expire, true
+		}
+	}
+
+	// pauses end once the until time is reached.
+	if s.Paused != nil && s.Paused.Until != 0 {
+		expire := time.Unix(s.Paused.Until, 0)
+		if !ok || expire.Before(t) {
+			t, ok = expire, true
+		}
+	}
+
+	if s.Rate != nil {
+		if next := s.Rate.Next(now()); next.After(now()) && (!ok || next.Before(t)) {
+			t, ok = next, true
+		}
+	}
+
+	return t, ok
+}
+
+// token returns the fencing token recorded for holder h, or zero if there is
+// none.
+func (s *Semaphore) token(h string) uint64 {
+	if info, ok := s.HolderInfo[h]; ok {
+		return info.Token
+	}
+	return 0
+}
+
+func newSemaphore() (sem *Semaphore) {
+	return &Semaphore{Semaphore: 1, Max: 1}
 }
@@ -15,13 +15,17 @@
 package lock
 
 import (
+	"errors"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 type testLockClient struct {
-	sem     *Semaphore
-	holders []holder
+	sem *Semaphore
 }
 
 func (c *testLockClient) Init() (err error) {
@@ -234,3 +238,742 @@ func TestSetMax(t *testing.T) {
 		}
 	}
 }
+
+func TestLeaseReclaim(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := start
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	c := testLockClient{}
+	c.Init()
+	al := New("a", &c)
+	al.SetTTL(time.Minute)
+	bl := New("b", &c)
+
+	if err := al.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.sem.HolderInfo["a"]; got == nil || got.StartTime != 1000 || got.ExpireTime != 1060 {
+		t.Fatalf("unexpected holder info for a: %#v", got)
+	}
+
+	clock = start.Add(30 * time.Second)
+	if err := bl.Lock(); err == nil {
+		t.Fatal("b should not be able to lock while a holds an unexpired lease")
+	}
+
+	if err := al.Renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.sem.HolderInfo["a"].ExpireTime; got != 1090 {
+		t.Fatalf("Renew did not extend the lease: got %v", got)
+	}
+
+	clock = start.Add(2 * time.Minute)
+	if err := bl.Lock(); err != nil {
+		t.Fatalf("b should have reclaimed the expired lease of a: %v", err)
+	}
+
+	if !reflect.DeepEqual(c.sem.Holders, []string{"b"}) {
+		t.Errorf("expired holder was not reclaimed: %v", c.sem.Holders)
+	}
+	if _, ok := c.sem.HolderInfo["a"]; ok {
+		t.Error("holder info of reclaimed holder was not removed")
+	}
+	if c.sem.Semaphore != 0 {
+		t.Errorf("unexpected semaphore value: %v", c.sem.Semaphore)
+	}
+
+	if err := al.Renew(context.Background()); err != ErrNotExist {
+		t.Errorf("renewing a reclaimed lock should fail with ErrNotExist, got %v", err)
+	}
+}
+
+func TestLeaseNoExpiry(t *testing.T) {
+	c := testLockClient{}
+	c.Init()
+	c.sem.Holders = []string{"legacy"}
+	c.sem.Semaphore = 0
+
+	al := New("a", &c)
+	al.SetTTL(time.Minute)
+	if err := al.Lock(); err == nil {
+		t.Fatal("holders without lease information should never be reclaimed")
+	}
+
+	if got := c.sem.Reclaim(); len(got) != 0 {
+		t.Errorf("unexpected reclaimed holders: %v", got)
+	}
+}
+
+// conflictLockClient fails the first conflicts calls to Set with
+// ErrCompareFailed, as if another client modified the semaphore.
+type conflictLockClient struct {
+	testLockClient
+	conflicts int
+	sets      int
+}
+
+func (c *conflictLockClient) Set(sem *Semaphore) error {
+	c.sets++
+	if c.sets <= c.conflicts {
+		return ErrCompareFailed
+	}
+	return c.testLockClient.Set(sem)
+}
+
+func (c *conflictLockClient) Get() (*Semaphore, error) {
+	// hand out copies so failed attempts don't leak into the stored value
+	sem := *c.sem
+	sem.Holders = append([]string(nil), c.sem.Holders...)
+	return &sem, nil
+}
+
+func TestStoreRetry(t *testing.T) {
+	c := &conflictLockClient{conflicts: maxStoreAttempts - 1}
+	c.Init()
+	al := New("a", c)
+
+	if err := al.Lock(); err != nil {
+		t.Fatalf("Lock should succeed after %d conflicts: %v", c.conflicts, err)
+	}
+	if !reflect.DeepEqual(c.sem.Holders, []string{"a"}) {
+		t.Errorf("Lock did not add a to the holders: %v", c.sem.Holders)
+	}
+	if c.sets != maxStoreAttempts {
+		t.Errorf("unexpected number of Set calls: got %d want %d", c.sets, maxStoreAttempts)
+	}
+
+	c.sets = 0
+	c.conflicts = maxStoreAttempts
+	err := al.Unlock()
+	if cerr, ok := err.(*ConflictError); !ok || cerr.Attempts != maxStoreAttempts {
+		t.Fatalf("expected ConflictError after exhausting retries, got %#v", err)
+	}
+	if !reflect.DeepEqual(c.sem.Holders, []string{"a"}) {
+		t.Errorf("failed Unlock modified the holders: %v", c.sem.Holders)
+	}
+}
+
+// watchLockClient is a LockClient safe for concurrent use which supports
+// watching the semaphore.
+type watchLockClient struct {
+	mu      sync.Mutex
+	sem     Semaphore
+	changed chan struct{}
+	members map[string]Member
+}
+
+func newWatchLockClient() *watchLockClient {
+	c := &watchLockClient{sem: *newSemaphore(), changed: make(chan struct{})}
+	// like etcd, never hand out a zero index.
+	c.sem.Index = 1
+	return c
+}
+
+func (c *watchLockClient) Init() error {
+	return nil
+}
+
+func (c *watchLockClient) Get() (*Semaphore, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sem := c.sem
+	sem.Holders = append([]string(nil), c.sem.Holders...)
+	sem.HolderInfo = make(map[string]*Holder)
+	for id, info := range c.sem.HolderInfo {
+		h := *info
+		sem.HolderInfo[id] = &h
+	}
+	sem.Waiters = nil
+	for _, w := range c.sem.Waiters {
+		cw := *w
+		sem.Waiters = append(sem.Waiters, &cw)
+	}
+	sem.History = append([]*Event(nil), c.sem.History...)
+	sem.Members = nil
+	if c.sem.Rate != nil {
+		r := *c.sem.Rate
+		sem.Rate = &r
+	}
+	return &sem, nil
+}
+
+func (c *watchLockClient) Register(ctx context.Context, h string, m *Member) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.members == nil {
+		c.members = make(map[string]Member)
+	}
+	c.members[h] = *m
+	return nil
+}
+
+func (c *watchLockClient) Members(ctx context.Context) (map[string]*Member, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := make(map[string]*Member)
+	for id, m := range c.members {
+		m := m
+		if !m.Expired(now()) {
+			members[id] = &m
+		}
+	}
+	return members, nil
+}
+
+func (c *watchLockClient) Set(sem *Semaphore) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sem.Index != c.sem.Index {
+		return ErrCompareFailed
+	}
+	c.sem = *sem
+	c.sem.Index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+func (c *watchLockClient) Watch(ctx context.Context, index uint64) error {
+	c.mu.Lock()
+	if c.sem.Index != index {
+		c.mu.Unlock()
+		return nil
+	}
+	ch := c.changed
+	c.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	c := newWatchLockClient()
+	al := New("a", c)
+	bl := New("b", c)
+
+	if _, err := al.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := al.Acquire(context.Background()); err != nil {
+		t.Fatalf("acquiring a held lock should succeed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := bl.Acquire(context.Background())
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("b acquired the lock while a held it: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := al.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(minAcquireWait / 2):
+		t.Fatal("b did not acquire the lock after a released it")
+	}
+
+	sem, _ := c.Get()
+	if !reflect.DeepEqual(sem.Holders, []string{"b"}) {
+		t.Errorf("unexpected holders: %v", sem.Holders)
+	}
+}
+
+func TestAcquireCanceled(t *testing.T) {
+	c := newWatchLockClient()
+	al := New("a", c)
+	bl := New("b", c)
+
+	if err := al.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := bl.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected Acquire to time out, got %v", err)
+	}
+}
+
+func TestHolderInfo(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	c := testLockClient{}
+	c.Init()
+	al := New("a", &c)
+	al.SetInfo(Holder{Hostname: "host-a", Reason: "update", Version: "1235.0.0", Strategy: "etcd-lock", StartTime: 1, ExpireTime: 2})
+
+	if err := al.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Holder{StartTime: 1000, RenewTime: 1000, Hostname: "host-a", Reason: "update", Version: "1235.0.0", Strategy: "etcd-lock"}
+	if got := c.sem.HolderInfo["a"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected holder info: got %#v want %#v", got, want)
+	}
+
+	if got := want.HeldFor(clock.Add(time.Minute)); got != time.Minute {
+		t.Errorf("unexpected HeldFor: got %v", got)
+	}
+	if got := (&Holder{}).HeldFor(clock); got != 0 {
+		t.Errorf("HeldFor of a holder without start time should be zero, got %v", got)
+	}
+}
+
+func TestFencingToken(t *testing.T) {
+	c := newWatchLockClient()
+	c.sem.Max, c.sem.Semaphore = 2, 2
+	al := New("a", c)
+	bl := New("b", c)
+
+	atok, err := al.LockContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atok == 0 {
+		t.Fatal("Lock returned a zero token")
+	}
+	if err := al.Validate(context.Background(), atok); err != nil {
+		t.Errorf("token of the current holding should be valid: %v", err)
+	}
+	if got, err := al.Acquire(context.Background()); err != nil || got != atok {
+		t.Errorf("Acquire of a held lock should return its token: got %v, %v want %v", got, err, atok)
+	}
+
+	btok, err := bl.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if btok <= atok {
+		t.Errorf("tokens are not increasing: a got %v, b got %v", atok, btok)
+	}
+	if err := al.Validate(context.Background(), btok); err != ErrInvalidToken {
+		t.Errorf("token of another holder should be invalid, got %v", err)
+	}
+
+	if err := al.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Validate(context.Background(), atok); err != ErrInvalidToken {
+		t.Errorf("token of a released lock should be invalid, got %v", err)
+	}
+
+	newtok, err := al.LockContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newtok <= btok {
+		t.Errorf("tokens are not increasing: got %v after %v", newtok, btok)
+	}
+	if err := al.Validate(context.Background(), atok); err != ErrInvalidToken {
+		t.Errorf("token of an earlier holding should be invalid, got %v", err)
+	}
+	if err := al.Validate(context.Background(), 0); err != ErrInvalidToken {
+		t.Errorf("zero token should be invalid, got %v", err)
+	}
+
+	// a holder whose lease expired must not be able to act on its token.
+	c.mu.Lock()
+	c.sem.HolderInfo["b"].ExpireTime = 1
+	c.mu.Unlock()
+	if err := bl.Validate(context.Background(), btok); err != ErrInvalidToken {
+		t.Errorf("token of an expired holder should be invalid, got %v", err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	sem := newSemaphore()
+	if pos := sem.Enqueue("a", time.Minute); pos != 0 {
+		t.Errorf("a should be first in the queue, got %d", pos)
+	}
+	if pos := sem.Enqueue("b", 2*time.Minute); pos != 1 {
+		t.Errorf("b should be second in the queue, got %d", pos)
+	}
+	if pos := sem.Enqueue("a", time.Minute); pos != 0 {
+		t.Errorf("refreshing a should keep its place, got %d", pos)
+	}
+
+	for i, h := range []string{"b", "c"} {
+		if err := sem.Lock(h); err != ErrNotFirst {
+			t.Errorf("case %d: %s should not get the semaphore ahead of a, got %v", i, h, err)
+		}
+	}
+
+	if err := sem.Lock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if pos := sem.Position("a"); pos != -1 {
+		t.Errorf("a should have left the queue, got position %d", pos)
+	}
+	if pos := sem.Position("b"); pos != 0 {
+		t.Errorf("b should be first in the queue, got %d", pos)
+	}
+
+	if err := sem.Unlock("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the place of b expires, it no longer blocks anyone.
+	clock = clock.Add(3 * time.Minute)
+	if pos := sem.Position("b"); pos != -1 {
+		t.Errorf("expired waiter should not have a position, got %d", pos)
+	}
+	if exp, ok := sem.nextExpiry(); !ok || !exp.Equal(time.Unix(1000+2*60+1, 0)) {
+		t.Errorf("unexpected next expiry: %v %v", exp, ok)
+	}
+	sem.Reclaim()
+	if len(sem.Waiters) != 0 {
+		t.Errorf("expired waiters were not reclaimed: %v", sem.Waiters)
+	}
+	if err := sem.Lock("c"); err != nil {
+		t.Errorf("c should get the semaphore once the queue is empty: %v", err)
+	}
+
+	if err := sem.Dequeue("c"); err != ErrNotExist {
+		t.Errorf("dequeuing a machine which is not waiting should fail, got %v", err)
+	}
+}
+
+func TestAcquireFIFO(t *testing.T) {
+	c := newWatchLockClient()
+	al := New("a", c)
+	if err := al.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	var waiters []*Lock
+	done := make(chan string, 2)
+	for _, id := range []string{"b", "c"} {
+		l := New(id, c)
+		waiters = append(waiters, l)
+		go func() {
+			if _, err := l.Acquire(context.Background()); err != nil {
+				t.Error(err)
+			}
+			done <- l.id
+		}()
+
+		// wait for the machine to join the queue before starting the
+		// next one, so their order is known.
+		for deadline := time.Now().Add(time.Second); ; {
+			sem, _ := c.Get()
+			if sem.Position(id) >= 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s did not join the queue", id)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	holder := al
+	for _, want := range []string{"b", "c"} {
+		if err := holder.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got := <-done:
+			if got != want {
+				t.Fatalf("%s acquired the lock ahead of %s", got, want)
+			}
+		case <-time.After(minAcquireWait / 2):
+			t.Fatalf("%s did not acquire the lock", want)
+		}
+
+		holder = waiters[0]
+		waiters = waiters[1:]
+	}
+}
+
+func TestPause(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	sem := newSemaphore()
+	sem.SetMax(2)
+	if err := sem.Lock("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	sem.Pause("incident 42", clock.Add(time.Hour))
+	err := sem.Lock("b")
+	if perr, ok := err.(*PausedError); !ok || perr.Pause.Reason != "incident 42" {
+		t.Fatalf("b should not get a paused semaphore, got %v", err)
+	}
+	if want := "reboots are paused until 1970-01-01T01:16:40Z: incident 42"; err.Error() != want {
+		t.Errorf("unexpected error message: got %q want %q", err, want)
+	}
+	if err := sem.Lock("a"); err != ErrExist {
+		t.Errorf("a should still hold the semaphore, got %v", err)
+	}
+	if sem.Max != 2 || sem.Semaphore != 1 {
+		t.Errorf("pausing modified the semaphore: max %d, available %d", sem.Max, sem.Semaphore)
+	}
+	if exp, ok := sem.nextExpiry(); !ok || !exp.Equal(clock.Add(time.Hour)) {
+		t.Errorf("unexpected next expiry: %v %v", exp, ok)
+	}
+
+	// the pause ends by itself once its time is up.
+	clock = clock.Add(time.Hour)
+	sem.Reclaim()
+	if sem.Paused != nil {
+		t.Errorf("ended pause was not reclaimed: %#v", sem.Paused)
+	}
+	if err := sem.Lock("b"); err != nil {
+		t.Errorf("b should get the semaphore once the pause ended: %v", err)
+	}
+
+	sem.Pause("", time.Time{})
+	if err := sem.Lock("c"); err == nil {
+		t.Error("c should not get a paused semaphore")
+	}
+	if err := sem.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sem.Resume(); err != ErrNotPaused {
+		t.Errorf("resuming twice should fail with ErrNotPaused, got %v", err)
+	}
+
+	if err := sem.SetMax(-1); err == nil || sem.Max != 2 {
+		t.Errorf("negative maximum should be refused, got %v with max %d", err, sem.Max)
+	}
+}
+
+func TestAcquirePaused(t *testing.T) {
+	c := newWatchLockClient()
+	al := New("a", c)
+	if err := al.Pause(context.Background(), "incident", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := al.Acquire(context.Background())
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("a acquired a paused lock: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := New("b", c).Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(minAcquireWait / 2):
+		t.Fatal("a did not acquire the lock once it was resumed")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	c := newWatchLockClient()
+	al := New("a", c)
+	al.SetTTL(time.Minute)
+	if err := al.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := New("", c)
+	admin.SetActor("root@admin")
+	if _, _, err := admin.SetMax(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// b reclaims the expired lease of a.
+	clock = clock.Add(2 * time.Minute)
+	if err := New("b", c).Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	bl := New("b", c)
+	bl.SetActor("root@admin")
+	if err := bl.ForceUnlock(context.Background(), "stuck", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.Unlock(); err != ErrNotExist {
+		t.Fatalf("unlocking twice should fail with ErrNotExist, got %v", err)
+	}
+
+	want := []*Event{
+		{Type: EventLock, Time: 1000, Machine: "a", Actor: "a", Semaphore: 0, Max: 1, Holders: []string{"a"}},
+		{Type: EventSetMax, Time: 1000, Actor: "root@admin", Semaphore: 1, Max: 2, Holders: []string{"a"}},
+		{Type: EventReclaim, Time: 1120, Machine: "a", Actor: "b", Semaphore: 2, Max: 2},
+		{Type: EventLock, Time: 1120, Machine: "b", Actor: "b", Semaphore: 1, Max: 2, Holders: []string{"b"}},
+		{Type: EventForceUnlock, Time: 1120, Machine: "b", Actor: "root@admin", Reason: "stuck", Semaphore: 2, Max: 2},
+	}
+	sem, _ := c.Get()
+	if !reflect.DeepEqual(sem.History, want) {
+		for i, e := range sem.History {
+			t.Logf("event %d: %#v", i, e)
+		}
+		t.Fatalf("unexpected history")
+	}
+
+	for i := 0; i < maxHistory; i++ {
+		sem.record(EventPause, "", "")
+	}
+	if len(sem.History) != maxHistory || sem.History[0].Type != EventPause {
+		t.Errorf("history was not bounded: %d events, first %q", len(sem.History), sem.History[0].Type)
+	}
+}
+
+func TestForceUnlockStale(t *testing.T) {
+	clock := time.Unix(100000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	c := newWatchLockClient()
+	c.sem.SetMax(3)
+	for _, id := range []string{"a", "b", "c"} {
+		l := New(id, c)
+		if id == "c" {
+			l.SetTTL(time.Hour)
+		}
+		if err := l.Lock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b keeps heartbeating, c keeps renewing its lease.
+	clock = clock.Add(50 * time.Minute)
+	if err := New("b", c).Heartbeat(context.Background(), Member{}); err != nil {
+		t.Fatal(err)
+	}
+	cl := New("c", c)
+	cl.SetTTL(time.Hour)
+	if err := cl.Renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(20 * time.Minute)
+
+	for i, tt := range []struct {
+		id         string
+		staleAfter time.Duration
+		lastSeen   int64
+	}{
+		{"b", 30 * time.Minute, 103000},
+		{"c", 30 * time.Minute, 103000},
+		{"a", 2 * time.Hour, 100000},
+	} {
+		err := New(tt.id, c).ForceUnlock(context.Background(), "", tt.staleAfter)
+		if nerr, ok := err.(*NotStaleError); !ok || nerr.LastSeen.Unix() != tt.lastSeen {
+			t.Errorf("case %d: %s should not be stale, got %v", i, tt.id, err)
+		}
+	}
+
+	if err := New("a", c).ForceUnlock(context.Background(), "", time.Hour); err != nil {
+		t.Errorf("a should be stale: %v", err)
+	}
+	if err := New("b", c).ForceUnlock(context.Background(), "", 0); err != nil {
+		t.Errorf("b should be unlocked without a staleness check: %v", err)
+	}
+	if err := New("a", c).ForceUnlock(context.Background(), "", time.Hour); err != ErrNotExist {
+		t.Errorf("unlocking a twice should fail with ErrNotExist, got %v", err)
+	}
+
+	// once the lease of c expires, it is stale no matter how recently it
+	// was seen.
+	clock = clock.Add(41 * time.Minute)
+	if err := New("c", c).ForceUnlock(context.Background(), "", 24*time.Hour); err != nil {
+		t.Errorf("c should be stale once its lease expired: %v", err)
+	}
+}
+
+func TestAcquireCondition(t *testing.T) {
+	c := newWatchLockClient()
+	al := New("a", c)
+	if err := al.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// b waits first in line, but cannot take the semaphore yet.
+	ready := make(chan struct{})
+	bl := New("b", c)
+	bl.SetCondition(func(ctx context.Context, sem *Semaphore) error {
+		select {
+		case <-ready:
+			return nil
+		default:
+			return errors.New("not ready")
+		}
+	})
+	sem, _ := c.Get()
+	sem.Enqueue("b", waiterTTL)
+	if err := c.Set(sem); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bl.Lock(); err == nil || err.Error() != "not ready" {
+		t.Fatalf("b should be refused by its condition, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := bl.Acquire(context.Background())
+		done <- err
+	}()
+
+	// b leaves the queue, so c can take the semaphore once a unlocks.
+	if err := al.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	cl := New("c", c)
+	if _, err := cl.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	close(ready)
+	if err := cl.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(minAcquireWait / 2):
+		t.Fatal("b did not acquire the lock once its condition was met")
+	}
+}
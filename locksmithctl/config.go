@@ -0,0 +1,530 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/locksmith/pkg/timeutil"
+)
+
+const (
+	// defaultConfigPath is where locksmithd reads its config file from,
+	// unless --config is given. It may be missing.
+	defaultConfigPath = "/etc/locksmith/locksmithd.yaml"
+
+	sourceDefault = "default"
+	sourceFlag    = "flag"
+)
+
+var (
+	cmdConfig = &Command{
+		Name:    "config",
+		Summary: "Validate or show the configuration of locksmithd.",
+		Usage:   "validate|show",
+		Description: `Config loads the configuration of locksmithd the way locksmithd does. Every
+setting is taken from the first of these which sets it:
+
+  1. the command line flags, such as --group
+  2. the LOCKSMITHD_* environment variables, such as LOCKSMITHD_GROUP
+  3. the REBOOT_STRATEGY, REBOOT_WINDOW_START and REBOOT_WINDOW_LENGTH
+     environment variables, as set in /etc/coreos/update.conf
+  4. the config file given with --config or LOCKSMITHD_CONFIG,
+     /etc/locksmith/locksmithd.yaml by default, a YAML file whose nested
+     keys, joined with dashes, name the flags, e.g. reboot: window: start:
+     for --reboot-window-start
+  5. the default value of the flag
+
+"config validate" checks the configuration and reports every problem found.
+"config show" prints the effective value of every setting along with where it
+comes from, masking passwords and tokens.`,
+		Run: runConfig,
+	}
+
+	// legacyEnv maps flags to the environment variables without prefix
+	// they were set with by older versions of locksmithd.
+	legacyEnv = [][2]string{
+		{"reboot-strategy", "REBOOT_STRATEGY"},
+		{"reboot-window-start", "REBOOT_WINDOW_START"},
+		{"reboot-window-length", "REBOOT_WINDOW_LENGTH"},
+	}
+
+	// secretFlags are masked by "config show".
+	secretFlags = map[string]bool{
+		"etcd-password": true,
+		"consul-token":  true,
+	}
+)
+
+// configEntry is a setting of a config file: the flag it sets, its value and
+// the line it was given on.
+type configEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+// configAliases maps the key paths of a config file, joined with dashes, to
+// the flags they set where the flag is not named like the key path.
+var configAliases = map[string]string{
+	"etcd-endpoints": "endpoint",
+	"endpoints":      "endpoint",
+}
+
+// configFrame is a key of a config file whose value is given on the lines
+// below it, either as a mapping or as a list.
+type configFrame struct {
+	indent   int
+	key      string
+	line     int
+	children bool
+	items    []string
+}
+
+// readConfig reads the config file at path, which is written in a subset of
+// YAML: nested mappings, lists of scalars either on lines starting with "- "
+// or in [brackets], quoted or plain scalars and # comments. Anything else,
+// such as anchors, tags or flow mappings, is an error. The keys leading
+// to a value, joined with dashes, must name a flag in fs, e.g. reboot: window:
+// start: sets reboot-window-start. Lists set repeatable flags once per item,
+// and other flags to the items joined with commas. Flags may only be set once.
+// A missing file is only an error if it is not the default config file.
+func readConfig(fs *flag.FlagSet, path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && path == defaultConfigPath {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []configEntry
+	seen := make(map[string]bool)
+	set := func(key string, values []string, line int) error {
+		name := key
+		if alias, ok := configAliases[key]; ok {
+			name = alias
+		}
+		fl := fs.Lookup(name)
+		if fl == nil || name == "config" || name == "version" {
+			return fmt.Errorf("%s:%d: unknown key %q", path, line, key)
+		}
+		if seen[name] {
+			return fmt.Errorf("%s:%d: %s is set more than once", path, line, name)
+		}
+		seen[name] = true
+
+		if _, repeatable := fl.Value.(*endpoints); !repeatable {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			entries = append(entries, configEntry{name, v, line})
+		}
+		return nil
+	}
+
+	// close sets the flag of a key whose value was expected on the
+	// following lines: the items of its list, or the empty string if
+	// nothing followed.
+	close := func(fr configFrame) error {
+		switch {
+		case len(fr.items) > 0:
+			return set(fr.key, fr.items, fr.line)
+		case !fr.children:
+			return set(fr.key, []string{""}, fr.line)
+		}
+		return nil
+	}
+
+	var (
+		stack   []configFrame
+		started bool
+	)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		raw := stripComment(s.Text())
+		text := strings.TrimLeft(raw, " ")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		// the document may start with a marker.
+		if !started && strings.TrimSpace(text) == "---" {
+			started = true
+			continue
+		}
+		started = true
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("%s:%d: indentation must use spaces", path, n)
+		}
+		text = strings.TrimSpace(text)
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+
+		// list items may be indented as far as their key.
+		item := text == "-" || strings.HasPrefix(text, "- ")
+		for len(stack) > 0 && (stack[len(stack)-1].indent > indent || (!item && stack[len(stack)-1].indent == indent)) {
+			if err := close(stack[len(stack)-1]); err != nil {
+				return nil, err
+			}
+			stack = stack[:len(stack)-1]
+		}
+
+		var parent *configFrame
+		if len(stack) > 0 {
+			parent = &stack[len(stack)-1]
+		}
+
+		if item {
+			if parent == nil || parent.children {
+				return nil, fmt.Errorf("%s:%d: unexpected list item", path, n)
+			}
+			v, err := configScalar(strings.TrimPrefix(text, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			parent.items = append(parent.items, v)
+			continue
+		}
+
+		key, value, ok := splitConfigLine(text)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, n)
+		}
+		if parent != nil {
+			if len(parent.items) > 0 {
+				return nil, fmt.Errorf("%s:%d: unexpected key %q in a list", path, n, key)
+			}
+			parent.children = true
+			key = parent.key + "-" + key
+		}
+
+		switch {
+		case value == "":
+			stack = append(stack, configFrame{indent: indent, key: key, line: n})
+		case strings.HasPrefix(value, "["):
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("%s:%d: unterminated list", path, n)
+			}
+			var items []string
+			if inner := strings.TrimSpace(value[1 : len(value)-1]); inner != "" {
+				for _, field := range strings.Split(inner, ",") {
+					v, err := configScalar(field)
+					if err != nil {
+						return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+					}
+					items = append(items, v)
+				}
+			}
+			if err := set(key, items, n); err != nil {
+				return nil, err
+			}
+		default:
+			v, err := configScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			if err := set(key, []string{v}, n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := len(stack) - 1; i >= 0; i-- {
+		if err := close(stack[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// stripComment removes a # comment from a line of a config file. A # only
+// starts a comment at the start of the line or after a space, outside of
+// quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// splitConfigLine splits a "key: value" line of a config file. The value is
+// empty if it is given on the following lines.
+func splitConfigLine(text string) (key, value string, ok bool) {
+	i := strings.Index(text, ": ")
+	switch {
+	case i >= 0:
+		key, value = text[:i], strings.TrimSpace(text[i+2:])
+	case strings.HasSuffix(text, ":"):
+		key = strings.TrimSuffix(text, ":")
+	default:
+		return "", "", false
+	}
+
+	key = strings.TrimSpace(key)
+	return key, value, key != "" && !strings.ContainsAny(key, " \"'")
+}
+
+// configScalar returns the value of a scalar of a config file, removing
+// quotes. Double quoted scalars may contain Go escape sequences. YAML which
+// is not understood, such as anchors, tags, flow mappings, nested lists and
+// block scalars, is an error rather than being read as a plain value.
+func configScalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return s, nil
+	}
+
+	switch s[0] {
+	case '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", fmt.Errorf("unterminated quoted value %s", s)
+		}
+		if end != len(s)-1 {
+			return "", fmt.Errorf("unexpected text after quoted value %s", s)
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value %s", s)
+		}
+		return v, nil
+	case '\'':
+		end := 1
+		for ; end < len(s); end++ {
+			if s[end] == '\'' {
+				if end+1 < len(s) && s[end+1] == '\'' {
+					end++
+					continue
+				}
+				break
+			}
+		}
+		if end >= len(s) {
+			return "", fmt.Errorf("unterminated quoted value %s", s)
+		}
+		if end != len(s)-1 {
+			return "", fmt.Errorf("unexpected text after quoted value %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case '&', '*':
+		return "", fmt.Errorf("anchors and aliases are not supported: %s", s)
+	case '!':
+		return "", fmt.Errorf("tags are not supported: %s", s)
+	case '{':
+		return "", fmt.Errorf("flow mappings are not supported: %s", s)
+	case '[', ']':
+		return "", fmt.Errorf("nested lists are not supported: %s", s)
+	case '|', '>':
+		return "", fmt.Errorf("block scalars are not supported: %s", s)
+	}
+	if strings.Contains(s, ": ") || strings.HasSuffix(s, ":") {
+		return "", fmt.Errorf("unexpected mapping in value %s", s)
+	}
+
+	return s, nil
+}
+
+// loadConfig sets the flags of fs which were not given on the command line
+// from the environment variables with the given prefix, the legacy
+// environment variables and the config file named by the config flag, in that
+// order of precedence. The config flag itself may be set on the command line
+// or in the environment. It returns where each flag which is not at its
+// default value was set from.
+func loadConfig(fs *flag.FlagSet, prefix string, legacy [][2]string) (map[string]string, error) {
+	sources := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = sourceFlag
+	})
+
+	flagsFromEnv(prefix, fs)
+	fs.Visit(func(f *flag.Flag) {
+		if sources[f.Name] == "" {
+			sources[f.Name] = strings.ToUpper(prefix + "_" + strings.Replace(f.Name, "-", "_", -1))
+		}
+	})
+
+	for _, l := range legacy {
+		if val := os.Getenv(l[1]); val != "" && sources[l[0]] == "" {
+			if err := fs.Set(l[0], val); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %v", val, l[1], err)
+			}
+			sources[l[0]] = l[1]
+		}
+	}
+
+	path := fs.Lookup("config").Value.String()
+	entries, err := readConfig(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// flags set before the config file take precedence over it.
+	set := make(map[string]bool)
+	for name := range sources {
+		set[name] = true
+	}
+	for _, e := range entries {
+		if set[e.key] {
+			continue
+		}
+		if err := fs.Set(e.key, e.value); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, e.line, e.value, e.key, err)
+		}
+		sources[e.key] = fmt.Sprintf("%s:%d", path, e.line)
+	}
+
+	return sources, nil
+}
+
+// loadDaemonConfig completes the global flags of locksmithd from its
+// environment and config file, see loadConfig.
+func loadDaemonConfig() (map[string]string, error) {
+	sources, err := loadConfig(globalFlagSet, "LOCKSMITHD", legacyEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(globalFlags.Endpoints) == 0 {
+		globalFlags.Endpoints = defaultEndpoints
+	}
+
+	return sources, nil
+}
+
+// validateConfig checks the global flags of locksmithd for values which
+// cannot work, returning all problems found.
+func validateConfig() []error {
+	var errs []error
+
+	switch globalFlags.RebootStrategy {
+	case "", StrategyReboot, StrategyEtcdLock, StrategyOff:
+	default:
+		errs = append(errs, fmt.Errorf("unknown reboot strategy %q", globalFlags.RebootStrategy))
+	}
+
+	startw, lengthw := globalFlags.RebootWindowStart, globalFlags.RebootWindowLength
+	switch {
+	case (startw == "") != (lengthw == ""):
+		errs = append(errs, fmt.Errorf("either both or neither of reboot-window-start and reboot-window-length must be set"))
+	case startw != "":
+		if _, err := timeutil.ParsePeriodic(startw, lengthw); err != nil {
+			errs = append(errs, fmt.Errorf("invalid reboot window: %v", err))
+		}
+	}
+
+	switch globalFlags.Backend {
+	case backendEtcd, backendKubernetes, backendFile, backendConsul:
+	default:
+		errs = append(errs, fmt.Errorf("unknown backend %q", globalFlags.Backend))
+	}
+
+	switch globalFlags.EtcdAPI {
+	case etcdAPIv2, etcdAPIv3:
+	default:
+		errs = append(errs, fmt.Errorf("unknown etcd API version %q", globalFlags.EtcdAPI))
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"timeout", globalFlags.Timeout},
+		{"lease-ttl", globalFlags.LeaseTTL},
+		{"unlock-delay", globalFlags.UnlockDelay},
+		{"hook-timeout", globalFlags.HookTimeout},
+		{"health-deadline", globalFlags.HealthDeadline},
+		{"drain-timeout", globalFlags.DrainTimeout},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %s", d.name, d.value))
+		}
+	}
+
+	return errs
+}
+
+func runConfig(args []string) (exit int) {
+	if len(args) != 1 || (args[0] != "validate" && args[0] != "show") {
+		fmt.Fprintln(os.Stderr, "Expected validate or show.")
+		return 1
+	}
+
+	sources, err := loadDaemonConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configuration:", err)
+		return 1
+	}
+
+	if args[0] == "show" {
+		fmt.Fprintln(out, "KEY\tVALUE\tSOURCE")
+		globalFlagSet.VisitAll(func(f *flag.Flag) {
+			if f.Name == "version" {
+				return
+			}
+
+			value := f.Value.String()
+			if secretFlags[f.Name] && value != "" {
+				value = "********"
+			}
+			source := sources[f.Name]
+			if source == "" {
+				source = sourceDefault
+			}
+
+			fmt.Fprintf(out, "%s\t%s\t%s\n", f.Name, orDash(value), source)
+		})
+		out.Flush()
+	}
+
+	errs := validateConfig()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+
+	if args[0] == "validate" {
+		fmt.Println("Configuration is valid.")
+	}
+
+	return
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFlagSet returns a flag set with a few flags of each kind locksmithd
+// has.
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.String("group", "", "")
+	fs.String("reboot-strategy", StrategyReboot, "")
+	fs.String("reboot-window-start", "", "")
+	fs.Duration("timeout", time.Minute, "")
+	fs.Var(&endpoints{}, "endpoint", "")
+	return fs
+}
+
+func writeConfig(t *testing.T, dir, contents string) string {
+	path := filepath.Join(dir, "locksmithd.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tt := range []struct {
+		contents string
+		want     []configEntry
+		err      bool
+	}{
+		{"", nil, false},
+		{"# comment\n---\n\ngroup: db # trailing\n", []configEntry{{"group", "db", 4}}, false},
+		{"reboot:\n  strategy: off\n  window:\n    start: \"Sun 04:00\"\ngroup: 'a#b'", []configEntry{{"reboot-strategy", "off", 2}, {"reboot-window-start", "Sun 04:00", 4}, {"group", "a#b", 5}}, false},
+		{"etcd:\n  endpoints:\n  - http://a:2379\n  - http://b:2379\ntimeout: 1m", []configEntry{{"endpoint", "http://a:2379", 2}, {"endpoint", "http://b:2379", 2}, {"timeout", "1m", 5}}, false},
+		{"endpoint: [http://a:2379, \"http://b:2379\"]", []configEntry{{"endpoint", "http://a:2379", 1}, {"endpoint", "http://b:2379", 1}}, false},
+		{"group: [a, b]\nreboot-window-start:", []configEntry{{"group", "a,b", 1}, {"reboot-window-start", "", 2}}, false},
+		{"group: a\ngroup: b", nil, true},
+		{"reboot:\n  strategy: off\nreboot-strategy: off", nil, true},
+		{"group", nil, true},
+		{"strategy: reboot", nil, true},
+		{"reboot:\n  window:\n    begin: Sun 04:00", nil, true},
+		{"config: /etc/other.yaml", nil, true},
+		{"- group", nil, true},
+		{"endpoint:\n  - http://a:2379\n  group: a", nil, true},
+		{"endpoint: [http://a:2379", nil, true},
+		{"reboot:\n\tstrategy: off", nil, true},
+		{"group: &rack rack-12", nil, true},
+		{"group: *rack", nil, true},
+		{"group: !!str rack-12", nil, true},
+		{"reboot: {strategy: off}", nil, true},
+		{"group: \"etcd-lock\" trailing", nil, true},
+		{"group: 'etcd-lock' trailing", nil, true},
+		{"group: \"etcd-lock", nil, true},
+		{"group: a: b", nil, true},
+		{"endpoint:\n  - [http://a:2379]", nil, true},
+		{"endpoint: [http://a:2379, {b: c}]", nil, true},
+		{"group: |\n  rack-12", nil, true},
+		{"group: 'it''s' # quoted", []configEntry{{"group", "it's", 1}}, false},
+		{"reboot-window-start: Sun 04:00", []configEntry{{"reboot-window-start", "Sun 04:00", 1}}, false},
+	} {
+		got, err := readConfig(testFlagSet(), writeConfig(t, dir, tt.contents))
+		if (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected error state: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got %v want %v", i, got, tt.want)
+		}
+	}
+
+	path := writeConfig(t, dir, "group: a\nreboot: {strategy: off}")
+	if _, err := readConfig(testFlagSet(), path); err == nil || err.Error() != path+":2: flow mappings are not supported: {strategy: off}" {
+		t.Errorf("unexpected error for a flow mapping: %v", err)
+	}
+
+	if _, err := readConfig(testFlagSet(), filepath.Join(dir, "missing.conf")); err == nil {
+		t.Error("reading a missing config file which is not the default should fail")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeConfig(t, dir, `
+group: file
+reboot:
+  strategy: off
+  window:
+    start: Sun 04:00
+timeout: 1h
+endpoint:
+- http://a:2379
+- http://b:2379
+`)
+
+	os.Setenv("TESTLOCKSMITHD_CONFIG", path)
+	os.Setenv("TESTLOCKSMITHD_TIMEOUT", "5s")
+	os.Setenv("TESTLOCKSMITHD_LEGACY_STRATEGY", StrategyEtcdLock)
+	defer os.Unsetenv("TESTLOCKSMITHD_CONFIG")
+	defer os.Unsetenv("TESTLOCKSMITHD_TIMEOUT")
+	defer os.Unsetenv("TESTLOCKSMITHD_LEGACY_STRATEGY")
+
+	fs := testFlagSet()
+	if err := fs.Parse([]string{"--group=flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := [][2]string{{"reboot-strategy", "TESTLOCKSMITHD_LEGACY_STRATEGY"}}
+	sources, err := loadConfig(fs, "TESTLOCKSMITHD", legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		value  string
+		source string
+	}{
+		{"group", "flag", sourceFlag},
+		{"timeout", "5s", "TESTLOCKSMITHD_TIMEOUT"},
+		{"reboot-strategy", StrategyEtcdLock, "TESTLOCKSMITHD_LEGACY_STRATEGY"},
+		{"reboot-window-start", "Sun 04:00", path + ":6"},
+		{"endpoint", "http://a:2379,http://b:2379", path + ":8"},
+		{"config", path, "TESTLOCKSMITHD_CONFIG"},
+	} {
+		if got := fs.Lookup(tt.name).Value.String(); got != tt.value {
+			t.Errorf("%s: got value %q want %q", tt.name, got, tt.value)
+		}
+		if got := sources[tt.name]; got != tt.source {
+			t.Errorf("%s: got source %q want %q", tt.name, got, tt.source)
+		}
+	}
+
+	// --config takes precedence over TESTLOCKSMITHD_CONFIG.
+	other := filepath.Join(dir, "other.yaml")
+	if err := ioutil.WriteFile(other, []byte("timeout: soon\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs = testFlagSet()
+	if err := fs.Parse([]string{"--config=" + other}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(fs, "TESTLOCKSMITHD_NONE", nil); err == nil {
+		t.Error("loading an invalid value from the config file should fail")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	saved := globalFlags
+	defer func() { globalFlags = saved }()
+
+	for i, tt := range []struct {
+		strategy, start, length, backend, api string
+		timeout                               time.Duration
+		errs                                  int
+	}{
+		{StrategyReboot, "", "", backendEtcd, etcdAPIv2, time.Minute, 0},
+		{StrategyEtcdLock, "Sun 04:00", "1h", backendConsul, etcdAPIv3, 0, 0},
+		{"best-effort", "", "", backendEtcd, etcdAPIv2, time.Minute, 1},
+		{StrategyReboot, "Sun 04:00", "", backendEtcd, etcdAPIv2, time.Minute, 1},
+		{StrategyReboot, "Someday 04:00", "1h", backendEtcd, etcdAPIv2, time.Minute, 1},
+		{StrategyReboot, "", "", "zookeeper", "v4", -time.Minute, 3},
+	} {
+		globalFlags.RebootStrategy = tt.strategy
+		globalFlags.RebootWindowStart = tt.start
+		globalFlags.RebootWindowLength = tt.length
+		globalFlags.Backend = tt.backend
+		globalFlags.EtcdAPI = tt.api
+		globalFlags.Timeout = tt.timeout
+
+		if errs := validateConfig(); len(errs) != tt.errs {
+			t.Errorf("case %d: got errors %v want %d", i, errs, tt.errs)
+		}
+	}
+}
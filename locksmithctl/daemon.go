@@ -20,15 +20,20 @@ package main
 import "C"
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/login1"
 	"github.com/coreos/pkg/capnslog"
+	"golang.org/x/net/context"
 
 	"github.com/coreos/locksmith/lock"
 	"github.com/coreos/locksmith/pkg/coordinatorconf"
@@ -43,6 +48,13 @@ const (
 	loginsRebootDelay = time.Minute * 5
 
 	coordinatorName = "locksmithd"
+
+	osReleasePath = "/etc/os-release"
+	uptimePath    = "/proc/uptime"
+
+	// soakReportInterval is how often the time left before releasing the
+	// lock after a reboot is reported.
+	soakReportInterval = 30 * time.Second
 )
 
 var (
@@ -134,13 +146,26 @@ func (r rebooter) rebootAndSleep() {
 	time.Sleep(time.Hour * 24 * 7)
 }
 
-// lockAndReboot attempts to acquire the lock and reboot the machine in an
-// infinite loop. Returns if the reboot failed.
-func (r rebooter) lockAndReboot(lck *lock.Lock) {
+// lockAndReboot waits to acquire the lock and reboots the machine in an
+// infinite loop. Returns if the reboot failed. If the lock is kept from the
+// last reboot, see keepHeldLock, it is not released when preparing to reboot
+// fails.
+func (r rebooter) lockAndReboot(lck *lock.MultiLock, kept bool) {
 	interval := initialInterval
 	for {
-		err := lck.Lock()
-		if err != nil && err != lock.ErrExist {
+		// Acquire blocks until the lock is free, so a timeout only means
+		// the lock was not available during this attempt.
+		ctx, cancel := newContext()
+		_, err := lck.Acquire(ctx)
+		timedOut := ctx.Err() != nil
+		cancel()
+		if err != nil && timedOut {
+			dlog.Debugf("Lock not acquired within %v, still waiting.", globalFlags.Timeout)
+			interval = initialInterval
+
+			continue
+		}
+		if err != nil {
 			interval = expBackoff(interval)
 			dlog.Warningf("Failed to acquire lock: %v. Retrying in %v.", err, interval)
 			time.Sleep(interval)
@@ -148,13 +173,68 @@ func (r rebooter) lockAndReboot(lck *lock.Lock) {
 			continue
 		}
 
+		stopRenew := make(chan struct{})
+		if globalFlags.LeaseTTL > 0 {
+			go renewLease(lck, globalFlags.LeaseTTL, stopRenew)
+		}
+
+		err = r.preReboot()
+		if err == nil && globalFlags.Drain {
+			err = drainNode()
+		}
+		if err != nil && kept {
+			close(stopRenew)
+			interval = expBackoff(interval)
+			dlog.Warningf("Preparing to reboot failed: %v. Keeping the lock held since the last reboot and retrying in %v.", err, interval)
+			time.Sleep(interval)
+
+			continue
+		}
+		if err != nil {
+			close(stopRenew)
+			interval = expBackoff(interval)
+			dlog.Warningf("Preparing to reboot failed: %v. Releasing the lock and retrying in %v.", err, interval)
+
+			ctx, cancel := newContext()
+			if err := unlockIfHeld(ctx, lck); err != nil {
+				dlog.Errorf("Failed to release lock: %v", err)
+			}
+			cancel()
+			time.Sleep(interval)
+
+			continue
+		}
+
 		r.rebootAndSleep()
 		return
 	}
 }
 
-func setupLock() (lck *lock.Lock, err error) {
-	elc, err := getClient()
+// renewLease periodically renews the lease of a held lock so that it is not
+// reclaimed by other machines while this machine is waiting to reboot, until
+// stop is closed. The reboot is expected to end the process otherwise.
+func renewLease(lck *lock.MultiLock, ttl time.Duration, stop chan struct{}) {
+	tick := time.NewTicker(ttl / 3)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+
+		ctx, cancel := newContext()
+		if err := lck.Renew(ctx); err != nil {
+			dlog.Warningf("Failed to renew lock lease: %v", err)
+		}
+		cancel()
+	}
+}
+
+// setupLock returns a lock for this machine in every group it belongs to.
+func setupLock(ctx context.Context) (lck *lock.MultiLock, err error) {
+	clients, err := getClients(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("Error initializing etcd client: %v", err)
 	}
@@ -164,7 +244,8 @@ func setupLock() (lck *lock.Lock, err error) {
 		return nil, fmt.Errorf("Cannot read machine-id")
 	}
 
-	lck = lock.New(mID, elc)
+	lck = lock.NewMulti(mID, clients...)
+	lck.SetTTL(globalFlags.LeaseTTL)
 
 	return lck, nil
 }
@@ -173,6 +254,25 @@ type rebooter struct {
 	strategy                 string
 	lgn                      *login1.Conn
 	coordinatorConfigUpdater coordinatorconf.CoordinatorConfigUpdater
+	// version is the OS version the reboot applies.
+	version string
+}
+
+// holderInfo returns the metadata recorded with the lock taken for the reboot.
+func (r rebooter) holderInfo() lock.Holder {
+	hostname, _ := os.Hostname()
+
+	return lock.Holder{
+		Hostname: hostname,
+		Reason:   "update",
+		Version:  r.version,
+		Strategy: r.strategy,
+	}
+}
+
+// preReboot runs the pre-reboot hooks, see runHooks.
+func (r rebooter) preReboot() error {
+	return runHooks(globalFlags.PreRebootDir, hookEnv(hookPreReboot, r.strategy, r.version), globalFlags.HookTimeout)
 }
 
 func (r rebooter) reboot() int {
@@ -184,22 +284,41 @@ func (r rebooter) reboot() int {
 	case StrategyEtcdLock:
 		// If the strategy is etcd-lock, then a lock should be acquired in etcd
 		// before rebooting
-		lck, err := setupLock()
+		ctx, cancel := newContext()
+		lck, err := setupLock(ctx)
+		cancel()
 		if err != nil {
 			dlog.Errorf("Failed to set up lock: %v", err)
 			return 1
 		}
 
-		err = unlockIfHeld(lck)
-		if err != nil {
-			dlog.Errorf("Failed to unlock held lock: %v", err)
-			return 1
-		}
+		kept := keepHeldLock(lck, initialInterval)
+		if !kept {
+			info := r.holderInfo()
+			cluster := quorumCluster()
+			if id := localEtcdMember(cluster); id != "" {
+				dlog.Infof("This machine runs etcd member %s, only rebooting while the etcd cluster keeps quorum.", id)
+				info.EtcdMember = id
+				lck.SetCondition(quorumCondition(cluster.status, id))
+			}
 
-		r.lockAndReboot(lck)
+			lck.SetInfo(info)
+		}
+		r.lockAndReboot(lck, kept)
 	case StrategyReboot:
-		// If the strategy is reboot, no extra work must be done before
-		// rebooting
+		// If the strategy is reboot, only the pre-reboot hooks must run
+		// before rebooting
+		interval := initialInterval
+		for {
+			err := r.preReboot()
+			if err == nil {
+				break
+			}
+
+			interval = expBackoff(interval)
+			dlog.Warningf("Pre-reboot hooks failed: %v. Retrying in %v.", err, interval)
+			time.Sleep(interval)
+		}
 	case StrategyOff:
 		// We should never get here with the off strategy, but in case we do
 		// print a more descriptive error message
@@ -215,9 +334,78 @@ func (r rebooter) reboot() int {
 	return 1
 }
 
+// keepHeldLock reports whether this machine still holds the lock from its
+// last reboot, because another reboot became necessary before the lock was
+// released, e.g. during the unlock delay. The lock is then kept for the next
+// reboot instead of giving up the slot, so that no other machine reboots
+// before this one is done; the unlock delay starts over after the next boot.
+// If the lock is kept because the health checks failed, see holdUnhealthy,
+// the machine must not reboot at all: keepHeldLock blocks until the lock is
+// released by hand and then reports false. The lock is read every interval
+// meanwhile, and failures to read it are retried as often.
+func keepHeldLock(lck *lock.MultiLock, interval time.Duration) bool {
+	gated := false
+	for {
+		ctx, cancel := newContext()
+		info, err := lck.HolderInfo(ctx)
+		if err == nil && info != nil && !info.Gated && info.UnlockTime != 0 {
+			// the unlock time no longer applies.
+			if err := lck.SetUnlockTime(ctx, time.Time{}); err != nil {
+				dlog.Warningf("Failed to clear when the lock is going to be released: %v", err)
+			}
+		}
+		cancel()
+
+		switch {
+		case err != nil:
+			dlog.Warningf("Failed to check for held locks: %v. Retrying in %v.", err, interval)
+			time.Sleep(interval)
+		case info == nil:
+			if gated {
+				dlog.Notice("The lock kept for failed health checks was released.")
+			}
+			return false
+		case info.Gated:
+			if !gated {
+				dlog.Errorf("Health checks failed after the last reboot, not rebooting until the lock is released with locksmithctl unlock.")
+				gated = true
+			}
+			time.Sleep(interval)
+		default:
+			dlog.Info("Keeping the lock held since the last reboot.")
+			return true
+		}
+	}
+}
+
+// holdUnhealthy keeps the held lock after the health checks did not pass in
+// time, until a stop signal is sent. The lock is marked as gated, so that the
+// machine does not reboot while holding it either, see keepHeldLock.
+func holdUnhealthy(lck *lock.MultiLock, stop chan struct{}) {
+	dlog.Errorf("Health checks did not pass within %v, keeping the reboot lock so that no other machine reboots. Release it with locksmithctl unlock once the machine is fixed.", globalFlags.HealthDeadline)
+
+	for interval := initialInterval; ; interval = expBackoff(interval) {
+		ctx, cancel := newContext()
+		err := lck.SetGated(ctx, true)
+		cancel()
+		if err == nil {
+			break
+		}
+
+		dlog.Errorf("Recording the failed health checks with the lock failed: %v. Retrying in %v.", err, interval)
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+
+	<-stop
+}
+
 // unlockIfHeld will unlock a lock, if it is held by this machine, or return an error.
-func unlockIfHeld(lck *lock.Lock) error {
-	err := lck.Unlock()
+func unlockIfHeld(ctx context.Context, lck *lock.MultiLock) error {
+	err := lck.Unlock(ctx)
 	if err == lock.ErrNotExist {
 		return nil
 	} else if err == nil {
@@ -228,33 +416,266 @@ func unlockIfHeld(lck *lock.Lock) error {
 	return err
 }
 
-// unlockHeldLocks will loop until it can confirm that any held locks are
-// released or a stop signal is sent.
-func unlockHeldLocks(strategy string, stop chan struct{}, wg *sync.WaitGroup) {
-	defer wg.Done()
-	interval := initialInterval
+// quorumCluster returns the etcd cluster the lock is stored in, if
+// --etcd-quorum is set, or nil otherwise or if it cannot be set up.
+func quorumCluster() *etcdCluster {
+	if !globalFlags.EtcdQuorum || globalFlags.Backend != backendEtcd {
+		return nil
+	}
+
+	cluster, err := getEtcdCluster()
+	if err != nil {
+		dlog.Warningf("Failed to set up etcd members client: %v", err)
+		return nil
+	}
+
+	return cluster
+}
+
+// localEtcdMember returns the id of the etcd member of cluster running on
+// this machine. The id is empty if cluster is nil, if no etcd member runs
+// here, or if the members of the cluster cannot be listed.
+func localEtcdMember(cluster *etcdCluster) string {
+	if cluster == nil {
+		return ""
+	}
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	id, err := cluster.localMember(ctx, machineid.MachineID("/"))
+	if err != nil {
+		dlog.Warningf("Failed to list etcd members: %v", err)
+		return ""
+	}
+
+	return id
+}
+
+// heartbeat registers this machine as a member of its groups every
+// lock.HeartbeatInterval, along with the current operation of the update
+// engine. It never returns.
+func heartbeat(ue *updateengine.Client, strategy string) {
+	hostname, _ := os.Hostname()
+	member := lock.Member{
+		Hostname: hostname,
+		Version:  osVersion(osReleasePath),
+		Strategy: strategy,
+	}
+
+	cluster := quorumCluster()
+	var lck *lock.MultiLock
 	for {
-		var reason string
+		member.EtcdMember = localEtcdMember(cluster)
+
+		if status, err := ue.GetStatus(); err != nil {
+			dlog.Warningf("Failed to get update engine status: %v", err)
+		} else {
+			member.Operation = status.CurrentOperation
+		}
+
+		// the clients are kept across heartbeats once they are set up.
+		ctx, cancel := newContext()
+		var err error
+		if lck == nil {
+			lck, err = setupLock(ctx)
+		}
+		if err == nil {
+			err = lck.Heartbeat(ctx, member)
+		}
+		cancel()
+		if err != nil {
+			dlog.Warningf("Failed to register as a member: %v", err)
+		}
+
+		time.Sleep(lock.HeartbeatInterval)
+	}
+}
+
+// osVersion returns the VERSION of the OS as recorded in the os-release file
+// at path, or the empty string if it cannot be read.
+func osVersion(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v := strings.TrimPrefix(s.Text(), "VERSION="); v != s.Text() {
+			return strings.Trim(v, `"'`)
+		}
+	}
+
+	return ""
+}
+
+// bootTime returns the time the machine booted at, according to the uptime
+// file at path, or now if it cannot be read.
+func bootTime(path string, now time.Time) time.Time {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return now
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return now
+	}
+
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return now
+	}
+
+	return now.Add(-time.Duration(uptime * float64(time.Second)))
+}
+
+// soak keeps the held lock until the given time, so that the next machine
+// only reboots once this one has been up for a while. The time left is
+// reported in the coordinator config, and the unlock time is recorded with
+// the holder. It returns false if a stop signal is sent before the time has
+// come.
+func soak(lck *lock.MultiLock, conf coordinatorconf.CoordinatorConfigUpdater, until time.Time, stop chan struct{}) bool {
+	ctx, cancel := newContext()
+	err := lck.SetUnlockTime(ctx, until)
+	cancel()
+	if err != nil {
+		dlog.Warningf("Failed to record when the lock is going to be released: %v", err)
+	}
+
+	dlog.Infof("Keeping the reboot lock until %s.", until)
+	defer conf.UpdateUnlockDelay(0)
+
+	for {
+		remaining := until.Sub(time.Now())
+		if remaining <= 0 {
+			return true
+		}
+
+		if err := conf.UpdateUnlockDelay(remaining); err != nil {
+			dlog.Errorf("could not update state file with the unlock delay: %v", err)
+		}
+
+		interval := soakReportInterval
+		if remaining < interval {
+			interval = remaining
+		}
 		select {
 		case <-stop:
-			return
+			return false
 		case <-time.After(interval):
-			lck, err := setupLock()
-			if err != nil {
-				reason = "error setting up lock: " + err.Error()
-				break
-			}
+		}
+	}
+}
 
-			err = unlockIfHeld(lck)
+// retryUntil calls f with exponential backoff until it succeeds, returning
+// true, or until a stop signal is sent, returning false. Failures are logged
+// along with what failed.
+func retryUntil(what string, stop chan struct{}, f func() error) bool {
+	interval := initialInterval
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(interval):
+			err := f()
 			if err == nil {
-				return
+				return true
 			}
-			reason = err.Error()
+
+			interval = expBackoff(interval)
+			dlog.Errorf("%s failed: %v. Retrying in %v.", what, err, interval)
 		}
+	}
+}
+
+// unlockHeldLocks will loop until it can confirm that any held locks are
+// released or a stop signal is sent. If draining is enabled, the Kubernetes
+// node is uncordoned first. A lock held after a reboot is only released once
+// the post-reboot hooks succeeded and the health checks passed, and with an
+// unlock delay, once the machine has been up for that long, see soak. If the
+// health checks fail, the lock is kept, see holdUnhealthy. Its lease is
+// renewed meanwhile.
+func unlockHeldLocks(strategy string, conf coordinatorconf.CoordinatorConfigUpdater, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-		interval = expBackoff(interval)
-		dlog.Errorf("Unlocking old locks failed: %v. Retrying in %v.", reason, interval)
+	if globalFlags.Drain && !retryUntil("Uncordoning Kubernetes node", stop, uncordonNode) {
+		return
 	}
+
+	var (
+		lck  *lock.MultiLock
+		held bool
+	)
+	if !retryUntil("Checking for held locks", stop, func() error {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		var err error
+		lck, err = setupLock(ctx)
+		if err != nil {
+			return fmt.Errorf("error setting up lock: %v", err)
+		}
+
+		held, err = lck.Held(ctx)
+		return err
+	}) || !held {
+		return
+	}
+
+	if globalFlags.LeaseTTL > 0 {
+		stopRenew := make(chan struct{})
+		defer close(stopRenew)
+		go renewLease(lck, globalFlags.LeaseTTL, stopRenew)
+	}
+
+	env := hookEnv(hookPostReboot, strategy, osVersion(osReleasePath))
+	if !retryUntil("Running post-reboot hooks", stop, func() error {
+		return runHooks(globalFlags.PostRebootDir, env, globalFlags.HookTimeout)
+	}) {
+		return
+	}
+
+	var checks []healthCheck
+	if !retryUntil("Setting up health checks", stop, func() (err error) {
+		checks, err = healthChecks()
+		return err
+	}) {
+		return
+	}
+	if len(checks) > 0 && !waitHealthy(checks, globalFlags.HealthDeadline, healthCheckInterval, stop) {
+		select {
+		case <-stop:
+		default:
+			holdUnhealthy(lck, stop)
+		}
+		return
+	}
+
+	// the health checks may have failed before locksmithd was restarted.
+	ctx, cancel := newContext()
+	if info, err := lck.HolderInfo(ctx); err == nil && info != nil && info.Gated {
+		if err := lck.SetGated(ctx, false); err != nil {
+			dlog.Warningf("Failed to clear the failed health checks recorded with the lock: %v", err)
+		}
+	}
+	cancel()
+
+	if globalFlags.UnlockDelay > 0 {
+		until := bootTime(uptimePath, time.Now()).Add(globalFlags.UnlockDelay)
+		if !soak(lck, conf, until, stop) {
+			return
+		}
+	}
+
+	retryUntil("Unlocking old locks", stop, func() error {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		return unlockIfHeld(ctx, lck)
+	})
 }
 
 // runDaemon waits for the reboot needed signal coming out of update engine and
@@ -263,7 +684,18 @@ func unlockHeldLocks(strategy string, stop chan struct{}, wg *sync.WaitGroup) {
 func runDaemon() int {
 	var period *timeutil.Periodic
 
-	strategy := os.Getenv("REBOOT_STRATEGY")
+	if _, err := loadDaemonConfig(); err != nil {
+		dlog.Fatalf("Error loading configuration: %v", err)
+	}
+
+	if errs := validateConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			dlog.Errorf("Invalid configuration: %v", err)
+		}
+		return 1
+	}
+
+	strategy := globalFlags.RebootStrategy
 
 	if strategy == "" {
 		strategy = StrategyReboot
@@ -274,22 +706,7 @@ func runDaemon() int {
 		return 0
 	}
 
-	// XXX: REBOOT_WINDOW_* are deprecated in favor of variables with LOCKSMITHD_ prefix,
-	// but the old ones are read for compatibility.
-	startw := os.Getenv("LOCKSMITHD_REBOOT_WINDOW_START")
-	if startw == "" {
-		startw = os.Getenv("REBOOT_WINDOW_START")
-	}
-
-	lengthw := os.Getenv("LOCKSMITHD_REBOOT_WINDOW_LENGTH")
-	if lengthw == "" {
-		lengthw = os.Getenv("REBOOT_WINDOW_LENGTH")
-	}
-
-	if (startw == "") != (lengthw == "") {
-		dlog.Fatal("Either both or neither $REBOOT_WINDOW_START and $REBOOT_WINDOW_LENGTH must be set")
-	}
-
+	startw, lengthw := globalFlags.RebootWindowStart, globalFlags.RebootWindowLength
 	if startw != "" && lengthw != "" {
 		p, err := timeutil.ParsePeriodic(startw, lengthw)
 		if err != nil {
@@ -335,7 +752,8 @@ func runDaemon() int {
 	var wg sync.WaitGroup
 	if strategy == StrategyEtcdLock {
 		wg.Add(1)
-		go unlockHeldLocks(strategy, stop, &wg)
+		go unlockHeldLocks(strategy, coordinatorConf, stop, &wg)
+		go heartbeat(ue, strategy)
 	}
 
 	ch := make(chan updateengine.Status, 1)
@@ -358,8 +776,9 @@ func runDaemon() int {
 	}
 
 	if result.CurrentOperation != updateengine.UpdateStatusUpdatedNeedReboot {
-		<-ch
+		result = <-ch
 	}
+	r.version = result.NewVersion
 
 	close(stop)
 	wg.Wait()
@@ -15,8 +15,16 @@
 package main
 
 import (
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/lock"
 )
 
 func TestExpBackoff(t *testing.T) {
@@ -31,3 +39,192 @@ func TestExpBackoff(t *testing.T) {
 		}
 	}
 }
+
+func TestOSVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-os-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tt := range []struct {
+		contents string
+		want     string
+	}{
+		{"NAME=\"Container Linux by CoreOS\"\nID=coreos\nVERSION=1465.6.0\nVERSION_ID=1465.6.0\n", "1465.6.0"},
+		{"VERSION_ID=1465.6.0\nVERSION=\"1465.6.0\"\n", "1465.6.0"},
+		{"ID=coreos\n", ""},
+	} {
+		path := filepath.Join(dir, "os-release")
+		if err := ioutil.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := osVersion(path); got != tt.want {
+			t.Errorf("case %d: got %q want %q", i, got, tt.want)
+		}
+	}
+
+	if got := osVersion(filepath.Join(dir, "missing")); got != "" {
+		t.Errorf("missing os-release: got %q", got)
+	}
+}
+
+func TestBootTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-uptime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(100000, 0)
+	for i, tt := range []struct {
+		contents string
+		want     time.Time
+	}{
+		{"600.50 1100.25\n", now.Add(-600500 * time.Millisecond)},
+		{"", now},
+		{"up 10 minutes\n", now},
+	} {
+		path := filepath.Join(dir, "uptime")
+		if err := ioutil.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := bootTime(path, now); !got.Equal(tt.want) {
+			t.Errorf("case %d: got %v want %v", i, got, tt.want)
+		}
+	}
+
+	if got := bootTime(filepath.Join(dir, "missing"), now); !got.Equal(now) {
+		t.Errorf("missing uptime: got %v", got)
+	}
+}
+
+// newTestMultiLock returns a lock for id in two groups stored in dir.
+func newTestMultiLock(t *testing.T, dir, id string) *lock.MultiLock {
+	var clients []lock.LockClient
+	for _, g := range []string{"rack-12", ""} {
+		c, err := lock.NewFileLockClient(context.Background(), dir, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+
+	return lock.NewMulti(id, clients...)
+}
+
+func TestKeepHeldLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	lck := newTestMultiLock(t, dir, "a")
+	if keepHeldLock(lck, time.Millisecond) {
+		t.Error("kept a lock which is not held")
+	}
+
+	if _, err := lck.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lck.SetUnlockTime(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// another reboot is needed during the unlock delay.
+	if !keepHeldLock(lck, time.Millisecond) {
+		t.Fatal("gave up the lock during the unlock delay")
+	}
+	if _, err := lck.Acquire(ctx); err != nil {
+		t.Fatalf("acquiring the kept lock failed: %v", err)
+	}
+
+	info, err := lck.HolderInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil {
+		t.Fatal("the lock is no longer held")
+	}
+	if info.UnlockTime != 0 {
+		t.Errorf("the unlock time was kept: %v", info.UnlockTime)
+	}
+
+	// the next machine must wait for a.
+	if _, err := newTestMultiLock(t, dir, "b").Lock(ctx); err == nil {
+		t.Error("b took the lock kept by a")
+	}
+}
+
+func TestHoldUnhealthy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	lck := newTestMultiLock(t, dir, "a")
+	if _, err := lck.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the health checks failed after the reboot.
+	stop := make(chan struct{})
+	held := make(chan struct{})
+	go func() {
+		holdUnhealthy(lck, stop)
+		close(held)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := lck.HolderInfo(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info != nil && info.Gated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the failed health checks were not recorded with the lock")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// then a reboot is needed.
+	close(stop)
+	<-held
+
+	kept := make(chan bool, 1)
+	go func() {
+		kept <- keepHeldLock(lck, 5*time.Millisecond)
+	}()
+
+	select {
+	case <-kept:
+		t.Fatal("the machine went on to reboot with failed health checks")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if info, err := lck.HolderInfo(ctx); err != nil || info == nil {
+		t.Fatalf("the lock is no longer held: %v", err)
+	}
+	if _, err := newTestMultiLock(t, dir, "b").Lock(ctx); err == nil {
+		t.Error("b took the lock kept for failed health checks")
+	}
+
+	// the lock is released by hand once the machine is fixed.
+	if err := lck.ForceUnlock(ctx, "fixed", 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case k := <-kept:
+		if k {
+			t.Error("kept a lock which was released")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after the lock was released")
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/k8s"
+)
+
+const (
+	// drainedAnnotation marks nodes cordoned by locksmithd, so that only
+	// those are uncordoned after the reboot, and not nodes cordoned by
+	// someone else.
+	drainedAnnotation = "locksmith.coreos.com/drained"
+	// mirrorPodAnnotation marks static pods run by the kubelet itself,
+	// which cannot be evicted.
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+
+	// drainPollInterval is how often refused evictions are retried, and
+	// evicted pods are checked for being gone.
+	drainPollInterval = 5 * time.Second
+)
+
+// nodeName returns the name of the Kubernetes node of this machine.
+func nodeName() string {
+	if globalFlags.KubeNode != "" {
+		return globalFlags.KubeNode
+	}
+
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// cordon marks the node unschedulable, unless it already is, annotating it
+// as cordoned by locksmithd.
+func cordon(ctx context.Context, kc *k8s.Client, node string) error {
+	n, err := kc.GetNode(ctx, node)
+	if err != nil {
+		return err
+	}
+	if n.Spec.Unschedulable {
+		return nil
+	}
+
+	_, err = kc.PatchNode(ctx, node, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{drainedAnnotation: "true"},
+		},
+		"spec": map[string]interface{}{"unschedulable": true},
+	})
+	return err
+}
+
+// uncordon marks the node schedulable again if it was cordoned by
+// locksmithd.
+func uncordon(ctx context.Context, kc *k8s.Client, node string) error {
+	n, err := kc.GetNode(ctx, node)
+	if err != nil {
+		return err
+	}
+	if _, ok := n.Metadata.Annotations[drainedAnnotation]; !ok {
+		return nil
+	}
+
+	_, err = kc.PatchNode(ctx, node, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{drainedAnnotation: nil},
+		},
+		"spec": map[string]interface{}{"unschedulable": false},
+	})
+	return err
+}
+
+// evictable reports whether pod should be evicted when draining its node.
+// Pods of DaemonSets would be recreated on the node right away, mirror pods
+// cannot be evicted, and pods which have terminated are not running anyway.
+func evictable(pod k8s.Pod) bool {
+	if _, ok := pod.Metadata.Annotations[mirrorPodAnnotation]; ok {
+		return false
+	}
+	if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+		return false
+	}
+	for _, owner := range pod.Metadata.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// drain cordons the node and evicts its pods through the eviction API, so
+// that PodDisruptionBudgets are respected, then waits for the evicted pods to
+// be gone. Evictions refused by a PodDisruptionBudget are retried every
+// interval until the context is done.
+func drain(ctx context.Context, kc *k8s.Client, node string, interval time.Duration) error {
+	if err := cordon(ctx, kc, node); err != nil {
+		return fmt.Errorf("error cordoning node %s: %v", node, err)
+	}
+
+	pods, err := kc.ListNodePods(ctx, node)
+	if err != nil {
+		return fmt.Errorf("error listing pods: %v", err)
+	}
+
+	var pending []k8s.Pod
+	for _, pod := range pods {
+		if evictable(pod) {
+			pending = append(pending, pod)
+		}
+	}
+
+	// evict the pods, then wait for them to be gone. A pod is gone once it
+	// no longer exists, or has been replaced by a pod of the same name.
+	evicted := make(map[string]bool)
+	for len(pending) > 0 {
+		var left []k8s.Pod
+		for _, pod := range pending {
+			key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+			if !evicted[key] {
+				err := kc.EvictPod(ctx, pod.Metadata.Namespace, pod.Metadata.Name)
+				switch {
+				case err == nil:
+					dlog.Infof("Evicted pod %s", key)
+					evicted[key] = true
+				case k8s.IsNotFound(err):
+					continue
+				case k8s.IsTooManyRequests(err):
+					dlog.Infof("Eviction of pod %s refused for now: %v", key, err)
+				case ctx.Err() != nil:
+					return fmt.Errorf("%d pods were not evicted: %v", len(pending), ctx.Err())
+				default:
+					return fmt.Errorf("error evicting pod %s: %v", key, err)
+				}
+			} else {
+				p, err := kc.GetPod(ctx, pod.Metadata.Namespace, pod.Metadata.Name)
+				switch {
+				case k8s.IsNotFound(err):
+					continue
+				case ctx.Err() != nil:
+					return fmt.Errorf("%d pods were not evicted: %v", len(pending), ctx.Err())
+				case err != nil:
+					return fmt.Errorf("error getting pod %s: %v", key, err)
+				case p.Metadata.UID != pod.Metadata.UID:
+					continue
+				}
+			}
+
+			left = append(left, pod)
+		}
+
+		pending = left
+		if len(pending) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d pods were not evicted: %v", len(pending), ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+
+	return nil
+}
+
+// drainNode drains the Kubernetes node of this machine within the drain
+// timeout, see drain. If draining fails, the node is uncordoned again.
+func drainNode() error {
+	kc, err := getKubernetesClient()
+	if err != nil {
+		return fmt.Errorf("error initializing Kubernetes client: %v", err)
+	}
+
+	node := nodeName()
+	dlog.Infof("Draining Kubernetes node %s.", node)
+
+	ctx, cancel := newDrainContext()
+	err = drain(ctx, kc, node, drainPollInterval)
+	cancel()
+	if err == nil {
+		return nil
+	}
+
+	uctx, ucancel := newContext()
+	defer ucancel()
+	if uerr := uncordon(uctx, kc, node); uerr != nil {
+		dlog.Errorf("Failed to uncordon node %s: %v", node, uerr)
+	}
+
+	return err
+}
+
+// newDrainContext returns a context bounded by the drain timeout. A drain
+// timeout of 0 means no timeout.
+func newDrainContext() (context.Context, context.CancelFunc) {
+	if globalFlags.DrainTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), globalFlags.DrainTimeout)
+}
+
+// uncordonNode uncordons the Kubernetes node of this machine after a reboot,
+// if locksmithd cordoned it.
+func uncordonNode() error {
+	kc, err := getKubernetesClient()
+	if err != nil {
+		return fmt.Errorf("error initializing Kubernetes client: %v", err)
+	}
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	return uncordon(ctx, kc, nodeName())
+}
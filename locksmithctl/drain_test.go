@@ -0,0 +1,241 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/k8s"
+)
+
+// fakeKubernetes is an in-memory Kubernetes API server serving a single
+// node and its pods. Evictions of pods listed in pdb are refused that many
+// times before they succeed.
+type fakeKubernetes struct {
+	mu      sync.Mutex
+	node    map[string]interface{}
+	pods    map[string]k8s.Pod
+	pdb     map[string]int
+	evicted []string
+}
+
+func newFakeKubernetes(pods ...k8s.Pod) *fakeKubernetes {
+	f := &fakeKubernetes{
+		node: map[string]interface{}{"metadata": map[string]interface{}{"name": "core-01"}, "spec": map[string]interface{}{}},
+		pods: make(map[string]k8s.Pod),
+		pdb:  make(map[string]int),
+	}
+	for _, pod := range pods {
+		f.pods[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = pod
+	}
+	return f
+}
+
+// merge applies the JSON merge patch to obj.
+func merge(obj, patch map[string]interface{}) {
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(obj, k)
+		case map[string]interface{}:
+			sub, ok := obj[k].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				obj[k] = sub
+			}
+			merge(sub, v)
+		default:
+			obj[k] = v
+		}
+	}
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","message":"not found","reason":"NotFound","code":404}`))
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	switch {
+	case r.URL.Path == "/api/v1/nodes/core-01" && r.Method == "GET":
+		json.NewEncoder(w).Encode(f.node)
+	case r.URL.Path == "/api/v1/nodes/core-01" && r.Method == "PATCH":
+		var patch map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&patch)
+		merge(f.node, patch)
+		json.NewEncoder(w).Encode(f.node)
+	case r.URL.Path == "/api/v1/pods" && r.URL.Query().Get("fieldSelector") == "spec.nodeName=core-01":
+		var list struct {
+			Items []k8s.Pod `json:"items"`
+		}
+		for _, pod := range f.pods {
+			list.Items = append(list.Items, pod)
+		}
+		json.NewEncoder(w).Encode(list)
+	case len(parts) == 5 && parts[2] == "pods" && r.Method == "GET":
+		pod, ok := f.pods[parts[1]+"/"+parts[3]]
+		if !ok {
+			notFound()
+			return
+		}
+		json.NewEncoder(w).Encode(pod)
+	case len(parts) == 5 && parts[4] == "eviction" && r.Method == "POST":
+		key := parts[1] + "/" + parts[3]
+		if _, ok := f.pods[key]; !ok {
+			notFound()
+			return
+		}
+		if f.pdb[key] > 0 {
+			f.pdb[key]--
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"kind":"Status","message":"Cannot evict pod as it would violate the pod's disruption budget.","reason":"TooManyRequests","code":429}`))
+			return
+		}
+		delete(f.pods, key)
+		f.evicted = append(f.evicted, key)
+		w.Write([]byte(`{"kind":"Status","status":"Success","code":201}`))
+	default:
+		notFound()
+	}
+}
+
+func (f *fakeKubernetes) unschedulable() (bool, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	spec := f.node["spec"].(map[string]interface{})
+	annotations, _ := f.node["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	_, annotated := annotations[drainedAnnotation]
+	unschedulable, _ := spec["unschedulable"].(bool)
+	return unschedulable, annotated
+}
+
+func newPod(namespace, name, phase string, owner string, annotations map[string]string) k8s.Pod {
+	pod := k8s.Pod{
+		Metadata: k8s.ObjectMeta{Name: name, Namespace: namespace, UID: namespace + "-" + name, Annotations: annotations},
+		Spec:     k8s.PodSpec{NodeName: "core-01"},
+		Status:   k8s.PodStatus{Phase: phase},
+	}
+	if owner != "" {
+		pod.Metadata.OwnerReferences = []k8s.OwnerReference{{Kind: owner, Name: name}}
+	}
+	return pod
+}
+
+func TestDrain(t *testing.T) {
+	f := newFakeKubernetes(
+		newPod("default", "web-1", "Running", "ReplicaSet", nil),
+		newPod("default", "db-0", "Running", "StatefulSet", nil),
+		newPod("kube-system", "node-exporter", "Running", "DaemonSet", nil),
+		newPod("kube-system", "kube-proxy-core-01", "Running", "", map[string]string{mirrorPodAnnotation: "1"}),
+		newPod("default", "job-1", "Succeeded", "Job", nil),
+	)
+	f.pdb["default/db-0"] = 2
+
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	kc, err := k8s.New(k8s.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := drain(context.Background(), kc, "core-01", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(f.evicted)
+	if want := []string{"default/db-0", "default/web-1"}; !reflect.DeepEqual(f.evicted, want) {
+		t.Errorf("unexpected evictions: got %v want %v", f.evicted, want)
+	}
+	if unschedulable, annotated := f.unschedulable(); !unschedulable || !annotated {
+		t.Errorf("node was not cordoned: unschedulable %v annotated %v", unschedulable, annotated)
+	}
+
+	if err := uncordon(context.Background(), kc, "core-01"); err != nil {
+		t.Fatal(err)
+	}
+	if unschedulable, annotated := f.unschedulable(); unschedulable || annotated {
+		t.Errorf("node was not uncordoned: unschedulable %v annotated %v", unschedulable, annotated)
+	}
+
+	// nodes cordoned by someone else stay cordoned.
+	f.node["spec"] = map[string]interface{}{"unschedulable": true}
+	if err := drain(context.Background(), kc, "core-01", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := uncordon(context.Background(), kc, "core-01"); err != nil {
+		t.Fatal(err)
+	}
+	if unschedulable, _ := f.unschedulable(); !unschedulable {
+		t.Error("node cordoned by someone else was uncordoned")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	f := newFakeKubernetes(newPod("default", "db-0", "Running", "StatefulSet", nil))
+	f.pdb["default/db-0"] = 1000
+
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	kc, err := k8s.New(k8s.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := drain(ctx, kc, "core-01", time.Millisecond); err == nil || !strings.Contains(err.Error(), "1 pods were not evicted") {
+		t.Errorf("expected the drain to time out, got %v", err)
+	}
+	if len(f.evicted) != 0 {
+		t.Errorf("pod protected by a disruption budget was evicted: %v", f.evicted)
+	}
+}
+
+func TestNewDrainContext(t *testing.T) {
+	defer func(d time.Duration) { globalFlags.DrainTimeout = d }(globalFlags.DrainTimeout)
+
+	for i, tt := range []struct {
+		timeout  time.Duration
+		deadline bool
+	}{
+		{0, false},
+		{time.Minute, true},
+	} {
+		globalFlags.DrainTimeout = tt.timeout
+		ctx, cancel := newDrainContext()
+		if _, ok := ctx.Deadline(); ok != tt.deadline {
+			t.Errorf("case %d: deadline set: %v, want %v", i, ok, tt.deadline)
+		}
+		if ctx.Err() != nil {
+			t.Errorf("case %d: context already done: %v", i, ctx.Err())
+		}
+		cancel()
+	}
+}
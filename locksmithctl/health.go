@@ -0,0 +1,164 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+const (
+	// healthCheckInterval is how often failing health checks are run
+	// again.
+	healthCheckInterval = 10 * time.Second
+	// healthCheckTimeout bounds how long a single health check may take.
+	healthCheckTimeout = 30 * time.Second
+)
+
+// healthCheck is a check which must pass after a reboot before the lock is
+// released.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// healthChecks returns the health checks configured with the --health-*
+// flags.
+func healthChecks() ([]healthCheck, error) {
+	var checks []healthCheck
+
+	if units := splitList(globalFlags.HealthUnits); len(units) > 0 {
+		conn, err := dbus.New()
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to systemd: %v", err)
+		}
+		for _, unit := range units {
+			checks = append(checks, unitCheck(conn, unit))
+		}
+	}
+
+	hc := &http.Client{Timeout: healthCheckTimeout}
+	for _, url := range splitList(globalFlags.HealthURLs) {
+		checks = append(checks, httpCheck(hc, url))
+	}
+
+	for _, addr := range splitList(globalFlags.HealthPorts) {
+		checks = append(checks, tcpCheck(addr))
+	}
+
+	if globalFlags.HealthCommand != "" {
+		checks = append(checks, commandCheck(globalFlags.HealthCommand))
+	}
+
+	return checks, nil
+}
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// unitCheck passes if the systemd unit is active.
+func unitCheck(conn *dbus.Conn, unit string) healthCheck {
+	return healthCheck{"unit " + unit, func() error {
+		p, err := conn.GetUnitProperty(unit, "ActiveState")
+		if err != nil {
+			return err
+		}
+
+		if state, _ := p.Value.Value().(string); state != "active" {
+			return fmt.Errorf("unit is %s", state)
+		}
+		return nil
+	}}
+}
+
+// httpCheck passes if a GET request of url responds with a 2xx status.
+func httpCheck(hc *http.Client, url string) healthCheck {
+	return healthCheck{"URL " + url, func() error {
+		resp, err := hc.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	}}
+}
+
+// tcpCheck passes if addr accepts TCP connections.
+func tcpCheck(addr string) healthCheck {
+	return healthCheck{"port " + addr, func() error {
+		conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}}
+}
+
+// commandCheck passes if the shell command exits with status 0.
+func commandCheck(command string) healthCheck {
+	return healthCheck{"command " + command, func() error {
+		return runCommand(exec.Command("/bin/sh", "-c", command), healthCheckTimeout)
+	}}
+}
+
+// waitHealthy runs the health checks every interval until all of them pass,
+// returning true. It returns false if they do not pass within deadline, or
+// if a stop signal is sent. A deadline of zero waits forever.
+func waitHealthy(checks []healthCheck, deadline, interval time.Duration, stop chan struct{}) bool {
+	var timeout <-chan time.Time
+	if deadline > 0 {
+		timeout = time.After(deadline)
+	}
+
+	for {
+		failed := false
+		for _, c := range checks {
+			if err := c.check(); err != nil {
+				dlog.Warningf("Health check of %s failed: %v", c.name, err)
+				failed = true
+				break
+			}
+		}
+		if !failed {
+			return true
+		}
+
+		select {
+		case <-stop:
+			return false
+		case <-timeout:
+			return false
+		case <-time.After(interval):
+		}
+	}
+}
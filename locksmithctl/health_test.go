@@ -0,0 +1,102 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHealthChecks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i, tt := range []struct {
+		check healthCheck
+		pass  bool
+	}{
+		{httpCheck(http.DefaultClient, srv.URL+"/healthz"), true},
+		{httpCheck(http.DefaultClient, srv.URL+"/ready"), false},
+		{tcpCheck(l.Addr().String()), true},
+		{tcpCheck("127.0.0.1:1"), false},
+		{commandCheck("test -d /"), true},
+		{commandCheck("exit 1"), false},
+	} {
+		if err := tt.check.check(); (err == nil) != tt.pass {
+			t.Errorf("case %d: %s: unexpected result: %v", i, tt.check.name, err)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	for i, tt := range []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"etcd-member.service", []string{"etcd-member.service"}},
+		{"a.service, b.service,", []string{"a.service", "b.service"}},
+	} {
+		if got := splitList(tt.s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got %q want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	failures := 0
+	flaky := healthCheck{"flaky", func() error {
+		if failures < 2 {
+			failures++
+			return errors.New("not yet")
+		}
+		return nil
+	}}
+	broken := healthCheck{"broken", func() error {
+		return errors.New("broken")
+	}}
+
+	stop := make(chan struct{})
+	if !waitHealthy([]healthCheck{flaky}, time.Minute, time.Millisecond, stop) {
+		t.Error("checks which pass eventually should be healthy")
+	}
+	if failures != 2 {
+		t.Errorf("unexpected number of failures: %d", failures)
+	}
+
+	if waitHealthy([]healthCheck{flaky, broken}, 10*time.Millisecond, time.Millisecond, stop) {
+		t.Error("checks which never pass should not be healthy")
+	}
+
+	close(stop)
+	if waitHealthy([]healthCheck{broken}, 0, time.Minute, stop) {
+		t.Error("checks should not be healthy once stopped")
+	}
+}
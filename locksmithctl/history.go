@@ -0,0 +1,149 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+var (
+	cmdHistory = &Command{
+		Name:    "history",
+		Summary: "Show the recent history of the reboot lock.",
+		Usage:   "[--since=<duration|time>] [--machine=<machine-id>]",
+		Description: `History lists the most recent locks, unlocks, forced unlocks, reclaimed leases,
+changes of the maximum, pauses and resumes of the reboot lock, oldest first,
+along with who made them and the state of the lock right after them. Only the
+latest 100 events of each group are kept.
+
+With --since, only events after the given duration ago, such as 24h, or after
+the given RFC 3339 time are shown. With --machine, only events about the given
+machine-id are shown.
+
+If several groups are given with --group, their events are merged.`,
+		Run: runHistory,
+	}
+
+	historyFlags = struct {
+		Since   string
+		Machine string
+	}{}
+)
+
+func init() {
+	cmdHistory.Flags.StringVar(&historyFlags.Since, "since", "", "Only show events after this duration ago or this RFC 3339 time.")
+	cmdHistory.Flags.StringVar(&historyFlags.Machine, "machine", "", "Only show events about this machine-id.")
+}
+
+// groupEvent is an event in the history of the semaphore of a group.
+type groupEvent struct {
+	group string
+	*lock.Event
+}
+
+// byTime sorts events by the time they happened.
+type byTime []groupEvent
+
+func (e byTime) Len() int           { return len(e) }
+func (e byTime) Less(i, j int) bool { return e[i].Time < e[j].Time }
+func (e byTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// parseSince parses the --since flag of history, either a duration before now
+// or an RFC 3339 time. The empty string yields the zero time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("duration %v is not positive", d)
+		}
+		return now.Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a duration nor an RFC 3339 time", s)
+	}
+
+	return t, nil
+}
+
+// filterEvents returns the events of group at or after since which are
+// about machine. An empty machine matches all events.
+func filterEvents(group string, events []*lock.Event, since time.Time, machine string) []groupEvent {
+	var filtered []groupEvent
+	for _, e := range events {
+		if e.Time < since.Unix() || (machine != "" && e.Machine != machine) {
+			continue
+		}
+		filtered = append(filtered, groupEvent{group, e})
+	}
+
+	return filtered
+}
+
+func runHistory(args []string) (exit int) {
+	since, err := parseSince(historyFlags.Since, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid --since:", err)
+		return 1
+	}
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	clients, err := getClients(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+
+	gs := groups()
+	var events []groupEvent
+	for i, elc := range clients {
+		sem, err := lock.New("", elc).GetContext(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting value:", err)
+			return 1
+		}
+
+		events = append(events, filterEvents(gs[i], sem.History, since, historyFlags.Machine)...)
+	}
+	sort.Stable(byTime(events))
+
+	header := "TIME\tEVENT\tMACHINE ID\tACTOR\tAVAILABLE\tMAX\tHOLDERS\tREASON"
+	if len(clients) > 1 {
+		header = "TIME\tGROUP\tEVENT\tMACHINE ID\tACTOR\tAVAILABLE\tMAX\tHOLDERS\tREASON"
+	}
+	fmt.Fprintln(out, header)
+	for _, e := range events {
+		t := time.Unix(e.Time, 0).UTC().Format(time.RFC3339)
+		if len(clients) > 1 {
+			t += fmt.Sprintf("\t%q", e.group)
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", t, e.Type, orDash(e.Machine), orDash(e.Actor), e.Semaphore, e.Max, orDash(strings.Join(e.Holders, ",")), orDash(e.Reason))
+	}
+	out.Flush()
+
+	return 0
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/coreos/locksmith/pkg/machineid"
+)
+
+const (
+	// hookPreReboot and hookPostReboot are the kinds of hooks passed to
+	// hooks in LOCKSMITH_HOOK.
+	hookPreReboot  = "pre-reboot"
+	hookPostReboot = "post-reboot"
+)
+
+// hookEnv returns the environment hooks of the given kind run with: the
+// environment of locksmithd, along with a description of the update.
+func hookEnv(hook, strategy, version string) []string {
+	return append(os.Environ(),
+		"LOCKSMITH_HOOK="+hook,
+		"LOCKSMITH_MACHINE_ID="+machineid.MachineID("/"),
+		"LOCKSMITH_GROUP="+globalFlags.Group,
+		"LOCKSMITH_STRATEGY="+strategy,
+		"LOCKSMITH_NEW_VERSION="+version,
+	)
+}
+
+// runHooks runs the executables in dir in lexical order with the given
+// environment, stopping at the first one which fails or does not finish
+// within timeout. A timeout of zero lets hooks run forever. A missing dir
+// has no hooks.
+func runHooks(dir string, env []string, timeout time.Duration) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		path := filepath.Join(dir, fi.Name())
+
+		// follow symlinks, so hooks can be linked into place.
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+			continue
+		}
+
+		dlog.Infof("Running hook %s", path)
+		if err := runHook(path, env, timeout); err != nil {
+			return fmt.Errorf("hook %s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+// runHook runs the executable at path, see runCommand.
+func runHook(path string, env []string, timeout time.Duration) error {
+	cmd := exec.Command(path)
+	cmd.Env = env
+	return runCommand(cmd, timeout)
+}
+
+// runCommand runs cmd with the output of locksmithd, killing it along with
+// the processes it started if it does not finish within timeout.
+func runCommand(cmd *exec.Cmd, timeout time.Duration) error {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	if timeout <= 0 {
+		return <-done
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
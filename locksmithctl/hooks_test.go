@@ -0,0 +1,82 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	hooks := filepath.Join(dir, "hooks.d")
+	if err := os.Mkdir(hooks, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeHook := func(name, script string, mode os.FileMode) {
+		if err := ioutil.WriteFile(filepath.Join(hooks, name), []byte("#!/bin/sh\n"+script+"\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeHook("20-second", `echo "second $LOCKSMITH_HOOK" >> `+out, 0755)
+	writeHook("10-first", `echo "first $LOCKSMITH_NEW_VERSION" >> `+out, 0755)
+	writeHook("15-disabled", `echo disabled >> `+out, 0644)
+
+	env := []string{"LOCKSMITH_HOOK=pre-reboot", "LOCKSMITH_NEW_VERSION=1465.6.0"}
+	if err := runHooks(hooks, env, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "first 1465.6.0\nsecond pre-reboot\n"; string(b) != want {
+		t.Errorf("unexpected hook output: got %q want %q", b, want)
+	}
+
+	// the first failing hook stops the others from running.
+	os.Remove(out)
+	writeHook("12-fail", "exit 3", 0755)
+	if err := runHooks(hooks, env, time.Minute); err == nil || !strings.Contains(err.Error(), "12-fail") {
+		t.Errorf("expected the failing hook to be reported, got %v", err)
+	}
+	if b, _ := ioutil.ReadFile(out); string(b) != "first 1465.6.0\n" {
+		t.Errorf("hooks after the failing one ran: %q", b)
+	}
+
+	writeHook("12-fail", "sleep 10", 0755)
+	start := time.Now()
+	if err := runHooks(hooks, env, 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the hook to time out, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("hook was not killed after its timeout, took %v", d)
+	}
+
+	if err := runHooks(filepath.Join(dir, "missing"), env, time.Minute); err != nil {
+		t.Errorf("a missing hook directory should have no hooks, got %v", err)
+	}
+}
@@ -20,27 +20,54 @@ import (
 
 	"github.com/coreos/locksmith/lock"
 	"github.com/coreos/locksmith/pkg/machineid"
+	"golang.org/x/net/context"
 )
 
 var (
 	cmdLock = &Command{
 		Name:    "lock",
 		Summary: "Lock this machine or a given machine-id for reboot.",
-		Usage:   "<machine-id>",
+		Usage:   "[--wait] [--reason=<reason>] [--print-token] <machine-id>",
 		Description: `Lock is for manual locking of the reboot lock for this machine or a given
-machine-id. Under normal operation this should not be necessary.`,
+machine-id. Under normal operation this should not be necessary.
+
+With --wait, lock blocks until the lock becomes available.
+
+With --print-token, the fencing token of the acquisition is printed. The token
+is higher than that of any earlier acquisition of the lock, and can be checked
+with "locksmithctl validate-token" to tell whether the holder still owns the
+lock.
+
+If several groups are given with --group, the lock is taken in all of them or
+in none, and --print-token prints one token per group, in sorted group order.`,
 		Run: runLock,
 	}
+
+	lockFlags = struct {
+		Wait       bool
+		Reason     string
+		PrintToken bool
+	}{}
 )
 
+func init() {
+	cmdLock.Flags.StringVar(&lockFlags.Reason, "reason", "", "Reason for taking the lock, shown by status.")
+	cmdLock.Flags.BoolVar(&lockFlags.PrintToken, "print-token", false, "Print the fencing token of the acquisition.")
+	cmdLock.Flags.BoolVar(&lockFlags.Wait, "wait", false, "Block until the lock is acquired instead of failing if it is held. --timeout does not apply while waiting.")
+}
+
 func runLock(args []string) (exit int) {
-	elc, err := getClient()
+	ctx, cancel := newContext()
+	defer cancel()
+
+	clients, err := getClients(ctx)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
 		return 1
 	}
 
 	var mID string
+	info := lock.Holder{Reason: lockFlags.Reason}
 
 	if len(args) == 0 {
 		mID = machineid.MachineID("/")
@@ -48,17 +75,33 @@ func runLock(args []string) (exit int) {
 			fmt.Fprintln(os.Stderr, "Cannot read machine-id")
 			return 1
 		}
+		// the hostname is only known when locking this machine.
+		info.Hostname, _ = os.Hostname()
 	} else {
 		mID = args[0]
 	}
 
-	l := lock.New(mID, elc)
+	l := lock.NewMulti(mID, clients...)
+	l.SetTTL(globalFlags.LeaseTTL)
+	l.SetInfo(info)
+	l.SetActor(actor())
 
-	err = l.Lock()
+	var tokens []uint64
+	if lockFlags.Wait {
+		tokens, err = l.Acquire(context.Background())
+	} else {
+		tokens, err = l.Lock(ctx)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error locking:", err)
 		return 1
 	}
 
+	if lockFlags.PrintToken {
+		for _, token := range tokens {
+			fmt.Println(token)
+		}
+	}
+
 	return 0
 }
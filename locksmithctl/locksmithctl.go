@@ -24,19 +24,32 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	"github.com/coreos/locksmith/lock"
+	"github.com/coreos/locksmith/pkg/consul"
+	"github.com/coreos/locksmith/pkg/etcdv3"
+	"github.com/coreos/locksmith/pkg/k8s"
 	"github.com/coreos/locksmith/version"
 
 	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
 )
 
 const (
 	cliName        = "locksmithctl"
 	cliDescription = `Manage the cluster wide reboot lock.`
+
+	etcdAPIv2 = "v2"
+	etcdAPIv3 = "v3"
+
+	backendEtcd       = "etcd"
+	backendKubernetes = "kubernetes"
+	backendFile       = "file"
+	backendConsul     = "consul"
 )
 
 var (
@@ -46,15 +59,46 @@ var (
 	globalFlagSet = flag.NewFlagSet("locksmithctl", flag.ExitOnError)
 
 	globalFlags = struct {
-		Debug        bool
-		Endpoints    endpoints
-		EtcdKeyFile  string
-		EtcdCertFile string
-		EtcdCAFile   string
-		EtcdUsername string
-		EtcdPassword string
-		Group        string
-		Version      bool
+		Config             string
+		Debug              bool
+		Endpoints          endpoints
+		EtcdKeyFile        string
+		EtcdCertFile       string
+		EtcdCAFile         string
+		EtcdUsername       string
+		EtcdPassword       string
+		EtcdAPI            string
+		EtcdQuorum         bool
+		Backend            string
+		KubeServer         string
+		KubeToken          string
+		KubeCAFile         string
+		KubeNS             string
+		KubeNode           string
+		Drain              bool
+		DrainTimeout       time.Duration
+		LockDir            string
+		ConsulAddress      string
+		ConsulToken        string
+		ConsulCAFile       string
+		ConsulCertFile     string
+		ConsulKeyFile      string
+		Group              string
+		RebootStrategy     string
+		RebootWindowStart  string
+		RebootWindowLength string
+		LeaseTTL           time.Duration
+		UnlockDelay        time.Duration
+		PreRebootDir       string
+		PostRebootDir      string
+		HookTimeout        time.Duration
+		HealthUnits        string
+		HealthURLs         string
+		HealthPorts        string
+		HealthCommand      string
+		HealthDeadline     time.Duration
+		Timeout            time.Duration
+		Version            bool
 	}{}
 
 	defaultEndpoints = []string{
@@ -85,6 +129,7 @@ func init() {
 	out = new(tabwriter.Writer)
 	out.Init(os.Stdout, 0, 8, 1, '\t', 0)
 
+	globalFlagSet.StringVar(&globalFlags.Config, "config", defaultConfigPath, "YAML config file of locksmithd, whose nested keys joined with dashes name the flags to set")
 	globalFlagSet.BoolVar(&globalFlags.Debug, "debug", false, "Print out debug information to stderr.")
 	globalFlagSet.Var(&globalFlags.Endpoints, "endpoint", "etcd endpoint for locksmith. Specify multiple times to use multiple endpoints.")
 	globalFlagSet.StringVar(&globalFlags.EtcdKeyFile, "etcd-keyfile", "", "etcd key file authentication")
@@ -92,17 +137,55 @@ func init() {
 	globalFlagSet.StringVar(&globalFlags.EtcdCAFile, "etcd-cafile", "", "etcd CA file authentication")
 	globalFlagSet.StringVar(&globalFlags.EtcdUsername, "etcd-username", "", "username for secure etcd communication")
 	globalFlagSet.StringVar(&globalFlags.EtcdPassword, "etcd-password", "", "password for secure etcd communication")
-	globalFlagSet.StringVar(&globalFlags.Group, "group", "", "locksmith group")
+	globalFlagSet.StringVar(&globalFlags.EtcdAPI, "etcd-api", etcdAPIv2, "etcd API version to store the lock with, v2 or v3")
+	globalFlagSet.BoolVar(&globalFlags.EtcdQuorum, "etcd-quorum", true, "only let etcd members take the lock while the etcd cluster keeps quorum without them")
+	globalFlagSet.StringVar(&globalFlags.Backend, "backend", backendEtcd, "Where to store the lock, etcd, kubernetes, file or consul")
+	globalFlagSet.StringVar(&globalFlags.KubeServer, "kubernetes-server", "", "Kubernetes API server URL. If unset, the in-cluster configuration of the pod is used.")
+	globalFlagSet.StringVar(&globalFlags.KubeToken, "kubernetes-token-file", "", "file containing the bearer token for the Kubernetes API server")
+	globalFlagSet.StringVar(&globalFlags.KubeCAFile, "kubernetes-cafile", "", "Kubernetes API server CA file")
+	globalFlagSet.StringVar(&globalFlags.KubeNS, "kubernetes-namespace", "kube-system", "Kubernetes namespace to store the lock in")
+	globalFlagSet.StringVar(&globalFlags.KubeNode, "kubernetes-node", "", "name of the Kubernetes node of the machine, defaults to the hostname")
+	globalFlagSet.BoolVar(&globalFlags.Drain, "drain", false, "drain the Kubernetes node of the machine after taking the lock and before rebooting, and uncordon it after the reboot")
+	globalFlagSet.DurationVar(&globalFlags.DrainTimeout, "drain-timeout", 10*time.Minute, "How long draining the Kubernetes node may take before the reboot is put off. 0 means no timeout.")
+	globalFlagSet.StringVar(&globalFlags.LockDir, "lock-dir", "/var/lib/locksmith", "directory to store the lock in with the file backend. Share it between hosts to coordinate them.")
+	globalFlagSet.StringVar(&globalFlags.ConsulAddress, "consul-address", "http://127.0.0.1:8500", "Consul agent URL")
+	globalFlagSet.StringVar(&globalFlags.ConsulToken, "consul-token", "", "Consul ACL token")
+	globalFlagSet.StringVar(&globalFlags.ConsulCAFile, "consul-cafile", "", "Consul CA file authentication")
+	globalFlagSet.StringVar(&globalFlags.ConsulCertFile, "consul-certfile", "", "Consul cert file authentication")
+	globalFlagSet.StringVar(&globalFlags.ConsulKeyFile, "consul-keyfile", "", "Consul key file authentication")
+	globalFlagSet.StringVar(&globalFlags.Group, "group", "", "locksmith group, or a comma-separated list of groups to hold the lock in all at once")
+	globalFlagSet.StringVar(&globalFlags.RebootStrategy, "reboot-strategy", StrategyReboot, "How locksmithd reboots the machine after an update: reboot, etcd-lock or off")
+	globalFlagSet.StringVar(&globalFlags.RebootWindowStart, "reboot-window-start", "", "start of the window locksmithd may reboot the machine in, such as \"Thu 04:00\" or \"04:00\" for every day")
+	globalFlagSet.StringVar(&globalFlags.RebootWindowLength, "reboot-window-length", "", "length of the reboot window, such as \"1h30m\"")
+	globalFlagSet.DurationVar(&globalFlags.LeaseTTL, "lease-ttl", 0, "How long a lock is held without renewal before other machines may reclaim it. 0 means locks never expire.")
+	globalFlagSet.DurationVar(&globalFlags.UnlockDelay, "unlock-delay", 0, "How long locksmithd keeps the lock after the machine booted, before letting the next machine reboot.")
+	globalFlagSet.StringVar(&globalFlags.PreRebootDir, "pre-reboot-dir", "/etc/locksmith/pre-reboot.d", "directory of executables locksmithd runs before rebooting")
+	globalFlagSet.StringVar(&globalFlags.PostRebootDir, "post-reboot-dir", "/etc/locksmith/post-reboot.d", "directory of executables locksmithd runs after rebooting, before releasing the lock")
+	globalFlagSet.DurationVar(&globalFlags.HookTimeout, "hook-timeout", 5*time.Minute, "How long each pre- or post-reboot hook may run. 0 means no timeout.")
+	globalFlagSet.StringVar(&globalFlags.HealthUnits, "health-units", "", "comma-separated systemd units which must be active after a reboot before locksmithd releases the lock")
+	globalFlagSet.StringVar(&globalFlags.HealthURLs, "health-urls", "", "comma-separated URLs which must respond with a 2xx status after a reboot before locksmithd releases the lock")
+	globalFlagSet.StringVar(&globalFlags.HealthPorts, "health-ports", "", "comma-separated host:port addresses which must accept TCP connections after a reboot before locksmithd releases the lock")
+	globalFlagSet.StringVar(&globalFlags.HealthCommand, "health-command", "", "shell command which must exit with status 0 after a reboot before locksmithd releases the lock")
+	globalFlagSet.DurationVar(&globalFlags.HealthDeadline, "health-deadline", 30*time.Minute, "How long the health checks may fail after a reboot before locksmithd gives up and keeps the lock. 0 means no deadline.")
+	globalFlagSet.DurationVar(&globalFlags.Timeout, "timeout", time.Minute, "Timeout for each operation on the lock. 0 means no timeout.")
 	globalFlagSet.BoolVar(&globalFlags.Version, "version", false, "Print the version and exit.")
 
 	commands = []*Command{
+		cmdConfig,
 		cmdHelp,
+		cmdHistory,
 		cmdLock,
+		cmdMembers,
+		cmdMigrate,
+		cmdPause,
 		cmdReboot,
+		cmdResume,
 		cmdSendNeedReboot,
 		cmdSetMax,
+		cmdSetRate,
 		cmdStatus,
 		cmdUnlock,
+		cmdValidateToken,
 	}
 }
 
@@ -132,10 +215,6 @@ func main() {
 	globalFlagSet.Parse(os.Args[1:])
 	var args = globalFlagSet.Args()
 
-	if len(globalFlags.Endpoints) == 0 {
-		globalFlags.Endpoints = defaultEndpoints
-	}
-
 	progName := path.Base(os.Args[0])
 
 	if globalFlags.Version {
@@ -144,7 +223,6 @@ func main() {
 	}
 
 	if progName == "locksmithd" {
-		flagsFromEnv("LOCKSMITHD", globalFlagSet)
 		os.Exit(runDaemon())
 	}
 
@@ -153,7 +231,13 @@ func main() {
 		args = append(args, "help")
 	}
 
-	flagsFromEnv("LOCKSMITHCTL", globalFlagSet)
+	// config loads the configuration of locksmithd instead.
+	if args[0] != cmdConfig.Name {
+		flagsFromEnv("LOCKSMITHCTL", globalFlagSet)
+		if len(globalFlags.Endpoints) == 0 {
+			globalFlags.Endpoints = defaultEndpoints
+		}
+	}
 
 	var cmd *Command
 
@@ -178,9 +262,122 @@ func main() {
 	os.Exit(cmd.Run(cmd.Flags.Args()))
 }
 
-// getLockClient returns an initialized EtcdLockClient, using an etcd
-// client configured from the global etcd flags
-func getClient() (*lock.EtcdLockClient, error) {
+// newContext returns a context bounded by the --timeout flag.
+func newContext() (context.Context, context.CancelFunc) {
+	if globalFlags.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), globalFlags.Timeout)
+}
+
+// groups returns the groups given with the --group flag. The flag takes a
+// comma-separated list; an empty entry stands for the default group. The
+// groups are sorted, so that every machine takes their semaphores in the same
+// order.
+func groups() []string {
+	seen := make(map[string]bool)
+	var groups []string
+	for _, g := range strings.Split(globalFlags.Group, ",") {
+		g = strings.TrimSpace(g)
+		if !seen[g] {
+			seen[g] = true
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+
+	return groups
+}
+
+// getClient returns an initialized lock.LockClient for the group given with
+// the --group flag, using an etcd client configured from the global etcd
+// flags. It fails if more than one group is given.
+func getClient(ctx context.Context) (lock.LockClient, error) {
+	g := groups()
+	if len(g) != 1 {
+		return nil, fmt.Errorf("a single group is required, got %q", globalFlags.Group)
+	}
+
+	return newClient(ctx, g[0])
+}
+
+// getClients returns an initialized lock.LockClient for each group given with
+// the --group flag, in the order returned by groups.
+func getClients(ctx context.Context) ([]lock.LockClient, error) {
+	var clients []lock.LockClient
+	for _, g := range groups() {
+		elc, err := newClient(ctx, g)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, elc)
+	}
+
+	return clients, nil
+}
+
+// newClient returns an initialized lock.LockClient for group, stored in the
+// backend selected by the --backend flag.
+func newClient(ctx context.Context, group string) (lock.LockClient, error) {
+	switch globalFlags.Backend {
+	case backendEtcd:
+		return newEtcdClient(ctx, group)
+	case backendKubernetes:
+		kc, err := getKubernetesClient()
+		if err != nil {
+			return nil, err
+		}
+
+		return lock.NewKubernetesLockClient(ctx, kc, globalFlags.KubeNS, group)
+	case backendFile:
+		return lock.NewFileLockClient(ctx, globalFlags.LockDir, group)
+	case backendConsul:
+		cc, err := getConsulClient()
+		if err != nil {
+			return nil, err
+		}
+
+		return lock.NewConsulLockClient(ctx, cc, group)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", globalFlags.Backend)
+	}
+}
+
+// newEtcdClient returns an initialized lock.LockClient for group, using an
+// etcd client configured from the global etcd flags. The etcd API version
+// used is selected by the --etcd-api flag.
+func newEtcdClient(ctx context.Context, group string) (lock.LockClient, error) {
+	switch globalFlags.EtcdAPI {
+	case etcdAPIv2:
+		kapi, err := getKeysAPI()
+		if err != nil {
+			return nil, err
+		}
+
+		return lock.NewEtcdLockClientContext(ctx, kapi, group)
+	case etcdAPIv3:
+		kv, err := getV3Client()
+		if err != nil {
+			return nil, err
+		}
+
+		return lock.NewEtcdV3LockClient(ctx, kv, group)
+	default:
+		return nil, fmt.Errorf("unknown etcd API version %q", globalFlags.EtcdAPI)
+	}
+}
+
+// getTransport returns an http.Transport configured from the global etcd TLS
+// flags.
+func getTransport() (*http.Transport, error) {
+	return newTransport(globalFlags.EtcdCAFile, globalFlags.EtcdCertFile, globalFlags.EtcdKeyFile)
+}
+
+// newTransport returns an http.Transport trusting the CA in caFile, if given,
+// and authenticating with the client certificate in certFile and keyFile, if
+// given. The default TLS configuration is used if none of the files is given.
+func newTransport(caFile, certFile, keyFile string) (*http.Transport, error) {
 	// copy of github.com/coreos/etcd/client.DefaultTransport so that
 	// TLSClientConfig can be overridden.
 	transport := &http.Transport{
@@ -192,28 +389,49 @@ func getClient() (*lock.EtcdLockClient, error) {
 		TLSHandshakeTimeout: 10 * time.Second,
 	}
 
-	if globalFlags.EtcdCAFile != "" || globalFlags.EtcdCertFile != "" || globalFlags.EtcdKeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(globalFlags.EtcdCertFile, globalFlags.EtcdKeyFile)
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return transport, nil
+	}
+
+	tlsconf := &tls.Config{}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both a certificate file and a key file are needed for client authentication")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
 			return nil, err
 		}
 
-		ca, err := ioutil.ReadFile(globalFlags.EtcdCAFile)
+		tlsconf.Certificates = []tls.Certificate{cert}
+		tlsconf.BuildNameToCertificate()
+	}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
 		if err != nil {
 			return nil, err
 		}
 
 		capool := x509.NewCertPool()
-		capool.AppendCertsFromPEM(ca)
-
-		tlsconf := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      capool,
+		if !capool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
 		}
 
-		tlsconf.BuildNameToCertificate()
+		tlsconf.RootCAs = capool
+	}
+
+	transport.TLSClientConfig = tlsconf
+
+	return transport, nil
+}
 
-		transport.TLSClientConfig = tlsconf
+// getKeysAPI returns an etcd v2 KeysAPI configured from the global etcd flags.
+func getKeysAPI() (client.KeysAPI, error) {
+	transport, err := getTransport()
+	if err != nil {
+		return nil, err
 	}
 
 	cfg := client.Config{
@@ -228,13 +446,81 @@ func getClient() (*lock.EtcdLockClient, error) {
 		return nil, err
 	}
 
-	kapi := client.NewKeysAPI(ec)
+	return client.NewKeysAPI(ec), nil
+}
 
-	lc, err := lock.NewEtcdLockClient(kapi, globalFlags.Group)
+// getV3Client returns an etcd v3 client configured from the global etcd flags.
+func getV3Client() (*etcdv3.Client, error) {
+	transport, err := getTransport()
 	if err != nil {
 		return nil, err
 	}
-	return lc, err
+
+	return etcdv3.New(etcdv3.Config{
+		Endpoints: globalFlags.Endpoints,
+		Transport: transport,
+		Username:  globalFlags.EtcdUsername,
+		Password:  globalFlags.EtcdPassword,
+	})
+}
+
+// getKubernetesClient returns a Kubernetes client configured from the global
+// Kubernetes flags, or from the in-cluster configuration if no server is
+// given.
+func getKubernetesClient() (*k8s.Client, error) {
+	if globalFlags.KubeServer == "" {
+		cfg, err := k8s.InClusterConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		return k8s.New(cfg)
+	}
+
+	transport, err := k8s.NewTransport(globalFlags.KubeCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := k8s.Config{
+		Host:      globalFlags.KubeServer,
+		Transport: transport,
+	}
+
+	if globalFlags.KubeToken != "" {
+		token, err := ioutil.ReadFile(globalFlags.KubeToken)
+		if err != nil {
+			return nil, err
+		}
+		cfg.BearerToken = strings.TrimSpace(string(token))
+	}
+
+	return k8s.New(cfg)
+}
+
+// getConsulClient returns a Consul client configured from the global Consul
+// flags.
+func getConsulClient() (*consul.Client, error) {
+	transport, err := newTransport(globalFlags.ConsulCAFile, globalFlags.ConsulCertFile, globalFlags.ConsulKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return consul.New(consul.Config{
+		Address:   globalFlags.ConsulAddress,
+		Transport: transport,
+		Token:     globalFlags.ConsulToken,
+	})
+}
+
+// actor returns who is recorded in the history of the lock as having made the
+// changes of a command: the user running it and the host it runs on.
+func actor() string {
+	hostname, _ := os.Hostname()
+	if user := os.Getenv("USER"); user != "" {
+		return user + "@" + hostname
+	}
+	return hostname
 }
 
 // flagsFromEnv parses all registered flags in the given flagSet,
@@ -0,0 +1,180 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+func TestGroups(t *testing.T) {
+	defer func(g string) { globalFlags.Group = g }(globalFlags.Group)
+
+	for i, tt := range []struct {
+		flag string
+		want []string
+	}{
+		{"", []string{""}},
+		{"lb", []string{"lb"}},
+		{"zone-a,rack-12", []string{"rack-12", "zone-a"}},
+		{"rack-12, zone-a,", []string{"", "rack-12", "zone-a"}},
+		{"rack-12,rack-12", []string{"rack-12"}},
+	} {
+		globalFlags.Group = tt.flag
+		if got := groups(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got %q want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "locksmith-transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the certificate of the test server is self-signed.
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.TLS.Certificates[0].Certificate[0]})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalidFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		ca, cert, key string
+		err           bool
+	}{
+		{"", "", "", false},
+		{caFile, "", "", false},
+		{invalidFile, "", "", true},
+		{filepath.Join(dir, "missing.pem"), "", "", true},
+		{caFile, filepath.Join(dir, "cert.pem"), "", true},
+		{"", "", filepath.Join(dir, "key.pem"), true},
+	} {
+		tr, err := newTransport(tt.ca, tt.cert, tt.key)
+		if (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected error state: %v", i, err)
+			continue
+		}
+		if err != nil || tt.ca == "" {
+			continue
+		}
+
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err != nil {
+			t.Errorf("case %d: request trusting the CA failed: %v", i, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestParseUntil(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, tt := range []struct {
+		s    string
+		want time.Time
+		err  bool
+	}{
+		{"", time.Time{}, false},
+		{"2h", now.Add(2 * time.Hour), false},
+		{"2017-06-01T18:00:00Z", time.Date(2017, 6, 1, 18, 0, 0, 0, time.UTC), false},
+		{"-1h", time.Time{}, true},
+		{"2017-06-01T06:00:00Z", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+	} {
+		got, err := parseUntil(tt.s, now)
+		if (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected error state: %v", i, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("case %d: got %v want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for i, tt := range []struct {
+		s        string
+		reboots  int
+		interval time.Duration
+		err      bool
+	}{
+		{"6/1h", 6, time.Hour, false},
+		{"1/30m", 1, 30 * time.Minute, false},
+		{"off", 0, 0, false},
+		{"0/1h", 0, 0, true},
+		{"6", 0, 0, true},
+		{"6/hour", 0, 0, true},
+	} {
+		reboots, interval, err := parseRate(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected error state: %v", i, err)
+			continue
+		}
+		if reboots != tt.reboots || interval != tt.interval {
+			t.Errorf("case %d: got %d/%v want %d/%v", i, reboots, interval, tt.reboots, tt.interval)
+		}
+	}
+}
+
+func TestFilterEvents(t *testing.T) {
+	events := []*lock.Event{
+		{Type: lock.EventLock, Time: 100, Machine: "a"},
+		{Type: lock.EventSetMax, Time: 200},
+		{Type: lock.EventUnlock, Time: 300, Machine: "a"},
+		{Type: lock.EventLock, Time: 400, Machine: "b"},
+	}
+
+	for i, tt := range []struct {
+		since   time.Time
+		machine string
+		want    []string
+	}{
+		{time.Time{}, "", []string{"lock", "set-max", "unlock", "lock"}},
+		{time.Unix(200, 0), "", []string{"set-max", "unlock", "lock"}},
+		{time.Time{}, "a", []string{"lock", "unlock"}},
+		{time.Unix(350, 0), "a", nil},
+	} {
+		var got []string
+		for _, e := range filterEvents("db", events, tt.since, tt.machine) {
+			if e.group != "db" {
+				t.Errorf("case %d: unexpected group %q", i, e.group)
+			}
+			got = append(got, e.Type)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("case %d: got %v want %v", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/coreos/locksmith/lock"
+	"github.com/coreos/locksmith/updateengine"
+)
+
+var (
+	cmdMembers = &Command{
+		Name:    "members",
+		Summary: "List the machines registered in the group.",
+		Description: `Members lists the machines which registered themselves in the group, along with
+their hostname, OS version, reboot strategy, the current operation of their
+update engine, and how long ago they last sent a heartbeat.
+
+locksmithd registers machines using the etcd-lock strategy, and sends a
+heartbeat every minute. Machines which have not sent a heartbeat for 5 minutes
+are shown as not alive, and are removed after a day.
+
+If several groups are given with --group, the members of each group are shown.`,
+		Run: runMembers,
+	}
+)
+
+func printMembers(sem *lock.Semaphore) {
+	now := time.Now()
+
+	var ids []string
+	for id := range sem.Members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Fprintln(out, "MACHINE ID\tHOSTNAME\tVERSION\tSTRATEGY\tOPERATION\tLAST SEEN\tALIVE\tNEEDS REBOOT")
+	for _, id := range ids {
+		m := sem.Members[id]
+		d := now.Sub(time.Unix(m.LastHeartbeat, 0))
+		needsReboot := m.Operation == updateengine.UpdateStatusUpdatedNeedReboot
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s ago\t%t\t%t\n", id, orDash(m.Hostname), orDash(m.Version), orDash(m.Strategy), orDash(m.Operation), d-d%time.Second, m.Alive(now), needsReboot)
+	}
+	out.Flush()
+}
+
+func runMembers(args []string) (exit int) {
+	ctx, cancel := newContext()
+	defer cancel()
+
+	clients, err := getClients(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+
+	gs := groups()
+	for i, elc := range clients {
+		sem, err := lock.New("", elc).GetContext(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting value:", err)
+			return 1
+		}
+
+		if len(clients) > 1 {
+			if i > 0 {
+				fmt.Println("")
+			}
+			fmt.Printf("Group: %q\n", gs[i])
+		}
+
+		printMembers(sem)
+	}
+
+	return 0
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+var (
+	cmdMigrate = &Command{
+		Name:    "migrate",
+		Summary: "Copy the reboot locks from the etcd v2 API to the v3 API.",
+		Description: `Migrate copies the semaphores of all groups from the etcd v2 store into the
+etcd v3 store, so that machines can switch to --etcd-api=v3. Keys which already
+exist in the v3 store are not overwritten, so migrate can safely be run more
+than once. Locks taken through the v2 API after the migration are not copied.`,
+		Run: runMigrate,
+	}
+)
+
+func runMigrate(args []string) int {
+	ctx, cancel := newContext()
+	defer cancel()
+
+	kapi, err := getKeysAPI()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd v2 client:", err)
+		return 1
+	}
+
+	kv, err := getV3Client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd v3 client:", err)
+		return 1
+	}
+
+	keys, err := lock.MigrateV2ToV3(ctx, kapi, kv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error migrating locks:", err)
+		return 1
+	}
+
+	for _, key := range keys {
+		fmt.Println("Migrated:", key)
+	}
+
+	return 0
+}
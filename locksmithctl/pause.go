@@ -0,0 +1,104 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+var (
+	cmdPause = &Command{
+		Name:    "pause",
+		Summary: "Stop all machines from taking the reboot lock.",
+		Usage:   "[--reason=<reason>] [--until=<duration|time>]",
+		Description: `Pause stops all machines from taking the reboot lock, e.g. during an incident,
+until it is resumed with "locksmithctl resume". Machines already holding the
+lock keep it, and the maximum number of holders is left untouched.
+
+With --until, the pause ends by itself after the given duration, such as 2h, or
+at the given RFC 3339 time, such as 2017-06-01T18:00:00Z.
+
+If several groups are given with --group, all of them are paused.`,
+		Run: runPause,
+	}
+
+	pauseFlags = struct {
+		Reason string
+		Until  string
+	}{}
+)
+
+func init() {
+	cmdPause.Flags.StringVar(&pauseFlags.Reason, "reason", "", "Reason for the pause, shown by status.")
+	cmdPause.Flags.StringVar(&pauseFlags.Until, "until", "", "End the pause after this duration or at this RFC 3339 time.")
+}
+
+// parseUntil parses the --until flag of pause, either a duration from now or
+// an RFC 3339 time. The empty string yields the zero time.
+func parseUntil(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("duration %v is not positive", d)
+		}
+		return now.Add(d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a duration nor an RFC 3339 time", s)
+	}
+	if !t.After(now) {
+		return time.Time{}, fmt.Errorf("%v is in the past", t)
+	}
+
+	return t, nil
+}
+
+func runPause(args []string) (exit int) {
+	until, err := parseUntil(pauseFlags.Until, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid --until:", err)
+		return 1
+	}
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	clients, err := getClients(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+
+	gs := groups()
+	for i, elc := range clients {
+		l := lock.New("", elc)
+		l.SetActor(actor())
+		if err := l.Pause(ctx, pauseFlags.Reason, until); err != nil {
+			fmt.Fprintf(os.Stderr, "Error pausing group %q: %v\n", gs[i], err)
+			return 1
+		}
+	}
+
+	return 0
+}
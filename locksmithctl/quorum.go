@@ -0,0 +1,266 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/lock"
+	"github.com/coreos/locksmith/updateengine"
+)
+
+// clusterStatusTTL is how long the health of the etcd cluster is cached by
+// quorumCondition, as the condition is evaluated every time the semaphore
+// changes.
+const clusterStatusTTL = 10 * time.Second
+
+var (
+	errLeaderLast = errors.New("this machine runs the etcd leader, which reboots after the other etcd members waiting to reboot")
+)
+
+// etcdMember is a member of the etcd cluster along with its state.
+type etcdMember struct {
+	client.Member
+	Healthy bool
+	Leader  bool
+}
+
+// etcdCluster inspects the members of the etcd cluster.
+type etcdCluster struct {
+	members client.MembersAPI
+	hc      *http.Client
+}
+
+// getEtcdCluster returns an etcdCluster configured from the global etcd
+// flags.
+func getEtcdCluster() (*etcdCluster, error) {
+	transport, err := getTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	ec, err := client.New(client.Config{
+		Endpoints: globalFlags.Endpoints,
+		Transport: transport,
+		Username:  globalFlags.EtcdUsername,
+		Password:  globalFlags.EtcdPassword,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdCluster{members: client.NewMembersAPI(ec), hc: &http.Client{Transport: transport}}, nil
+}
+
+// localMember returns the id of the etcd member running on this machine, or
+// the empty string if there is none. A member runs on this machine if it is
+// named after the machine id, as on CoreOS, or if it uses one of the
+// addresses of the machine as peer URL.
+func (c *etcdCluster) localMember(ctx context.Context, machineID string) (string, error) {
+	members, err := c.members.List(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	local := make(map[string]bool)
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			local[ipnet.IP.String()] = true
+		}
+	}
+
+	return findLocalMember(members, machineID, local), nil
+}
+
+// findLocalMember returns the id of the member named machineID, or using one
+// of the local addresses in a peer URL.
+func findLocalMember(members []client.Member, machineID string, local map[string]bool) string {
+	for _, m := range members {
+		if machineID != "" && m.Name == machineID {
+			return m.ID
+		}
+
+		for _, peer := range m.PeerURLs {
+			u, err := url.Parse(peer)
+			if err != nil {
+				continue
+			}
+			host, _, err := net.SplitHostPort(u.Host)
+			if err != nil {
+				host = u.Host
+			}
+			if ip := net.ParseIP(host); ip != nil && local[ip.String()] {
+				return m.ID
+			}
+		}
+	}
+
+	return ""
+}
+
+// status returns the members of the etcd cluster, along with whether they
+// are healthy and which of them is the leader.
+func (c *etcdCluster) status(ctx context.Context) ([]etcdMember, error) {
+	members, err := c.members.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]etcdMember, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		status[i].Member = m
+		wg.Add(1)
+		go func(em *etcdMember) {
+			defer wg.Done()
+			em.Healthy, em.Leader = c.probe(ctx, em.ClientURLs)
+		}(&status[i])
+	}
+	wg.Wait()
+
+	return status, nil
+}
+
+// probe checks the health of the member serving the given client URLs, and
+// whether it is the leader, through the first URL it answers on.
+func (c *etcdCluster) probe(ctx context.Context, urls []string) (healthy, leader bool) {
+	for _, u := range urls {
+		var health struct {
+			Health string `json:"health"`
+		}
+		if err := c.get(ctx, u+"/health", &health); err != nil {
+			continue
+		}
+
+		var stats struct {
+			State string `json:"state"`
+		}
+		if err := c.get(ctx, u+"/v2/stats/self", &stats); err != nil {
+			continue
+		}
+
+		return health.Health == "true", stats.State == "StateLeader"
+	}
+
+	return false, false
+}
+
+func (c *etcdCluster) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	// Request.WithContext needs go 1.7
+	req.Cancel = ctx.Done()
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// quorumCondition returns a lock.Condition letting the machine running the
+// etcd member self take the semaphore only if checkQuorum allows it. The
+// status of the cluster is fetched with status, at most every
+// clusterStatusTTL.
+func quorumCondition(status func(context.Context) ([]etcdMember, error), self string) lock.Condition {
+	var (
+		mu      sync.Mutex
+		members []etcdMember
+		fetched time.Time
+	)
+
+	return func(ctx context.Context, sem *lock.Semaphore) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if members == nil || time.Since(fetched) > clusterStatusTTL {
+			m, err := status(ctx)
+			if err != nil {
+				return fmt.Errorf("checking etcd quorum: %v", err)
+			}
+			members, fetched = m, time.Now()
+		}
+
+		return checkQuorum(members, self, sem, time.Now())
+	}
+}
+
+// checkQuorum returns an error unless the etcd member self can go down while
+// the etcd cluster keeps quorum, with the etcd members run by the holders of
+// sem counted as down too. If self is the leader, it also returns
+// errLeaderLast while any other etcd member registered in the group of sem is
+// alive, needs a reboot and is waiting in the queue of sem, so that the
+// leader reboots after them. Members which need a reboot but do not wait for
+// the semaphore, e.g. as their reboot window is closed, do not hold up the
+// leader.
+func checkQuorum(members []etcdMember, self string, sem *lock.Semaphore, t time.Time) error {
+	down := map[string]bool{self: true}
+	for _, h := range sem.Holders {
+		if info, ok := sem.HolderInfo[h]; ok && info.EtcdMember != "" {
+			down[info.EtcdMember] = true
+		}
+	}
+
+	available := 0
+	leader := false
+	for _, m := range members {
+		if m.ID == self {
+			leader = m.Leader
+		}
+		if m.Healthy && !down[m.ID] {
+			available++
+		}
+	}
+
+	if quorum := len(members)/2 + 1; available < quorum {
+		return fmt.Errorf("rebooting etcd member %s would leave %d healthy etcd members of %d, short of a quorum of %d", self, available, len(members), quorum)
+	}
+
+	if !leader {
+		return nil
+	}
+	for id, m := range sem.Members {
+		if m.EtcdMember != "" && !down[m.EtcdMember] && m.Alive(t) && m.Operation == updateengine.UpdateStatusUpdatedNeedReboot && sem.Position(id) >= 0 {
+			return errLeaderLast
+		}
+	}
+
+	return nil
+}
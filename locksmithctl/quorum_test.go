@@ -0,0 +1,166 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/lock"
+	"github.com/coreos/locksmith/updateengine"
+)
+
+type testMembersAPI struct {
+	client.MembersAPI
+	members []client.Member
+}
+
+func (t *testMembersAPI) List(ctx context.Context) ([]client.Member, error) {
+	return t.members, nil
+}
+
+func TestFindLocalMember(t *testing.T) {
+	members := []client.Member{
+		{ID: "1", Name: "a", PeerURLs: []string{"http://10.0.0.1:2380"}},
+		{ID: "2", Name: "b", PeerURLs: []string{"https://[fd00::2]:2380"}},
+		{ID: "3", Name: "69d27b356a94476da859461d3a3bc6fd", PeerURLs: []string{"http://core-03:2380"}},
+	}
+
+	for i, tt := range []struct {
+		machineID string
+		local     []string
+		want      string
+	}{
+		{"", []string{"10.0.0.1"}, "1"},
+		{"", []string{"127.0.0.1", "fd00::2"}, "2"},
+		{"69d27b356a94476da859461d3a3bc6fd", nil, "3"},
+		{"3bbbe45ba4ac4d2d8bd5ebbfd3e9d4f3", []string{"10.0.0.4"}, ""},
+	} {
+		local := make(map[string]bool)
+		for _, ip := range tt.local {
+			local[ip] = true
+		}
+		if got := findLocalMember(members, tt.machineID, local); got != tt.want {
+			t.Errorf("case %d: got %q want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestEtcdClusterStatus(t *testing.T) {
+	newMember := func(health, state string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/health":
+				w.Write([]byte(`{"health": "` + health + `"}`))
+			case "/v2/stats/self":
+				w.Write([]byte(`{"state": "` + state + `"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	}
+	leader := newMember("true", "StateLeader")
+	defer leader.Close()
+	follower := newMember("false", "StateFollower")
+	defer follower.Close()
+
+	c := &etcdCluster{
+		members: &testMembersAPI{members: []client.Member{
+			{ID: "1", ClientURLs: []string{"http://127.0.0.1:1", leader.URL}},
+			{ID: "2", ClientURLs: []string{follower.URL}},
+			{ID: "3", ClientURLs: []string{"http://127.0.0.1:1"}},
+		}},
+		hc: http.DefaultClient,
+	}
+
+	status, err := c.status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][2]bool
+	for _, m := range status {
+		got = append(got, [2]bool{m.Healthy, m.Leader})
+	}
+	if want := [][2]bool{{true, true}, {false, false}, {false, false}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected status: got %v want %v", got, want)
+	}
+}
+
+func TestCheckQuorum(t *testing.T) {
+	now := time.Unix(100000, 0)
+	healthy := func(ids ...string) []etcdMember {
+		var members []etcdMember
+		for _, id := range ids {
+			members = append(members, etcdMember{Member: client.Member{ID: id}, Healthy: true})
+		}
+		return members
+	}
+	needsReboot := &lock.Member{EtcdMember: "2", Operation: updateengine.UpdateStatusUpdatedNeedReboot, LastHeartbeat: now.Unix()}
+	upToDate := &lock.Member{EtcdMember: "2", Operation: "UPDATE_STATUS_IDLE", LastHeartbeat: now.Unix()}
+	leader := append(healthy("2", "3"), etcdMember{Member: client.Member{ID: "1"}, Healthy: true, Leader: true})
+
+	for i, tt := range []struct {
+		members []etcdMember
+		holders map[string]string
+		others  map[string]*lock.Member
+		waiting []string
+		err     string
+	}{
+		// 3 healthy members survive losing one
+		{healthy("1", "2", "3"), nil, nil, nil, ""},
+		// but not losing one while another member holds the lock
+		{healthy("1", "2", "3"), map[string]string{"b": "2"}, nil, nil, "would leave 1 healthy etcd members of 3, short of a quorum of 2"},
+		// holders which do not run etcd members do not count
+		{healthy("1", "2", "3"), map[string]string{"b": ""}, nil, nil, ""},
+		// nor when another member is unhealthy already
+		{append(healthy("1", "2"), etcdMember{Member: client.Member{ID: "3"}}), nil, nil, nil, "short of a quorum of 2"},
+		// 5 members survive losing two
+		{healthy("1", "2", "3", "4", "5"), map[string]string{"b": "2"}, nil, nil, ""},
+		// the leader lets other members needing a reboot go first
+		{leader, nil, map[string]*lock.Member{"b": needsReboot}, []string{"b"}, errLeaderLast.Error()},
+		// followers do not
+		{healthy("1", "2", "3"), nil, map[string]*lock.Member{"b": needsReboot}, []string{"b"}, ""},
+		// nor does the leader for members which are not waiting for the lock
+		{leader, nil, map[string]*lock.Member{"b": needsReboot}, nil, ""},
+		// or if only the leader needs a reboot
+		{leader, nil, map[string]*lock.Member{"b": upToDate}, []string{"b"}, ""},
+		{leader, nil, nil, nil, ""},
+	} {
+		sem := &lock.Semaphore{HolderInfo: make(map[string]*lock.Holder), Members: tt.others}
+		for h, member := range tt.holders {
+			sem.Holders = append(sem.Holders, h)
+			sem.HolderInfo[h] = &lock.Holder{EtcdMember: member}
+		}
+		for _, w := range tt.waiting {
+			sem.Enqueue(w, time.Hour)
+		}
+
+		err := checkQuorum(tt.members, "1", sem, now)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("case %d: got error %v, want %q", i, err, tt.err)
+		}
+	}
+}
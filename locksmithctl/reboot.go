@@ -38,7 +38,10 @@ func runReboot(args []string) int {
 		return 1
 	}
 
-	elc, err := getClient()
+	ctx, cancel := newContext()
+	defer cancel()
+
+	clients, err := getClients(ctx)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
 		return 1
@@ -56,9 +59,13 @@ func runReboot(args []string) int {
 		return 1
 	}
 
-	l := lock.New(mID, elc)
+	hostname, _ := os.Hostname()
+
+	l := lock.NewMulti(mID, clients...)
+	l.SetTTL(globalFlags.LeaseTTL)
+	l.SetInfo(lock.Holder{Hostname: hostname, Reason: "locksmithctl reboot"})
 
-	err = l.Lock()
+	_, err = l.Lock(ctx)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error locking:", err)
 		return 1
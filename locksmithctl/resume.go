@@ -0,0 +1,62 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+var (
+	cmdResume = &Command{
+		Name:    "resume",
+		Summary: "Allow machines to take the reboot lock again after a pause.",
+		Description: `Resume ends a pause started by "locksmithctl pause", so that machines can take
+the reboot lock again.
+
+If several groups are given with --group, all of them are resumed.`,
+		Run: runResume,
+	}
+)
+
+func runResume(args []string) (exit int) {
+	ctx, cancel := newContext()
+	defer cancel()
+
+	clients, err := getClients(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+
+	gs := groups()
+	for i, elc := range clients {
+		l := lock.New("", elc)
+		l.SetActor(actor())
+		err := l.Resume(ctx)
+		switch err {
+		case nil:
+		case lock.ErrNotPaused:
+			fmt.Printf("Group %q was not paused\n", gs[i])
+		default:
+			fmt.Fprintf(os.Stderr, "Error resuming group %q: %v\n", gs[i], err)
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coreos/locksmith/lock"
 )
@@ -26,9 +28,13 @@ var (
 	cmdSetMax = &Command{
 		Name:    "set-max",
 		Summary: "Set the maximum number of lock holders",
-		Usage:   "UNIT",
+		Usage:   "UNIT|PERCENT%",
 		Description: `Set the maximum number of machines that can be rebooting at a given time. This
-can be set at any time and will not affect current holders of the lock.`,
+can be set at any time and will not affect current holders of the lock.
+
+A percentage such as 10% sets the maximum relative to the number of machines
+registered in the group which are alive, rounded down but at least 1, so it
+follows the group as it grows and shrinks. See "locksmithctl members".`,
 		Run: runSetMax,
 	}
 )
@@ -39,25 +45,46 @@ func runSetMax(args []string) (exit int) {
 		return 1
 	}
 
-	elc, err := getClient()
+	ctx, cancel := newContext()
+	defer cancel()
+
+	elc, err := getClient(ctx)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
 		return 1
 	}
 	l := lock.New("hi", elc)
-	max, err := strconv.Atoi(args[0])
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Invalid maximum value:", args[0])
-		return 1
-	}
+	l.SetActor(actor())
 
-	sem, old, err := l.SetMax(max)
+	var (
+		sem *lock.Semaphore
+		old int
+		max int
+	)
+	if pct := strings.TrimSuffix(args[0], "%"); pct != args[0] {
+		max, err = strconv.Atoi(pct)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid maximum percentage:", args[0])
+			return 1
+		}
+
+		sem, old, err = l.SetMaxPercent(ctx, max)
+	} else {
+		max, err = strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid maximum value:", args[0])
+			return 1
+		}
+
+		sem, old, err = l.SetMaxContext(ctx, max)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error setting value:", err)
+		return 1
 	}
 
 	fmt.Println("Old-Max:", old)
-	fmt.Println("Max:", sem.Max)
+	fmt.Println("Max:", describeMax(sem, time.Now()))
 
 	return
 }
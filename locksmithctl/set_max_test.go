@@ -0,0 +1,70 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+func TestRunSetMax(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith_set_max_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(backend, dir string) {
+		globalFlags.Backend, globalFlags.LockDir = backend, dir
+	}(globalFlags.Backend, globalFlags.LockDir)
+	globalFlags.Backend, globalFlags.LockDir = backendFile, dir
+
+	for i, tt := range []struct {
+		arg  string
+		exit int
+		max  int
+	}{
+		{"2", 0, 2},
+		{"-1", 1, 2},
+		{"two", 1, 2},
+		{"0%", 1, 2},
+		{"500%", 1, 2},
+		{"x%", 1, 2},
+		{"100%", 0, 1},
+		{"3", 0, 3},
+	} {
+		if exit := runSetMax([]string{tt.arg}); exit != tt.exit {
+			t.Errorf("case %d: exit %d, want %d", i, exit, tt.exit)
+		}
+
+		ctx, cancel := newContext()
+		c, err := getClient(ctx)
+		if err != nil {
+			cancel()
+			t.Fatalf("case %d: %v", i, err)
+		}
+		sem, err := lock.New("", c).GetContext(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if sem.Max != tt.max {
+			t.Errorf("case %d: max %d, want %d", i, sem.Max, tt.max)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+var (
+	cmdSetRate = &Command{
+		Name:    "set-rate",
+		Summary: "Limit how many machines may reboot per interval",
+		Usage:   "REBOOTS/INTERVAL|off",
+		Description: `Set-rate limits how many machines may take the lock per interval, e.g. 6/1h
+for no more than 6 reboots per hour, regardless of the maximum number of lock
+holders. Once the limit is used up, another machine may take the lock every
+interval divided by the number of reboots, e.g. every 10 minutes for 6/1h.
+Machines which are refused wait in the queue for their turn.
+
+"off" removes the limit. Current holders of the lock are not affected.`,
+		Run: runSetRate,
+	}
+)
+
+// parseRate parses a rate limit given as REBOOTS/INTERVAL, such as 6/1h, or
+// "off", which is returned as zero reboots.
+func parseRate(s string) (int, time.Duration, error) {
+	if s == "off" {
+		return 0, 0, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected REBOOTS/INTERVAL, got %q", s)
+	}
+
+	reboots, err := strconv.Atoi(parts[0])
+	if err != nil || reboots < 1 {
+		return 0, 0, fmt.Errorf("invalid number of reboots %q", parts[0])
+	}
+
+	interval, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return reboots, interval, nil
+}
+
+// describeRate describes the rate limit r at time t, along with how many
+// reboots it allows right away, or when it allows the next one.
+func describeRate(r *lock.Rate, t time.Time) string {
+	if r == nil {
+		return "none"
+	}
+
+	if n := int(r.Available(t)); n > 0 {
+		return fmt.Sprintf("%s (%d available)", r.String(), n)
+	}
+
+	return fmt.Sprintf("%s (next in %s)", r.String(), r.Next(t).Sub(t))
+}
+
+func runSetRate(args []string) (exit int) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "New rate limit must be set.")
+		return 1
+	}
+
+	reboots, interval, err := parseRate(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid rate limit:", err)
+		return 1
+	}
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	elc, err := getClient(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+	l := lock.New("hi", elc)
+	l.SetActor(actor())
+
+	sem, old, err := l.SetRate(ctx, reboots, interval)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error setting value:", err)
+		return 1
+	}
+
+	oldRate := "none"
+	if old != nil {
+		oldRate = old.String()
+	}
+	fmt.Println("Old-Rate:", oldRate)
+	fmt.Println("Rate:", describeRate(sem.Rate, time.Now()))
+
+	return
+}
@@ -17,45 +17,179 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/coreos/locksmith/lock"
 )
 
 var (
 	cmdStatus = &Command{
-		Name:        "status",
-		Summary:     "Get the status of the cluster wide reboot lock.",
-		Description: `Status will return the number of locks that are held and available and a list of the holders.`,
-		Run:         runStatus,
+		Name:    "status",
+		Summary: "Get the status of the cluster wide reboot lock.",
+		Description: `Status will return the number of locks that are held and available and a list of the holders,
+along with their hostname, how long they have held the lock, the version they
+are updating to, the reboot strategy which took the lock, how long until they
+release it after their reboot, and why.
+
+If a rate limit is set, status shows it along with how many machines may take
+the lock right away. If the lock is paused, status shows since when, until when and why.
+
+Machines waiting for the lock are listed in the order in which they will be
+granted it.
+
+If several groups are given with --group, the status of each group is shown.`,
+		Run: runStatus,
 	}
 )
 
 func printHolders(sem *lock.Semaphore) {
-	fmt.Fprintln(out, "MACHINE ID")
+	now := time.Now()
+
+	fmt.Fprintln(out, "MACHINE ID\tHOSTNAME\tHELD FOR\tVERSION\tSTRATEGY\tUNLOCK IN\tREASON")
 	for _, h := range sem.Holders {
-		fmt.Fprintln(out, h)
+		info, ok := sem.HolderInfo[h]
+		if !ok {
+			// taken by a version of locksmith which does not record
+			// holder metadata.
+			info = &lock.Holder{}
+		}
+
+		heldFor := ""
+		if d := info.HeldFor(now); d > 0 {
+			heldFor = (d - d%time.Second).String()
+		}
+
+		// holders which rebooted already release the lock once they
+		// have been up for a while, unless their health checks failed.
+		unlockIn := ""
+		switch {
+		case info.Gated:
+			unlockIn = "unhealthy"
+		case info.UnlockTime != 0:
+			if d := time.Unix(info.UnlockTime, 0).Sub(now); d > 0 {
+				unlockIn = (d - d%time.Second).String()
+			}
+		}
+
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", h, orDash(info.Hostname), orDash(heldFor), orDash(info.Version), orDash(info.Strategy), orDash(unlockIn), orDash(info.Reason))
+	}
+	out.Flush()
+}
+
+// printWaiters prints the machines waiting in the queue of the semaphore,
+// skipping those which stopped refreshing their place in it.
+func printWaiters(sem *lock.Semaphore) {
+	now := time.Now()
+
+	var rows []string
+	for _, w := range sem.Waiters {
+		pos := sem.Position(w.ID)
+		if pos < 0 {
+			continue
+		}
+
+		d := now.Sub(time.Unix(w.EnqueueTime, 0))
+		rows = append(rows, fmt.Sprintf("%d\t%s\t%s\n", pos+1, w.ID, d-d%time.Second))
+	}
+	if len(rows) == 0 {
+		return
+	}
+
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "POSITION\tMACHINE ID\tWAITING FOR")
+	for _, row := range rows {
+		fmt.Fprint(out, row)
+	}
+	out.Flush()
+}
+
+// describeMax describes the maximum number of holders of sem at time t,
+// along with the percentage of members it derives from if any.
+func describeMax(sem *lock.Semaphore, t time.Time) string {
+	max := sem.EffectiveMax(t)
+	if sem.MaxPercent == 0 {
+		return strconv.Itoa(max)
 	}
+
+	return fmt.Sprintf("%d (%d%% of %d live members)", max, sem.MaxPercent, sem.LiveMembers(t))
+}
+
+// printPause prints whether the semaphore is paused, when the pause ends and
+// why it was paused.
+func printPause(sem *lock.Semaphore) {
+	now := time.Now()
+	if sem.Paused == nil || !sem.Paused.Active(now) {
+		return
+	}
+
+	d := now.Sub(time.Unix(sem.Paused.StartTime, 0))
+	until := "resumed"
+	if sem.Paused.Until != 0 {
+		until = time.Unix(sem.Paused.Until, 0).UTC().Format(time.RFC3339)
+	}
+
+	fmt.Printf("Paused: for %s, until %s\n", d-d%time.Second, until)
+	if sem.Paused.Reason != "" {
+		fmt.Println("Pause reason:", sem.Paused.Reason)
+	}
+}
+
+// orDash returns s, or "-" if s is empty, so that empty table cells are
+// still visible.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
 }
 
 func runStatus(args []string) (exit int) {
-	elc, err := getClient()
+	ctx, cancel := newContext()
+	defer cancel()
+
+	clients, err := getClients(ctx)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
 		return 1
 	}
-	l := lock.New("", elc)
 
-	sem, err := l.Get()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error setting value:", err)
-	}
+	gs := groups()
+	for i, elc := range clients {
+		l := lock.New("", elc)
+
+		sem, err := l.GetContext(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting value:", err)
+			return 1
+		}
+
+		if len(clients) > 1 {
+			if i > 0 {
+				fmt.Println("")
+			}
+			fmt.Printf("Group: %q\n", gs[i])
+		}
+
+		if sem.MaxPercent != 0 {
+			// show the maximum as it applies now, rather than as of
+			// the latest acquisition.
+			sem.SetMaxPercent(sem.MaxPercent)
+		}
+
+		fmt.Println("Available:", sem.Semaphore)
+		fmt.Println("Max:", describeMax(sem, time.Now()))
+		if sem.Rate != nil {
+			fmt.Println("Rate:", describeRate(sem.Rate, time.Now()))
+		}
+		printPause(sem)
 
-	fmt.Println("Available:", sem.Semaphore)
-	fmt.Println("Max:", sem.Max)
+		if len(sem.Holders) > 0 {
+			fmt.Fprintln(out, "")
+			printHolders(sem)
+		}
 
-	if len(sem.Holders) > 0 {
-		fmt.Fprintln(out, "")
-		printHolders(sem)
+		printWaiters(sem)
 	}
 
 	return
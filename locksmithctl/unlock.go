@@ -17,6 +17,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coreos/locksmith/lock"
 	"github.com/coreos/locksmith/pkg/machineid"
@@ -26,35 +29,90 @@ var (
 	cmdUnlock = &Command{
 		Name:    "unlock",
 		Summary: "Unlock this machine or a given machine-id for reboot.",
-		Usage:   "<machine-id>",
+		Usage:   "[--force-if-stale [--stale-after=<duration>]] [--force] [--reason=<reason>] <machine-id>",
 		Description: `Unlock is for manual unlocking of the reboot unlock for this machine or a
-given machine-id. Under normal operation this should not be necessary.`,
+given machine-id. Under normal operation this should not be necessary.
+
+Unlocking another machine might break the lock of a machine in the middle of
+rebooting, so it is refused unless --force-if-stale or --force is given. With
+--force-if-stale, the lock is only broken if the machine has not renewed its
+lease or sent a heartbeat for longer than --stale-after, or its lease has
+expired. --force breaks the lock regardless. Either way, the unlock is recorded
+as a forced unlock in the history of the lock along with --reason, see
+"locksmithctl history".
+
+If several groups are given with --group, the lock is released in all of them.
+With --force-if-stale, the machine must be stale in every group it holds the
+lock in, otherwise the lock is released in none of them.`,
 		Run: runUnlock,
 	}
+
+	unlockFlags = struct {
+		ForceIfStale bool
+		StaleAfter   time.Duration
+		Force        bool
+		Reason       string
+	}{}
 )
 
+func init() {
+	cmdUnlock.Flags.BoolVar(&unlockFlags.ForceIfStale, "force-if-stale", false, "Unlock another machine only if it is stale.")
+	cmdUnlock.Flags.DurationVar(&unlockFlags.StaleAfter, "stale-after", time.Hour, "How long a machine must not have shown signs of life to be stale.")
+	cmdUnlock.Flags.BoolVar(&unlockFlags.Force, "force", false, "Unlock another machine even if it is not stale.")
+	cmdUnlock.Flags.StringVar(&unlockFlags.Reason, "reason", "", "Reason for unlocking another machine, recorded in the history.")
+}
+
 func runUnlock(args []string) (exit int) {
-	elc, err := getClient()
+	ctx, cancel := newContext()
+	defer cancel()
+
+	clients, err := getClients(ctx)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
 		return 1
 	}
 
-	var mID string
-
-	if len(args) == 0 {
-		mID = machineid.MachineID("/")
-		if mID == "" {
-			fmt.Fprintln(os.Stderr, "Cannot read machine-id")
-			return 1
-		}
-	} else {
+	self := machineid.MachineID("/")
+	mID := self
+	if len(args) > 0 {
 		mID = args[0]
 	}
+	if mID == "" {
+		fmt.Fprintln(os.Stderr, "Cannot read machine-id")
+		return 1
+	}
 
-	l := lock.New(mID, elc)
+	l := lock.NewMulti(mID, clients...)
+	l.SetActor(actor())
 
-	err = l.Unlock()
+	switch {
+	case mID == self:
+		err = l.Unlock(ctx)
+	case unlockFlags.Force:
+		err = l.ForceUnlock(ctx, unlockFlags.Reason, 0)
+	case unlockFlags.ForceIfStale:
+		if unlockFlags.StaleAfter <= 0 {
+			fmt.Fprintln(os.Stderr, "--stale-after must be positive")
+			return 1
+		}
+		err = l.ForceUnlock(ctx, unlockFlags.Reason, unlockFlags.StaleAfter)
+	default:
+		fmt.Fprintf(os.Stderr, "Refusing to unlock another machine, %s, without --force-if-stale or --force\n", mID)
+		return 1
+	}
+	if perr, ok := err.(*lock.PartialUnlockError); ok {
+		gs := groups()
+		var unlocked []string
+		for _, i := range perr.Unlocked {
+			unlocked = append(unlocked, strconv.Quote(gs[i]))
+		}
+		fmt.Fprintf(os.Stderr, "Error unlocking: %s was only unlocked in groups %s: %v\n", mID, strings.Join(unlocked, ", "), perr.Err)
+		return 1
+	}
+	if nerr, ok := err.(*lock.NotStaleError); ok {
+		fmt.Fprintf(os.Stderr, "Refusing to unlock %s: it was last seen %v ago, within --stale-after. Use --force to unlock it anyway.\n", mID, time.Since(nerr.LastSeen)-time.Since(nerr.LastSeen)%time.Second)
+		return 1
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error unlocking:", err)
 		return 1
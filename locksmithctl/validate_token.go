@@ -0,0 +1,84 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/coreos/locksmith/lock"
+	"github.com/coreos/locksmith/pkg/machineid"
+)
+
+var (
+	cmdValidateToken = &Command{
+		Name:    "validate-token",
+		Summary: "Check a fencing token against the current lock holders.",
+		Usage:   "TOKEN [<machine-id>]",
+		Description: `Validate-token checks that TOKEN, as printed by "locksmithctl lock --print-token",
+belongs to the current holding of the reboot lock by this machine or a given
+machine-id. It exits with status 2 if the token is stale, i.e. the machine no
+longer holds the lock, its lease has expired, or the lock has been taken again
+since the token was handed out.`,
+		Run: runValidateToken,
+	}
+)
+
+func runValidateToken(args []string) (exit int) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "A token must be given.")
+		return 1
+	}
+
+	token, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid token:", args[0])
+		return 1
+	}
+
+	var mID string
+	if len(args) == 1 {
+		mID = machineid.MachineID("/")
+		if mID == "" {
+			fmt.Fprintln(os.Stderr, "Cannot read machine-id")
+			return 1
+		}
+	} else {
+		mID = args[1]
+	}
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	elc, err := getClient(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+
+	l := lock.New(mID, elc)
+	err = l.Validate(ctx, token)
+	if err == lock.ErrInvalidToken {
+		fmt.Fprintln(os.Stderr, "Token is stale:", token)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error validating token:", err)
+		return 1
+	}
+
+	return 0
+}
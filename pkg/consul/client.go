@@ -0,0 +1,288 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consul is a minimal client for the Consul HTTP API. It only
+// implements the handful of KV, transaction and session calls locksmith
+// needs.
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const apiPrefix = "/v1"
+
+var (
+	// ErrNoAddress is returned if a client is configured without an
+	// address.
+	ErrNoAddress = errors.New("no Consul address configured")
+)
+
+// Config holds the configuration of a Client.
+type Config struct {
+	// Address is the URL of the Consul agent, e.g. http://127.0.0.1:8500.
+	Address string
+	// Transport is used for all requests. If nil, http.DefaultTransport is
+	// used.
+	Transport http.RoundTripper
+	// Token is the ACL token sent with every request if set.
+	Token string
+}
+
+// Client is a client for the Consul HTTP API.
+type Client struct {
+	address *url.URL
+	hc      *http.Client
+	token   string
+}
+
+// New creates a new Client from the given configuration.
+func New(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, ErrNoAddress
+	}
+
+	address, err := url.Parse(strings.TrimRight(cfg.Address, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &Client{
+		address: address,
+		hc:      &http.Client{Transport: transport},
+		token:   cfg.Token,
+	}, nil
+}
+
+// Error is an error returned by Consul.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("consul: %s (code %d)", e.Message, e.Code)
+}
+
+// KVPair is a key and its value as stored in Consul.
+type KVPair struct {
+	Key         string
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+	Session     string `json:",omitempty"`
+}
+
+// KV operation verbs supported by Txn.
+const (
+	VerbSet    = "set"
+	VerbCAS    = "cas"
+	VerbLock   = "lock"
+	VerbDelete = "delete"
+)
+
+// TxnOp is a single KV operation in a transaction.
+type TxnOp struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+type txnOp struct {
+	KV TxnOp
+}
+
+type txnResponse struct {
+	Errors []struct {
+		OpIndex int
+		What    string
+	}
+}
+
+type sessionRequest struct {
+	Name     string
+	TTL      string
+	Behavior string
+}
+
+type sessionResponse struct {
+	ID string
+}
+
+// Get returns the pair stored at key, or nil if the key does not exist.
+func (c *Client) Get(ctx context.Context, key string) (*KVPair, error) {
+	var pairs []*KVPair
+	if _, err := c.call(ctx, "GET", "/kv/"+key, nil, nil, &pairs); err != nil {
+		if cerr, ok := err.(*Error); ok && cerr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	return pairs[0], nil
+}
+
+// List returns all pairs whose key starts with prefix.
+func (c *Client) List(ctx context.Context, prefix string) ([]*KVPair, error) {
+	var pairs []*KVPair
+	if _, err := c.call(ctx, "GET", "/kv/"+prefix, url.Values{"recurse": {""}}, nil, &pairs); err != nil {
+		if cerr, ok := err.(*Error); ok && cerr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+// Txn executes the operations atomically and reports whether they were
+// applied. A transaction is rolled back if any of its operations fails, e.g.
+// because a check-and-set index no longer matches.
+func (c *Client) Txn(ctx context.Context, ops []TxnOp) (bool, error) {
+	var req []txnOp
+	for _, op := range ops {
+		req = append(req, txnOp{op})
+	}
+
+	var resp txnResponse
+	_, err := c.call(ctx, "PUT", "/txn", nil, req, &resp)
+	if cerr, ok := err.(*Error); ok && cerr.Code == http.StatusConflict {
+		// rolled back; the body lists the failed operations.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return len(resp.Errors) == 0, nil
+}
+
+// CreateSession creates a session which is invalidated unless it is renewed
+// within ttl seconds. Keys locked by the session are deleted once it is
+// invalidated.
+func (c *Client) CreateSession(ctx context.Context, name string, ttl int64) (string, error) {
+	req := sessionRequest{Name: name, TTL: strconv.FormatInt(ttl, 10) + "s", Behavior: "delete"}
+
+	var resp sessionResponse
+	if _, err := c.call(ctx, "PUT", "/session/create", nil, req, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.ID, nil
+}
+
+// DestroySession invalidates the session with the given id.
+func (c *Client) DestroySession(ctx context.Context, id string) error {
+	var ok bool
+	_, err := c.call(ctx, "PUT", "/session/destroy/"+id, nil, nil, &ok)
+	return err
+}
+
+// Watch blocks until key is modified after index.
+func (c *Client) Watch(ctx context.Context, key string, index uint64) error {
+	for {
+		q := url.Values{"index": {strconv.FormatUint(index, 10)}}
+		var pairs []*KVPair
+		newIndex, err := c.call(ctx, "GET", "/kv/"+key, q, nil, &pairs)
+		if cerr, ok := err.(*Error); ok && cerr.Code == http.StatusNotFound {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// blocking queries return after a while even if nothing changed.
+		// an index lower than before means it was reset, e.g. after a
+		// snapshot restore, so anything may have changed.
+		if newIndex != index {
+			return nil
+		}
+	}
+}
+
+// call sends req to the given API method and decodes the response into
+// resp. It returns the index Consul reports for the response.
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, req, resp interface{}) (uint64, error) {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	// keys may contain escaped characters themselves, so the path is
+	// escaped as a whole rather than parsed.
+	u := *c.address
+	u.Path += apiPrefix + path
+	u.RawQuery = query.Encode()
+
+	hreq, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return 0, err
+	}
+	// Request.WithContext needs go 1.7
+	hreq.Cancel = ctx.Done()
+	if c.token != "" {
+		hreq.Header.Set("X-Consul-Token", c.token)
+	}
+
+	hresp, err := c.hc.Do(hreq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	defer hresp.Body.Close()
+
+	b, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	// a missing key still reports an index, which blocking queries need.
+	index, _ := strconv.ParseUint(hresp.Header.Get("X-Consul-Index"), 10, 64)
+	if hresp.StatusCode != http.StatusOK {
+		return index, &Error{Code: hresp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+
+	if resp == nil {
+		return index, nil
+	}
+
+	return index, json.Unmarshal(b, resp)
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestClient(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath()+"?"+r.URL.RawQuery+" "+r.Header.Get("X-Consul-Token")+" "+string(body))
+
+		w.Header().Set("X-Consul-Index", "7")
+		switch r.URL.EscapedPath() {
+		case "/v1/kv/groups/a%252Fb/semaphore":
+			w.Write([]byte(`[{"Key":"groups/a%2Fb/semaphore","Value":"YmFy","CreateIndex":2,"ModifyIndex":7}]`))
+		case "/v1/txn":
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"Results":null,"Errors":[{"OpIndex":0,"What":"failed"}]}`))
+		case "/v1/session/create":
+			w.Write([]byte(`{"ID":"abc"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{Address: srv.URL + "/", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := c.Get(context.Background(), "groups/a%2Fb/semaphore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &KVPair{Key: "groups/a%2Fb/semaphore", Value: []byte("bar"), CreateIndex: 2, ModifyIndex: 7}
+	if !reflect.DeepEqual(pair, want) {
+		t.Errorf("unexpected pair: got %#v want %#v", pair, want)
+	}
+
+	if pair, err := c.Get(context.Background(), "missing"); pair != nil || err != nil {
+		t.Errorf("expected no pair for a missing key, got %#v %v", pair, err)
+	}
+
+	if pairs, err := c.List(context.Background(), "missing/"); pairs != nil || err != nil {
+		t.Errorf("expected no pairs for a missing prefix, got %#v %v", pairs, err)
+	}
+
+	ok, err := c.Txn(context.Background(), []TxnOp{{Verb: VerbCAS, Key: "foo", Value: []byte("baz"), Index: 7}, {Verb: VerbDelete, Key: "bar"}})
+	if ok || err != nil {
+		t.Errorf("expected a rolled back transaction, got %v %v", ok, err)
+	}
+
+	id, err := c.CreateSession(context.Background(), "locksmith", 60)
+	if err != nil || id != "abc" {
+		t.Errorf("unexpected session: %v %v", id, err)
+	}
+
+	// the key has not changed since index 7
+	if err := c.Watch(context.Background(), "groups/a%2Fb/semaphore", 3); err != nil {
+		t.Errorf("unexpected watch error: %v", err)
+	}
+
+	if err := c.DestroySession(context.Background(), "abc"); err == nil {
+		t.Error("expected an error destroying a missing session")
+	} else if cerr, ok := err.(*Error); !ok || cerr.Code != http.StatusNotFound {
+		t.Errorf("expected Consul error, got %#v", err)
+	}
+
+	wantRequests := []string{
+		`GET /v1/kv/groups/a%252Fb/semaphore? secret `,
+		`GET /v1/kv/missing? secret `,
+		`GET /v1/kv/missing/?recurse= secret `,
+		`PUT /v1/txn? secret [{"KV":{"Verb":"cas","Key":"foo","Value":"YmF6","Index":7}},{"KV":{"Verb":"delete","Key":"bar"}}]`,
+		`PUT /v1/session/create? secret {"Name":"locksmith","TTL":"60s","Behavior":"delete"}`,
+		`GET /v1/kv/groups/a%252Fb/semaphore?index=3 secret `,
+		`PUT /v1/session/destroy/abc? secret `,
+	}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("unexpected requests:\ngot  %q\nwant %q", requests, wantRequests)
+	}
+
+	if _, err := New(Config{}); err != ErrNoAddress {
+		t.Errorf("expected ErrNoAddress, got %v", err)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	var indexes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		indexes = append(indexes, r.URL.Query().Get("index"))
+
+		// the first blocking query times out without a change
+		index := "5"
+		if len(indexes) > 1 {
+			index = "6"
+		}
+		w.Header().Set("X-Consul-Index", index)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Watch(context.Background(), "foo", 5); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"5", "5"}; !reflect.DeepEqual(indexes, want) {
+		t.Errorf("unexpected watch indexes: got %v want %v", indexes, want)
+	}
+}
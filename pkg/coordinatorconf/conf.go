@@ -24,14 +24,18 @@
 //
 // The "NAME" key MUST be set. (e.g. `NAME=locksmithd`). The "STATUS" key should generally bet set.
 // The STRATEGY key may optionally be set depending on the coordinator.
+// The UNLOCK_DELAY_REMAINING key is set to the number of seconds left before
+// the coordinator releases its reboot lock after a reboot, if it is waiting to.
 package coordinatorconf
 
 import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coreos/locksmith/pkg/filelock"
 )
@@ -56,6 +60,7 @@ const (
 
 type CoordinatorConfigUpdater interface {
 	UpdateState(updateCoordinatorState) error
+	UpdateUnlockDelay(remaining time.Duration) error
 }
 
 // Implements CoordinatorConfigUpdater
@@ -118,6 +123,20 @@ func (c *coordinator) UpdateState(s updateCoordinatorState) error {
 	return c.writeConfig()
 }
 
+// UpdateUnlockDelay updates the time left before the update coordinator
+// releases its reboot lock. A remaining time of zero or less removes it.
+func (c *coordinator) UpdateUnlockDelay(remaining time.Duration) error {
+	c.configLock.Lock()
+	if remaining > 0 {
+		c.config["UNLOCK_DELAY_REMAINING"] = strconv.FormatInt(int64((remaining+time.Second-1)/time.Second), 10)
+	} else {
+		delete(c.config, "UNLOCK_DELAY_REMAINING")
+	}
+	c.configLock.Unlock()
+
+	return c.writeConfig()
+}
+
 func (c *coordinator) writeConfig() error {
 	c.configLock.Lock()
 	defer c.configLock.Unlock()
@@ -0,0 +1,528 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcdv3 is a minimal client for the etcd v3 API. It talks to the
+// JSON gateway etcd serves next to its gRPC API, and only implements the
+// handful of KV, lease and watch calls locksmith needs.
+package etcdv3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	apiPrefix = "/v3"
+
+	// codeUnauthenticated is the gRPC status code of the errors etcd
+	// returns for requests with an invalid or expired auth token.
+	codeUnauthenticated = 16
+)
+
+var (
+	// ErrNoEndpoints is returned if a client is configured without endpoints.
+	ErrNoEndpoints = errors.New("no etcd endpoints configured")
+)
+
+// Config holds the configuration of a Client.
+type Config struct {
+	// Endpoints is the list of etcd client URLs. They are tried in order
+	// until one of them responds.
+	Endpoints []string
+	// Transport is used for all requests. If nil, http.DefaultTransport is
+	// used.
+	Transport http.RoundTripper
+	// Username and Password are used to authenticate against etcd if
+	// Username is set.
+	Username string
+	Password string
+}
+
+// Client is a client for the etcd v3 JSON gateway.
+type Client struct {
+	endpoints []string
+	hc        *http.Client
+	username  string
+	password  string
+
+	tokenLock sync.Mutex
+	token     string
+}
+
+// New creates a new Client from the given configuration.
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	c := &Client{
+		hc:       &http.Client{Transport: transport},
+		username: cfg.Username,
+		password: cfg.Password,
+	}
+	for _, ep := range cfg.Endpoints {
+		c.endpoints = append(c.endpoints, strings.TrimRight(ep, "/"))
+	}
+
+	return c, nil
+}
+
+// Error is an error returned by the etcd server.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("etcd: %s (code %d)", e.Message, e.Code)
+}
+
+// KeyValue is a key and its value as stored in etcd.
+type KeyValue struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision int64  `json:"create_revision,string"`
+	ModRevision    int64  `json:"mod_revision,string"`
+	Version        int64  `json:"version,string"`
+	Lease          int64  `json:"lease,string"`
+}
+
+// Compare targets supported by Compare.
+const (
+	TargetVersion = "VERSION"
+	TargetCreate  = "CREATE"
+	TargetMod     = "MOD"
+)
+
+// Compare is a condition of a transaction. The revision of Key selected by
+// Target must be equal to Revision for the comparison to succeed.
+type Compare struct {
+	Key      string
+	Target   string
+	Revision int64
+}
+
+// MarshalJSON implements json.Marshaler. The revision is a oneof field in the
+// etcd API, so its JSON name depends on the compare target.
+func (c Compare) MarshalJSON() ([]byte, error) {
+	var field string
+	switch c.Target {
+	case TargetVersion:
+		field = "version"
+	case TargetCreate:
+		field = "create_revision"
+	case TargetMod:
+		field = "mod_revision"
+	default:
+		return nil, fmt.Errorf("unknown compare target %q", c.Target)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"key":    []byte(c.Key),
+		"target": c.Target,
+		"result": "EQUAL",
+		field:    c.Revision,
+	})
+}
+
+// PutRequest stores Value at Key, optionally attached to a lease.
+type PutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,omitempty"`
+}
+
+// DeleteRequest deletes Key.
+type DeleteRequest struct {
+	Key []byte `json:"key"`
+}
+
+// Op is a single operation in a transaction. Exactly one of its fields
+// should be set.
+type Op struct {
+	Put    *PutRequest    `json:"request_put,omitempty"`
+	Delete *DeleteRequest `json:"request_delete_range,omitempty"`
+}
+
+// OpPut returns an Op storing value at key, attached to the given lease if
+// lease is not zero.
+func OpPut(key string, value []byte, lease int64) Op {
+	return Op{Put: &PutRequest{Key: []byte(key), Value: value, Lease: lease}}
+}
+
+// OpDelete returns an Op deleting key.
+func OpDelete(key string) Op {
+	return Op{Delete: &DeleteRequest{Key: []byte(key)}}
+}
+
+// Txn is an etcd transaction. If all comparisons succeed, the Success
+// operations are applied, otherwise the Failure operations are.
+type Txn struct {
+	Compare []Compare `json:"compare,omitempty"`
+	Success []Op      `json:"success,omitempty"`
+	Failure []Op      `json:"failure,omitempty"`
+}
+
+type rangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type rangeResponse struct {
+	Kvs []*KeyValue `json:"kvs"`
+}
+
+type txnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type grantRequest struct {
+	TTL int64 `json:"TTL"`
+}
+
+type revokeRequest struct {
+	ID int64 `json:"ID"`
+}
+
+type grantResponse struct {
+	ID    int64  `json:"ID,string"`
+	Error string `json:"error"`
+}
+
+type watchRequest struct {
+	CreateRequest struct {
+		Key           []byte `json:"key"`
+		RangeEnd      []byte `json:"range_end,omitempty"`
+		StartRevision int64  `json:"start_revision,omitempty"`
+	} `json:"create_request"`
+}
+
+type watchResponse struct {
+	Result struct {
+		Canceled        bool              `json:"canceled"`
+		CancelReason    string            `json:"cancel_reason"`
+		CompactRevision int64             `json:"compact_revision,string"`
+		Events          []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *Error `json:"error"`
+}
+
+type authRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type authResponse struct {
+	Token string `json:"token"`
+}
+
+// Range returns the key-value pair stored at key. If prefix is true, all
+// pairs whose key starts with key are returned. A missing key is not an
+// error; an empty result is returned instead.
+func (c *Client) Range(ctx context.Context, key string, prefix bool) ([]*KeyValue, error) {
+	req := rangeRequest{Key: []byte(key)}
+	if prefix {
+		req.RangeEnd = prefixEnd([]byte(key))
+	}
+
+	var resp rangeResponse
+	if err := c.call(ctx, "/kv/range", req, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Kvs, nil
+}
+
+// Txn executes the transaction and reports whether its comparisons
+// succeeded.
+func (c *Client) Txn(ctx context.Context, txn *Txn) (bool, error) {
+	var resp txnResponse
+	if err := c.call(ctx, "/kv/txn", txn, &resp); err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+// Grant creates a new lease with the given ttl in seconds and returns its id.
+func (c *Client) Grant(ctx context.Context, ttl int64) (int64, error) {
+	var resp grantResponse
+	if err := c.call(ctx, "/lease/grant", grantRequest{TTL: ttl}, &resp); err != nil {
+		return 0, err
+	}
+
+	if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+
+	return resp.ID, nil
+}
+
+// Revoke revokes the lease with the given id, deleting the keys attached to
+// it.
+func (c *Client) Revoke(ctx context.Context, id int64) error {
+	var resp struct{}
+	return c.call(ctx, "/lease/revoke", revokeRequest{ID: id}, &resp)
+}
+
+// Watch blocks until a key starting with prefix is modified at or after
+// revision rev. If the revision has already been compacted, Watch returns
+// immediately, as the keys may have been modified since.
+func (c *Client) Watch(ctx context.Context, prefix string, rev int64) error {
+	var req watchRequest
+	req.CreateRequest.Key = []byte(prefix)
+	req.CreateRequest.RangeEnd = prefixEnd([]byte(prefix))
+	req.CreateRequest.StartRevision = rev
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return c.withToken(ctx, func(token string) error {
+		var lastErr error
+		for _, ep := range c.endpoints {
+			var resp *http.Response
+			resp, lastErr = c.do(ctx, ep+apiPrefix+"/watch", token, body)
+			if lastErr != nil {
+				if _, ok := lastErr.(*Error); ok {
+					return lastErr
+				}
+				continue
+			}
+			defer resp.Body.Close()
+
+			// the gateway streams one response object per watch event
+			// batch, the first of which only confirms the watch was
+			// created.
+			dec := json.NewDecoder(resp.Body)
+			for {
+				var wr watchResponse
+				if err := dec.Decode(&wr); err != nil {
+					return err
+				}
+
+				switch {
+				case wr.Error != nil:
+					return wr.Error
+				case wr.Result.CompactRevision != 0, len(wr.Result.Events) > 0:
+					return nil
+				case wr.Result.Canceled:
+					return fmt.Errorf("etcd: watch canceled: %s", wr.Result.CancelReason)
+				}
+			}
+		}
+
+		return lastErr
+	})
+}
+
+// call posts req to the given API method and decodes the response into resp.
+// Endpoints are tried in order until one of them can be reached.
+func (c *Client) call(ctx context.Context, method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return c.withToken(ctx, func(token string) error {
+		var lastErr error
+		for _, ep := range c.endpoints {
+			var b []byte
+			b, lastErr = c.post(ctx, ep+apiPrefix+method, token, body)
+			if lastErr != nil {
+				if _, ok := lastErr.(*Error); ok {
+					return lastErr
+				}
+				continue
+			}
+
+			return json.Unmarshal(b, resp)
+		}
+
+		return lastErr
+	})
+}
+
+// withToken calls f with the token to use for requests. If etcd rejects the
+// token, e.g. because it expired, a new one is fetched and f is called once
+// more.
+func (c *Client) withToken(ctx context.Context, f func(token string) error) error {
+	token, err := c.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = f(token)
+	if c.username == "" || !isInvalidToken(err) {
+		return err
+	}
+
+	c.resetToken(token)
+	if token, err = c.authenticate(ctx); err != nil {
+		return err
+	}
+
+	return f(token)
+}
+
+// isInvalidToken reports whether err is etcd rejecting the auth token of a
+// request.
+func isInvalidToken(err error) bool {
+	eerr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+
+	return eerr.Code == codeUnauthenticated || eerr.Code == http.StatusUnauthorized || strings.Contains(eerr.Message, "invalid auth token")
+}
+
+// authenticate returns the token to use for requests, fetching one from etcd
+// the first time it is needed. If no username is configured, it returns the
+// empty string.
+func (c *Client) authenticate(ctx context.Context) (string, error) {
+	if c.username == "" {
+		return "", nil
+	}
+
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	body, err := json.Marshal(authRequest{Name: c.username, Password: c.password})
+	if err != nil {
+		return "", err
+	}
+
+	var lastErr error
+	for _, ep := range c.endpoints {
+		var b []byte
+		b, lastErr = c.post(ctx, ep+apiPrefix+"/auth/authenticate", "", body)
+		if lastErr != nil {
+			continue
+		}
+
+		var resp authResponse
+		if err := json.Unmarshal(b, &resp); err != nil {
+			return "", err
+		}
+		c.token = resp.Token
+		return c.token, nil
+	}
+
+	return "", lastErr
+}
+
+// resetToken forgets the cached token, unless it was already replaced by
+// another request.
+func (c *Client) resetToken(token string) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+func (c *Client) post(ctx context.Context, url, token string, body []byte) ([]byte, error) {
+	resp, err := c.do(ctx, url, token, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// do posts body to url, returning the response if the request succeeded. The
+// caller must close the response body.
+func (c *Client) do(ctx context.Context, url, token string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// Request.WithContext needs go 1.7
+	req.Cancel = ctx.Done()
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		// older gateways report the message in the error field.
+		var body struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Err     string `json:"error"`
+		}
+		json.Unmarshal(b, &body)
+
+		eerr := &Error{Code: body.Code, Message: body.Message}
+		if eerr.Message == "" {
+			eerr.Message = body.Err
+		}
+		if eerr.Message == "" {
+			eerr.Code = resp.StatusCode
+			eerr.Message = strings.TrimSpace(string(b))
+		}
+		return nil, eerr
+	}
+
+	return resp, nil
+}
+
+// prefixEnd returns the end of the range of keys starting with prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// the prefix is all 0xff, so the range is everything after it
+	return []byte{0}
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	for i, tt := range []struct {
+		prefix string
+		want   string
+	}{
+		{"a", "b"},
+		{"foo/", "foo0"},
+		{"a\xff", "b"},
+		{"\xff\xff", "\x00"},
+	} {
+		if got := string(prefixEnd([]byte(tt.prefix))); got != tt.want {
+			t.Errorf("case %d: got %q want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestCompareMarshal(t *testing.T) {
+	for i, tt := range []struct {
+		c    Compare
+		want string
+		err  bool
+	}{
+		{Compare{Key: "a", Target: TargetMod, Revision: 5}, `{"key":"YQ==","mod_revision":5,"result":"EQUAL","target":"MOD"}`, false},
+		{Compare{Key: "a", Target: TargetCreate}, `{"create_revision":0,"key":"YQ==","result":"EQUAL","target":"CREATE"}`, false},
+		{Compare{Key: "a", Target: "VALUE"}, "", true},
+	} {
+		b, err := json.Marshal(tt.c)
+		if (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected error state: %v", i, err)
+			continue
+		}
+		if string(b) != tt.want && !tt.err {
+			t.Errorf("case %d: got %s want %s", i, b, tt.want)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization")+" "+string(body))
+
+		switch r.URL.Path {
+		case "/v3/auth/authenticate":
+			w.Write([]byte(`{"token":"secret"}`))
+		case "/v3/kv/range":
+			w.Write([]byte(`{"header":{"revision":"7"},"kvs":[{"key":"Zm9v","value":"YmFy","create_revision":"2","mod_revision":"7","version":"3"}],"count":"1"}`))
+		case "/v3/kv/txn":
+			w.Write([]byte(`{"header":{"revision":"8"},"succeeded":true}`))
+		case "/v3/lease/grant":
+			w.Write([]byte(`{"header":{},"ID":"1234","TTL":"60"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found","code":5,"message":"not found"}`))
+		}
+	}))
+	defer srv.Close()
+
+	// the first endpoint is unreachable, so every call falls over to the
+	// second one.
+	c, err := New(Config{Endpoints: []string{"http://127.0.0.1:1", srv.URL + "/"}, Username: "root", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, err := c.Range(context.Background(), "foo", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*KeyValue{{Key: []byte("foo"), Value: []byte("bar"), CreateRevision: 2, ModRevision: 7, Version: 3}}
+	if !reflect.DeepEqual(kvs, want) {
+		t.Errorf("unexpected range result: got %#v want %#v", kvs, want)
+	}
+
+	ok, err := c.Txn(context.Background(), &Txn{Success: []Op{OpPut("foo", []byte("baz"), 1234), OpDelete("bar")}})
+	if err != nil || !ok {
+		t.Errorf("unexpected txn result: %v %v", ok, err)
+	}
+
+	id, err := c.Grant(context.Background(), 60)
+	if err != nil || id != 1234 {
+		t.Errorf("unexpected grant result: %v %v", id, err)
+	}
+
+	wantRequests := []string{
+		`/v3/auth/authenticate  {"name":"root","password":"pw"}`,
+		`/v3/kv/range secret {"key":"Zm9v","range_end":"Zm9w"}`,
+		`/v3/kv/txn secret {"success":[{"request_put":{"key":"Zm9v","value":"YmF6","lease":1234}},{"request_delete_range":{"key":"YmFy"}}]}`,
+		`/v3/lease/grant secret {"TTL":60}`,
+	}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("unexpected requests:\ngot  %q\nwant %q", requests, wantRequests)
+	}
+
+	c.endpoints = []string{srv.URL + "/missing"}
+	_, err = c.Range(context.Background(), "foo", false)
+	if eerr, ok := err.(*Error); !ok || eerr.Code != 5 {
+		t.Errorf("expected etcd error, got %#v", err)
+	}
+
+	if _, err := New(Config{}); err != ErrNoEndpoints {
+		t.Errorf("expected ErrNoEndpoints, got %v", err)
+	}
+}
+
+func TestClientTokenExpiry(t *testing.T) {
+	var (
+		tokens   int
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+
+		switch {
+		case r.URL.Path == "/v3/auth/authenticate":
+			tokens++
+			fmt.Fprintf(w, `{"token":"token%d"}`, tokens)
+		case r.Header.Get("Authorization") != fmt.Sprintf("token%d", tokens):
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"etcdserver: invalid auth token","code":16}`))
+		default:
+			w.Write([]byte(`{"header":{},"kvs":[]}`))
+		}
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{Endpoints: []string{srv.URL}, Username: "root", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Range(context.Background(), "foo", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// etcd forgets the token, e.g. because it expired
+	tokens++
+	if _, err := c.Range(context.Background(), "foo", false); err != nil {
+		t.Fatalf("expected the client to log in again, got %v", err)
+	}
+
+	wantRequests := []string{
+		"/v3/auth/authenticate ",
+		"/v3/kv/range token1",
+		"/v3/kv/range token1",
+		"/v3/auth/authenticate ",
+		"/v3/kv/range token3",
+	}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("unexpected requests:\ngot  %q\nwant %q", requests, wantRequests)
+	}
+
+	// a token which is refused right away is not retried forever
+	c.resetToken(c.token)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/auth/authenticate" {
+			w.Write([]byte(`{"token":"bad"}`))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"etcdserver: invalid auth token","code":16}`))
+	})
+	_, err = c.Range(context.Background(), "foo", false)
+	if eerr, ok := err.(*Error); !ok || eerr.Code != codeUnauthenticated {
+		t.Errorf("expected invalid token error, got %#v", err)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	for i, tt := range []struct {
+		stream string
+		err    bool
+	}{
+		{`{"result":{"header":{},"created":true}}` + "\n" + `{"result":{"header":{},"events":[{"kv":{"key":"Zm9v"}}]}}`, false},
+		{`{"result":{"header":{},"created":true}}{"result":{"compact_revision":"3"}}`, false},
+		{`{"result":{"header":{},"created":true}}{"error":{"code":14,"message":"unavailable"}}`, true},
+		{`{"result":{"header":{},"created":true}}{"result":{"canceled":true}}`, true},
+		{`{"result":{"header":{},"created":true}}`, true},
+	} {
+		var got watchRequest
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&got)
+			w.Write([]byte(tt.stream))
+		}))
+
+		c, err := New(Config{Endpoints: []string{srv.URL}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Watch(context.Background(), "foo/", 5)
+		if (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected error state: %v", i, err)
+		}
+
+		if string(got.CreateRequest.Key) != "foo/" || string(got.CreateRequest.RangeEnd) != "foo0" || got.CreateRequest.StartRevision != 5 {
+			t.Errorf("case %d: unexpected watch request: %#v", i, got)
+		}
+
+		srv.Close()
+	}
+}
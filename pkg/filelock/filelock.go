@@ -26,12 +26,17 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
 
 	"github.com/rkt/rkt/pkg/lock"
 )
 
 var AlreadyUnlockedErr = errors.New("lock is already unlocked")
 
+// AlreadyLockedErr is returned by NewExclusiveLock if the file is locked by
+// someone else.
+var AlreadyLockedErr = errors.New("file is already locked")
+
 // UpdateableFileLock is a filelock which can be updated atomically
 type UpdateableFileLock struct {
 	// lockLock protects updating of the file lock. It ensures that `unlock` will
@@ -44,23 +49,27 @@ type UpdateableFileLock struct {
 }
 
 // NewExclusiveLock creates a new exclusive filelock.
-// The given filepath must exist.
+// The given filepath must exist. If the file is already locked,
+// AlreadyLockedErr is returned.
 func NewExclusiveLock(path string) (*UpdateableFileLock, error) {
-	flock, err := lock.TryExclusiveLock(path, lock.RegFile)
+	flock, err := tryExclusiveLock(path)
 	if err != nil {
 		return nil, err
 	}
 	fi, err := os.Stat(path)
 	if err != nil {
+		flock.Close()
 		return nil, err
 	}
-	// Note: if we expected the file to ever be deleted and recreated while an
-	// ExLock isn't held, we would have to check the fd is still correct here.
-	// However, the file is created once and never deleted outside of the safely
-	// handled renames in this package, so it's safe to assume the fd hasn't
-	// changed.
-	// The rename call in this package is "safe" because it leaves no window
-	// where the file at that path does not have an exclusive lock
+	// The file at path may have been replaced by an Update between opening
+	// and locking it, in which case the lock was taken on the old file and
+	// the new one is still locked by whoever updated it.
+	// The rename call in this package is otherwise "safe" because it leaves
+	// no window where the file at that path does not have an exclusive lock
+	if !sameFile(flock, fi) {
+		flock.Close()
+		return nil, AlreadyLockedErr
+	}
 	return &UpdateableFileLock{
 		lock:     flock,
 		path:     path,
@@ -69,6 +78,38 @@ func NewExclusiveLock(path string) (*UpdateableFileLock, error) {
 	}, nil
 }
 
+// tryExclusiveLock takes an exclusive lock on path without blocking. Unlike
+// lock.TryExclusiveLock, it does not leak the file descriptor if the lock is
+// held by someone else.
+func tryExclusiveLock(path string) (*lock.FileLock, error) {
+	flock, err := lock.NewLock(path, lock.RegFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock.TryExclusiveLock(); err != nil {
+		flock.Close()
+		if err == lock.ErrLocked {
+			return nil, AlreadyLockedErr
+		}
+		return nil, err
+	}
+	return flock, nil
+}
+
+// sameFile reports whether flock holds the file described by fi.
+func sameFile(flock *lock.FileLock, fi os.FileInfo) bool {
+	fd, err := flock.Fd()
+	if err != nil {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return false
+	}
+	pst, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Dev == pst.Dev && st.Ino == pst.Ino
+}
+
 // Update writes the given contents into the filelock atomically
 func (l *UpdateableFileLock) Update(contents io.Reader) error {
 	lockDir := filepath.Dir(l.path)
@@ -88,7 +129,7 @@ func (l *UpdateableFileLock) Update(contents io.Reader) error {
 		return err
 	}
 
-	newFileLock, err := lock.TryExclusiveLock(newFile.Name(), lock.RegFile)
+	newFileLock, err := tryExclusiveLock(newFile.Name())
 	if err != nil {
 		os.Remove(newFile.Name())
 		return fmt.Errorf("could not lock tmpfile: %v", err)
@@ -98,18 +139,20 @@ func (l *UpdateableFileLock) Update(contents io.Reader) error {
 	defer l.lockLock.Unlock()
 
 	if !l.isLocked {
+		newFileLock.Close()
 		os.Remove(newFile.Name())
 		return AlreadyUnlockedErr
 	}
 	// Overwrite the old lock with our new one that has the correct contents
 	err = os.Rename(newFile.Name(), l.path)
 	if err != nil {
+		newFileLock.Close()
 		return err
 	}
 	// Lock overwritten, update our internal state while we still hold the mutex
 	oldLock := l.lock
 	l.lock = newFileLock
-	oldLock.Unlock()
+	oldLock.Close()
 	return nil
 }
 
@@ -122,5 +165,6 @@ func (l *UpdateableFileLock) Unlock() error {
 		return AlreadyUnlockedErr
 	}
 	l.isLocked = false
-	return l.lock.Unlock()
+	// closing the file descriptor releases the lock as well
+	return l.lock.Close()
 }
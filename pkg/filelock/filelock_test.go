@@ -20,6 +20,8 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/rkt/rkt/pkg/lock"
 )
 
 func TestFileLock(t *testing.T) {
@@ -47,8 +49,8 @@ func TestFileLock(t *testing.T) {
 	assertContents(t, lockPath, "bar")
 
 	_, err = NewExclusiveLock(lockPath)
-	if err == nil {
-		t.Fatalf("was able to make a new lock; expected lock to still be held")
+	if err != AlreadyLockedErr {
+		t.Fatalf("expected lock to still be held, got %v", err)
 	}
 
 	if err := ulock.Unlock(); err != nil {
@@ -61,6 +63,46 @@ func TestFileLock(t *testing.T) {
 	}
 }
 
+func TestFileLockReplaced(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "locksmith_filelock_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	lockPath := filepath.Join(tmpDir, "lock")
+	if err := ioutil.WriteFile(lockPath, nil, 0644); err != nil {
+		t.Fatalf("error creating test file: %v", err)
+	}
+
+	ulock, err := NewExclusiveLock(lockPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// open the file before it is replaced, as a concurrent NewExclusiveLock
+	// might, and lock it once the update released the old file.
+	stale, err := lock.NewLock(lockPath, lock.RegFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer stale.Close()
+
+	if err := ulock.Update(strings.NewReader("foo")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := stale.TryExclusiveLock(); err != nil {
+		t.Fatalf("expected the replaced file to be unlocked: %v", err)
+	}
+
+	fi, err := os.Stat(lockPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sameFile(stale, fi) {
+		t.Error("lock on the replaced file should not count as a lock on the new one")
+	}
+}
+
 func assertContents(t *testing.T, path string, contents string) {
 	//t.Helper() once go 1.9 is the only supported version
 	data, err := ioutil.ReadFile(path)
@@ -0,0 +1,383 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package k8s is a minimal client for the Kubernetes API. It talks to the
+// API server over plain HTTP and JSON, and only implements the handful of
+// calls locksmith needs.
+package k8s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+var (
+	// ErrNoHost is returned if a client is configured without a host.
+	ErrNoHost = errors.New("no Kubernetes API server configured")
+	// ErrNotInCluster is returned by InClusterConfig if it is not called
+	// from within a pod.
+	ErrNotInCluster = errors.New("not running in a Kubernetes cluster")
+)
+
+// Config holds the configuration of a Client.
+type Config struct {
+	// Host is the URL of the API server.
+	Host string
+	// Transport is used for all requests. If nil, http.DefaultTransport is
+	// used.
+	Transport http.RoundTripper
+	// BearerToken is sent with every request if set.
+	BearerToken string
+}
+
+// InClusterConfig returns the configuration for a client running in a pod,
+// using the service account Kubernetes mounts into every pod.
+func InClusterConfig() (Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return Config{}, ErrNotInCluster
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return Config{}, err
+	}
+
+	transport, err := NewTransport(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Config{
+		Host:        "https://" + net.JoinHostPort(host, port),
+		Transport:   transport,
+		BearerToken: strings.TrimSpace(string(token)),
+	}, nil
+}
+
+// NewTransport returns an http.Transport trusting the CA certificates in
+// caFile, or the system roots if caFile is empty.
+func NewTransport(caFile string) (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout,
+	}
+	if caFile == "" {
+		return transport, nil
+	}
+
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	capool := x509.NewCertPool()
+	if !capool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: capool}
+
+	return transport, nil
+}
+
+// Client is a client for the Kubernetes API.
+type Client struct {
+	host  string
+	hc    *http.Client
+	token string
+}
+
+// New creates a new Client from the given configuration.
+func New(cfg Config) (*Client, error) {
+	if cfg.Host == "" {
+		return nil, ErrNoHost
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &Client{
+		host:  strings.TrimRight(cfg.Host, "/"),
+		hc:    &http.Client{Transport: transport},
+		token: cfg.BearerToken,
+	}, nil
+}
+
+// StatusError is an error returned by the API server.
+type StatusError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kubernetes: %s (%s, code %d)", e.Message, e.Reason, e.Code)
+}
+
+// Reasons of StatusError.
+const (
+	ReasonNotFound      = "NotFound"
+	ReasonAlreadyExists = "AlreadyExists"
+	ReasonConflict      = "Conflict"
+	ReasonExpired       = "Expired"
+	ReasonGone          = "Gone"
+)
+
+// IsTooManyRequests reports whether err is a StatusError because the request
+// was refused for the time being, e.g. an eviction which would violate a
+// PodDisruptionBudget.
+func IsTooManyRequests(err error) bool {
+	serr, ok := err.(*StatusError)
+	return ok && serr.Code == http.StatusTooManyRequests
+}
+
+// IsNotFound reports whether err is a StatusError because an object does not
+// exist.
+func IsNotFound(err error) bool {
+	return hasReason(err, ReasonNotFound)
+}
+
+// IsAlreadyExists reports whether err is a StatusError because an object
+// being created already exists.
+func IsAlreadyExists(err error) bool {
+	return hasReason(err, ReasonAlreadyExists)
+}
+
+// IsConflict reports whether err is a StatusError because an object was
+// modified since the resource version it was updated with.
+func IsConflict(err error) bool {
+	return hasReason(err, ReasonConflict)
+}
+
+func hasReason(err error, reason string) bool {
+	serr, ok := err.(*StatusError)
+	return ok && serr.Reason == reason
+}
+
+// ObjectMeta is the metadata common to all objects.
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	OwnerReferences []OwnerReference  `json:"ownerReferences,omitempty"`
+}
+
+// OwnerReference identifies the object owning another object, e.g. the
+// DaemonSet of a Pod.
+type OwnerReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// ConfigMap is a Kubernetes ConfigMap.
+type ConfigMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+// NewConfigMap returns an empty ConfigMap with the given name.
+func NewConfigMap(namespace, name string) *ConfigMap {
+	return &ConfigMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   ObjectMeta{Name: name, Namespace: namespace},
+	}
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func configMapsPath(namespace string) string {
+	return "/api/v1/namespaces/" + pathEscape(namespace) + "/configmaps"
+}
+
+// GetConfigMap returns the ConfigMap with the given name.
+func (c *Client) GetConfigMap(ctx context.Context, namespace, name string) (*ConfigMap, error) {
+	cm := &ConfigMap{}
+	if err := c.call(ctx, "GET", configMapsPath(namespace)+"/"+pathEscape(name), nil, cm); err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// CreateConfigMap creates cm and returns it as stored by the API server.
+func (c *Client) CreateConfigMap(ctx context.Context, cm *ConfigMap) (*ConfigMap, error) {
+	ret := &ConfigMap{}
+	if err := c.call(ctx, "POST", configMapsPath(cm.Metadata.Namespace), cm, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// UpdateConfigMap replaces the ConfigMap named by cm and returns it as stored
+// by the API server. If cm carries a resource version, the update fails with
+// a conflict unless it is still the version of the stored ConfigMap.
+func (c *Client) UpdateConfigMap(ctx context.Context, cm *ConfigMap) (*ConfigMap, error) {
+	ret := &ConfigMap{}
+	path := configMapsPath(cm.Metadata.Namespace) + "/" + pathEscape(cm.Metadata.Name)
+	if err := c.call(ctx, "PUT", path, cm, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// WatchConfigMap blocks until the ConfigMap with the given name is modified
+// after resourceVersion. If the resource version is too old to watch from,
+// WatchConfigMap returns immediately, as the ConfigMap may have been modified
+// since.
+func (c *Client) WatchConfigMap(ctx context.Context, namespace, name, resourceVersion string) error {
+	q := url.Values{}
+	q.Set("watch", "true")
+	q.Set("fieldSelector", "metadata.name="+name)
+	q.Set("resourceVersion", resourceVersion)
+
+	resp, err := c.do(ctx, "GET", configMapsPath(namespace)+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				// the server ends watches after a while, which
+				// callers treat like any other wakeup.
+				return nil
+			}
+			return err
+		}
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			return nil
+		case "ERROR":
+			serr := &StatusError{}
+			if err := json.Unmarshal(ev.Object, serr); err != nil {
+				return err
+			}
+			if serr.Reason == ReasonExpired || serr.Reason == ReasonGone || serr.Code == http.StatusGone {
+				return nil
+			}
+			return serr
+		}
+	}
+}
+
+// call sends req to path and decodes the response into resp.
+func (c *Client) call(ctx context.Context, method, path string, req, resp interface{}) error {
+	var body []byte
+	if req != nil {
+		var err error
+		body, err = json.Marshal(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	r, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// pathEscape escapes s for use as a single path segment. url.PathEscape
+// needs go 1.8.
+func pathEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// do sends body to path, returning the response if the request succeeded.
+// The caller must close the response body.
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var rbody io.Reader
+	if body != nil {
+		rbody = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, c.host+path, rbody)
+	if err != nil {
+		return nil, err
+	}
+	// Request.WithContext needs go 1.7
+	req.Cancel = ctx.Done()
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		contentType := "application/json"
+		if method == "PATCH" {
+			contentType = "application/merge-patch+json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		serr := &StatusError{}
+		if err := json.Unmarshal(b, serr); err != nil || serr.Message == "" {
+			serr.Code = resp.StatusCode
+			serr.Message = strings.TrimSpace(string(b))
+		}
+		return nil, serr
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestPathEscape(t *testing.T) {
+	for i, tt := range []struct {
+		s    string
+		want string
+	}{
+		{"locksmith-rack-12", "locksmith-rack-12"},
+		{"a b/c+d", "a%20b%2Fc%2Bd"},
+	} {
+		if got := pathEscape(tt.s); got != tt.want {
+			t.Errorf("case %d: got %q want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization")+" "+string(body))
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/namespaces/kube-system/configmaps/lock":
+			w.Write([]byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"lock","namespace":"kube-system","resourceVersion":"7"},"data":{"semaphore":"{}"}}`))
+		case "POST /api/v1/namespaces/kube-system/configmaps":
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"kind":"Status","status":"Failure","message":"configmaps \"lock\" already exists","reason":"AlreadyExists","code":409}`))
+		case "PUT /api/v1/namespaces/kube-system/configmaps/lock":
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"kind":"Status","status":"Failure","message":"the object has been modified","reason":"Conflict","code":409}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`forbidden`))
+		}
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{Host: srv.URL + "/", BearerToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := c.GetConfigMap(context.Background(), "kube-system", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ConfigMap{APIVersion: "v1", Kind: "ConfigMap", Metadata: ObjectMeta{Name: "lock", Namespace: "kube-system", ResourceVersion: "7"}, Data: map[string]string{"semaphore": "{}"}}
+	if !reflect.DeepEqual(cm, want) {
+		t.Errorf("unexpected ConfigMap: got %#v want %#v", cm, want)
+	}
+
+	cm = NewConfigMap("kube-system", "lock")
+	if _, err := c.CreateConfigMap(context.Background(), cm); !IsAlreadyExists(err) {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+
+	cm.Metadata.ResourceVersion = "6"
+	if _, err := c.UpdateConfigMap(context.Background(), cm); !IsConflict(err) {
+		t.Errorf("expected Conflict, got %v", err)
+	}
+
+	_, err = c.GetConfigMap(context.Background(), "default", "lock")
+	if serr, ok := err.(*StatusError); !ok || serr.Code != http.StatusForbidden || serr.Message != "forbidden" {
+		t.Errorf("expected status error, got %#v", err)
+	}
+	if IsNotFound(err) {
+		t.Error("forbidden should not be reported as not found")
+	}
+
+	wantRequests := []string{
+		`GET /api/v1/namespaces/kube-system/configmaps/lock Bearer secret `,
+		`POST /api/v1/namespaces/kube-system/configmaps Bearer secret {"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"lock","namespace":"kube-system"}}`,
+		`PUT /api/v1/namespaces/kube-system/configmaps/lock Bearer secret {"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"lock","namespace":"kube-system","resourceVersion":"6"}}`,
+		`GET /api/v1/namespaces/default/configmaps/lock Bearer secret `,
+	}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("unexpected requests:\ngot  %q\nwant %q", requests, wantRequests)
+	}
+
+	if _, err := New(Config{}); err != ErrNoHost {
+		t.Errorf("expected ErrNoHost, got %v", err)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	for i, tt := range []struct {
+		stream string
+		err    bool
+	}{
+		{`{"type":"MODIFIED","object":{"metadata":{"name":"lock"}}}`, false},
+		{`{"type":"ERROR","object":{"kind":"Status","reason":"Expired","message":"too old resource version","code":410}}`, false},
+		{`{"type":"ERROR","object":{"kind":"Status","reason":"InternalError","message":"boom","code":500}}`, true},
+		{``, false},
+		{`{"type":`, true},
+	} {
+		var query string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.Path + "?" + r.URL.RawQuery
+			w.Write([]byte(tt.stream))
+		}))
+
+		c, err := New(Config{Host: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.WatchConfigMap(context.Background(), "kube-system", "lock", "5")
+		if (err != nil) != tt.err {
+			t.Errorf("case %d: unexpected error state: %v", i, err)
+		}
+
+		if want := "/api/v1/namespaces/kube-system/configmaps?fieldSelector=metadata.name%3Dlock&resourceVersion=5&watch=true"; query != want {
+			t.Errorf("case %d: unexpected watch request: got %s want %s", i, query, want)
+		}
+
+		srv.Close()
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+// Node is a Kubernetes Node.
+type Node struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       NodeSpec   `json:"spec"`
+}
+
+// NodeSpec is the specification of a Node.
+type NodeSpec struct {
+	// Unschedulable is set on cordoned nodes, which no new pods are
+	// scheduled on.
+	Unschedulable bool `json:"unschedulable,omitempty"`
+}
+
+// Pod is a Kubernetes Pod.
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     PodSpec    `json:"spec"`
+	Status   PodStatus  `json:"status"`
+}
+
+// PodSpec is the specification of a Pod.
+type PodSpec struct {
+	NodeName string `json:"nodeName,omitempty"`
+}
+
+// PodStatus is the status of a Pod.
+type PodStatus struct {
+	// Phase is e.g. Running, or Succeeded or Failed for pods which have
+	// terminated.
+	Phase string `json:"phase,omitempty"`
+}
+
+type podList struct {
+	Items []Pod `json:"items"`
+}
+
+type eviction struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+}
+
+func podsPath(namespace string) string {
+	return "/api/v1/namespaces/" + pathEscape(namespace) + "/pods"
+}
+
+// GetNode returns the Node with the given name.
+func (c *Client) GetNode(ctx context.Context, name string) (*Node, error) {
+	node := &Node{}
+	if err := c.call(ctx, "GET", "/api/v1/nodes/"+pathEscape(name), nil, node); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// PatchNode applies the JSON merge patch to the Node with the given name and
+// returns it as stored by the API server.
+func (c *Client) PatchNode(ctx context.Context, name string, patch interface{}) (*Node, error) {
+	node := &Node{}
+	if err := c.call(ctx, "PATCH", "/api/v1/nodes/"+pathEscape(name), patch, node); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// ListNodePods returns the pods of all namespaces scheduled on the given
+// node.
+func (c *Client) ListNodePods(ctx context.Context, node string) ([]Pod, error) {
+	q := url.Values{}
+	q.Set("fieldSelector", "spec.nodeName="+node)
+
+	var list podList
+	if err := c.call(ctx, "GET", "/api/v1/pods?"+q.Encode(), nil, &list); err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// GetPod returns the Pod with the given name.
+func (c *Client) GetPod(ctx context.Context, namespace, name string) (*Pod, error) {
+	pod := &Pod{}
+	if err := c.call(ctx, "GET", podsPath(namespace)+"/"+pathEscape(name), nil, pod); err != nil {
+		return nil, err
+	}
+
+	return pod, nil
+}
+
+// EvictPod asks the API server to evict the Pod with the given name. The
+// eviction is refused with a StatusError for which IsTooManyRequests is true
+// if it would violate a PodDisruptionBudget.
+func (c *Client) EvictPod(ctx context.Context, namespace, name string) error {
+	ev := &eviction{
+		APIVersion: "policy/v1beta1",
+		Kind:       "Eviction",
+		Metadata:   ObjectMeta{Name: name, Namespace: namespace},
+	}
+
+	var resp struct{}
+	return c.call(ctx, "POST", podsPath(namespace)+"/"+pathEscape(name)+"/eviction", ev, &resp)
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestNodes(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("Content-Type")+" "+string(body))
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/nodes/core-01", "PATCH /api/v1/nodes/core-01":
+			w.Write([]byte(`{"apiVersion":"v1","kind":"Node","metadata":{"name":"core-01"},"spec":{"unschedulable":true}}`))
+		case "GET /api/v1/pods":
+			w.Write([]byte(`{"items":[{"metadata":{"name":"web-1","namespace":"default","uid":"1","ownerReferences":[{"kind":"ReplicaSet","name":"web"}]},"spec":{"nodeName":"core-01"},"status":{"phase":"Running"}}]}`))
+		case "POST /api/v1/namespaces/default/pods/web-1/eviction":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"kind":"Status","status":"Failure","message":"Cannot evict pod as it would violate the pod's disruption budget.","reason":"TooManyRequests","code":429}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","status":"Failure","message":"not found","reason":"NotFound","code":404}`))
+		}
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := c.PatchNode(context.Background(), "core-01", map[string]interface{}{"spec": map[string]bool{"unschedulable": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.Spec.Unschedulable {
+		t.Errorf("unexpected node: %#v", node)
+	}
+
+	pods, err := c.ListNodePods(context.Background(), "core-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Pod{{
+		Metadata: ObjectMeta{Name: "web-1", Namespace: "default", UID: "1", OwnerReferences: []OwnerReference{{Kind: "ReplicaSet", Name: "web"}}},
+		Spec:     PodSpec{NodeName: "core-01"},
+		Status:   PodStatus{Phase: "Running"},
+	}}
+	if !reflect.DeepEqual(pods, want) {
+		t.Errorf("unexpected pods: got %#v want %#v", pods, want)
+	}
+
+	if err := c.EvictPod(context.Background(), "default", "web-1"); !IsTooManyRequests(err) {
+		t.Errorf("expected TooManyRequests, got %v", err)
+	}
+
+	if _, err := c.GetPod(context.Background(), "default", "web-1"); !IsNotFound(err) {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+
+	wantRequests := []string{
+		`PATCH /api/v1/nodes/core-01 application/merge-patch+json {"spec":{"unschedulable":true}}`,
+		`GET /api/v1/pods?fieldSelector=spec.nodeName%3Dcore-01  `,
+		`POST /api/v1/namespaces/default/pods/web-1/eviction application/json {"apiVersion":"policy/v1beta1","kind":"Eviction","metadata":{"name":"web-1","namespace":"default"}}`,
+		`GET /api/v1/namespaces/default/pods/web-1  `,
+	}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("unexpected requests:\ngot  %q\nwant %q", requests, wantRequests)
+	}
+}